@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/dragonfleas/kungfu/internal/parser"
+)
+
+// defaultVariant is the name builds without --variant are recorded under.
+const defaultVariant = parser.ReservedVariantName
+
+func modulesJSONPath(rootPath string) string {
+	return filepath.Join(rootPath, ".terraform", "modules", "modules.json")
+}
+
+func buildStatePath(rootPath string) string {
+	return filepath.Join(rootPath, ".terraform", "kungfu", "state.json")
+}
+
+// manifestDir returns dir in the form modules.json uses: relative to the root
+// module when dir is inside it.
+func manifestDir(rootPath, dir string) string {
+	rel, err := filepath.Rel(rootPath, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return dir
+	}
+	return rel
+}
+
+// loadBuildState reads the build state of a root module, returning an empty
+// state when no build has been recorded yet.
+func loadBuildState(rootPath string) (*models.BuildState, error) {
+	state := &models.BuildState{
+		Original: make(map[string]string),
+		Variants: make(map[string]map[string]string),
+	}
+
+	data, err := os.ReadFile(buildStatePath(rootPath))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read build state: %w", err)
+	}
+	if unmarshalErr := json.Unmarshal(data, state); unmarshalErr != nil {
+		return nil, fmt.Errorf("failed to parse build state: %w", unmarshalErr)
+	}
+	if state.Original == nil {
+		state.Original = make(map[string]string)
+	}
+	if state.Variants == nil {
+		state.Variants = make(map[string]map[string]string)
+	}
+	return state, nil
+}
+
+func saveBuildState(rootPath string, state *models.BuildState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal build state: %w", err)
+	}
+	statePath := buildStatePath(rootPath)
+	if mkdirErr := os.MkdirAll(filepath.Dir(statePath), 0750); mkdirErr != nil {
+		return fmt.Errorf("failed to create state directory: %w", mkdirErr)
+	}
+	if writeErr := os.WriteFile(statePath, data, 0600); writeErr != nil {
+		return fmt.Errorf("failed to write build state: %w", writeErr)
+	}
+	return nil
+}
+
+// activateVariant rewrites modules.json so that the modules patched by
+// variant point to their generated copies and every other module points to
+// the directory terraform init chose. An empty variant restores all original
+// directories. Directories found in modules.json that kungfu did not generate
+// are recorded as the new originals, so a later terraform init is picked up.
+func activateVariant(rootPath string, state *models.BuildState, variant string) ([]models.ManifestChange, error) {
+	manifestPath := modulesJSONPath(rootPath)
+	if _, statErr := os.Stat(manifestPath); os.IsNotExist(statErr) {
+		return nil, errors.New("modules.json not found - run 'terraform init' first")
+	}
+
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read modules.json: %w", err)
+	}
+
+	var manifest models.ModulesManifest
+	if unmarshalErr := json.Unmarshal(data, &manifest); unmarshalErr != nil {
+		return nil, fmt.Errorf("failed to parse modules.json: %w", unmarshalErr)
+	}
+
+	generated := make(map[string]bool)
+	for _, dirs := range state.Variants {
+		for _, dir := range dirs {
+			generated[dir] = true
+		}
+	}
+
+	var changes []models.ManifestChange
+	for i := range manifest.Modules {
+		entry := &manifest.Modules[i]
+		if entry.Key == "" {
+			continue
+		}
+
+		if !generated[entry.Dir] {
+			state.Original[entry.Key] = entry.Dir
+		}
+
+		newDir, patched := state.Variants[variant][entry.Key]
+		if !patched {
+			original, known := state.Original[entry.Key]
+			if !known {
+				continue
+			}
+			newDir = original
+		}
+
+		if entry.Dir != newDir {
+			changes = append(changes, models.ManifestChange{
+				Key:    entry.Key,
+				Source: entry.Source,
+				OldDir: entry.Dir,
+				NewDir: newDir,
+			})
+		}
+		entry.Dir = newDir
+	}
+
+	updatedData, marshalErr := json.MarshalIndent(manifest, "", "  ")
+	if marshalErr != nil {
+		return nil, fmt.Errorf("failed to marshal modules.json: %w", marshalErr)
+	}
+
+	if writeErr := os.WriteFile(manifestPath, updatedData, 0600); writeErr != nil {
+		return nil, fmt.Errorf("failed to write modules.json: %w", writeErr)
+	}
+
+	state.Active = variant
+	if saveErr := saveBuildState(rootPath, state); saveErr != nil {
+		return nil, saveErr
+	}
+	return changes, nil
+}
@@ -2,15 +2,18 @@ package cmd
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/dragonfleas/kungfu/internal/models"
 	"github.com/dragonfleas/kungfu/internal/parser"
 	"github.com/dragonfleas/kungfu/internal/patcher"
+	"github.com/hashicorp/hcl/v2"
 	"github.com/spf13/cobra"
 )
 
@@ -22,8 +25,12 @@ func NewBuildCmd() *cobra.Command {
 		Long: `Build reads the root module, finds all module declarations, applies patches
 from overlay files, and generates patched modules.
 
+Settings not given as flags are read from kungfu.hcl in the root module,
+when it exists.
+
 Example:
-  kungfu build . --overlay overlays/production`,
+  kungfu build . --overlay overlays/production
+  kungfu build . --variant production`,
 		Args: cobra.MaximumNArgs(1),
 		RunE: runBuild,
 	}
@@ -32,29 +39,123 @@ Example:
 		"overlay", "",
 		"Specific .kf.hcl file or directory (default: overlays/)")
 	cmd.Flags().StringP(
-		"output", "o", ".terraform/kungfu/modules",
+		"output", "o", defaultOutputDir,
 		"Output directory for patched modules")
+	cmd.Flags().String(
+		"variant", "",
+		"Build a variant declared in kungfu.hcl")
+	cmd.Flags().Bool(
+		"strict", false,
+		"Treat warnings as errors")
+	cmd.Flags().String(
+		"output-format", outputFormatText,
+		"Output format for the build report: text or json")
+	cmd.Flags().StringArray(
+		"var", nil,
+		"Set an overlay variable (name=value); may be repeated")
+	cmd.Flags().StringArray(
+		"var-file", nil,
+		"Load overlay variable values from an HCL file; may be repeated")
 
 	return cmd
 }
 
+const (
+	outputFormatText = "text"
+	outputFormatJSON = "json"
+
+	defaultOverlayDir = "overlays"
+	defaultOutputDir  = ".terraform/kungfu/modules"
+)
+
+// builder carries the state of a single build invocation.
+type builder struct {
+	cmd        *cobra.Command
+	absRoot    string
+	outputDir  string
+	jsonOutput bool
+	settings   models.ProjectSettings
+	// evalCtx is the overlay evaluation context, holding variables, locals
+	// and functions.
+	evalCtx *hcl.EvalContext
+	report  *models.BuildReport
+}
+
+// printf writes human-readable progress output. It is silent in JSON mode so
+// that the report is the only thing written.
+func (b *builder) printf(format string, args ...interface{}) {
+	if b.jsonOutput {
+		return
+	}
+	b.cmd.Printf(format, args...)
+}
+
+// warnf records a warning in the report and prints it in text mode.
+func (b *builder) warnf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	b.report.Warnings = append(b.report.Warnings, msg)
+	b.printf("\nWarning: %s\n", msg)
+}
+
 func runBuild(cmd *cobra.Command, args []string) error {
+	outputFormat, _ := cmd.Flags().GetString("output-format")
+	if outputFormat != outputFormatText && outputFormat != outputFormatJSON {
+		return fmt.Errorf("unsupported output format %q (expected %s or %s)",
+			outputFormat, outputFormatText, outputFormatJSON)
+	}
+
 	absRoot, err := resolveRootPath(args)
 	if err != nil {
 		return err
 	}
 
-	outputDir, _ := cmd.Flags().GetString("output")
+	settings, err := loadProjectSettings(cmd, absRoot)
+	if err != nil {
+		return err
+	}
+
+	variant, _ := cmd.Flags().GetString("variant")
+	b := &builder{
+		cmd:        cmd,
+		absRoot:    absRoot,
+		outputDir:  settings.Output,
+		jsonOutput: outputFormat == outputFormatJSON,
+		settings:   settings,
+		report: &models.BuildReport{
+			RootModule:      absRoot,
+			Variant:         variant,
+			OutputDir:       settings.Output,
+			Overlays:        []models.OverlayReport{},
+			Patches:         []models.AppliedPatch{},
+			FilesWritten:    []string{},
+			ManifestChanges: []models.ManifestChange{},
+			Warnings:        []string{},
+		},
+	}
+
+	buildErr := b.build()
+	if b.jsonOutput {
+		b.report.Success = buildErr == nil
+		if buildErr != nil {
+			b.report.Error = buildErr.Error()
+		}
+		if writeErr := writeJSONReport(cmd.OutOrStdout(), b.report); writeErr != nil {
+			return writeErr
+		}
+	}
+	return buildErr
+}
 
-	cmd.Printf("Root module: %s\n", absRoot)
-	cmd.Printf("Output directory: %s\n", outputDir)
+func (b *builder) build() error {
+	b.printf("Root module: %s\n", b.absRoot)
+	b.printf("Output directory: %s\n", b.outputDir)
 
-	modules, err := loadAndDisplayModules(cmd, absRoot)
+	modules, err := b.loadAndDisplayModules()
 	if err != nil {
 		return err
 	}
 
-	kfFiles, err := loadOverlayFiles(cmd, absRoot)
+	kfFiles, err := b.loadOverlayFiles()
 	if err != nil {
 		return err
 	}
@@ -63,23 +164,38 @@ func runBuild(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
-	allPatches, err := parseOverlayFiles(cmd, kfFiles)
+	allPatches, err := b.parseOverlayFiles(kfFiles)
 	if err != nil {
 		return err
 	}
 
-	patchesBySource := groupPatchesBySource(allPatches)
-
-	if applyErr := applyPatchesToModules(cmd, absRoot, outputDir, modules, patchesBySource); applyErr != nil {
+	patchedModules, applyErr := b.applyPatchesToModules(modules, allPatches)
+	if applyErr != nil {
 		return applyErr
 	}
 
-	if updateErr := updateModulesJSON(absRoot, patchesBySource, modules); updateErr != nil {
+	if b.settings.Strict != nil && *b.settings.Strict && len(b.report.Warnings) > 0 {
+		return fmt.Errorf("strict mode: build produced %d warning(s); modules.json was not updated",
+			len(b.report.Warnings))
+	}
+
+	changes, updateErr := b.activateBuild(patchedModules)
+	if updateErr != nil {
 		return fmt.Errorf("failed to update modules.json: %w", updateErr)
 	}
+	b.report.ManifestChanges = append(b.report.ManifestChanges, changes...)
 
-	cmd.Printf("\nBuild completed successfully!\n")
-	cmd.Printf("Patched modules are now active. Run 'terraform plan' to see changes.\n")
+	b.printf("\nBuild completed successfully!\n")
+	b.printf("Patched modules are now active. Run 'terraform plan' to see changes.\n")
+	return nil
+}
+
+func writeJSONReport(w io.Writer, report *models.BuildReport) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return fmt.Errorf("failed to write build report: %w", err)
+	}
 	return nil
 }
 
@@ -96,29 +212,38 @@ func resolveRootPath(args []string) (string, error) {
 	return absRoot, nil
 }
 
-func loadAndDisplayModules(cmd *cobra.Command, absRoot string) ([]models.ModuleCall, error) {
-	modules, err := parser.ParseRootModule(absRoot)
+func (b *builder) loadAndDisplayModules() ([]models.ModuleCall, error) {
+	modules, err := parser.ParseRootModule(b.absRoot)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse root module: %w", err)
 	}
 
-	cmd.Printf("Found %d module(s) in root module\n", len(modules))
+	installedVersions(b.absRoot, modules)
+
+	b.printf("Found %d module(s) in root module\n", len(modules))
 	for _, mod := range modules {
-		cmd.Printf("  - %s (source: %s)\n", mod.Name, mod.Source)
+		b.printf("  - %s (source: %s)\n", mod.Name, mod.Source)
 	}
 
 	return modules, nil
 }
 
-func loadOverlayFiles(cmd *cobra.Command, absRoot string) ([]string, error) {
-	overlayDir, _ := cmd.Flags().GetString("overlay")
-	if overlayDir == "" {
-		overlayDir = "overlays"
+func (b *builder) loadOverlayFiles() ([]string, error) {
+	var kfFiles []string
+	for _, overlay := range b.settings.Overlays {
+		overlayFiles, err := b.loadOverlayPath(overlay)
+		if err != nil {
+			return nil, err
+		}
+		kfFiles = append(kfFiles, overlayFiles...)
 	}
+	return kfFiles, nil
+}
 
+func (b *builder) loadOverlayPath(overlayDir string) ([]string, error) {
 	overlayPath := overlayDir
 	if !filepath.IsAbs(overlayPath) {
-		overlayPath = filepath.Join(absRoot, overlayDir)
+		overlayPath = filepath.Join(b.absRoot, overlayDir)
 	}
 
 	fileInfo, err := os.Stat(overlayPath)
@@ -132,89 +257,197 @@ func loadOverlayFiles(cmd *cobra.Command, absRoot string) ([]string, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to find overlay files: %w", err)
 		}
-		cmd.Printf("Overlay directory: %s\n", overlayPath)
+		b.printf("Overlay directory: %s\n", overlayPath)
 	} else {
 		if !strings.HasSuffix(overlayPath, ".kf.hcl") {
 			return nil, fmt.Errorf("overlay file must have .kf.hcl extension: %s", overlayPath)
 		}
 		kfFiles = []string{overlayPath}
-		cmd.Printf("Overlay file: %s\n", overlayPath)
+		b.printf("Overlay file: %s\n", overlayPath)
 	}
 
 	if len(kfFiles) == 0 {
-		cmd.Printf("No .kf.hcl files found in %s\n", overlayPath)
+		b.printf("No .kf.hcl files found in %s\n", overlayPath)
 	}
 
 	return kfFiles, nil
 }
 
-func parseOverlayFiles(cmd *cobra.Command, kfFiles []string) ([]models.Patch, error) {
-	cmd.Printf("\nFound %d overlay file(s)\n", len(kfFiles))
+func (b *builder) parseOverlayFiles(kfFiles []string) ([]models.Patch, error) {
+	overlays, err := resolveIncludes(kfFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	b.printf("\nFound %d overlay file(s)\n", len(overlays))
+
+	paths := make([]string, 0, len(overlays))
+	for _, overlay := range overlays {
+		paths = append(paths, overlay.path)
+	}
+	ctx, err := b.overlayEvalContext(paths)
+	if err != nil {
+		return nil, err
+	}
+	b.evalCtx = ctx
 
 	var allPatches []models.Patch
-	for _, kfFile := range kfFiles {
-		config, parseErr := parser.ParseKungfuFile(kfFile)
+	var warnings []string
+	for _, overlay := range overlays {
+		config, parseErr := parser.ParseKungfuFileWithContext(overlay.path, ctx)
 		if parseErr != nil {
-			return nil, fmt.Errorf("failed to parse %s: %w", kfFile, parseErr)
+			return nil, fmt.Errorf("failed to parse %s: %w", overlay.path, parseErr)
+		}
+		warnings = append(warnings, config.Warnings...)
+		for i := range config.Patches {
+			config.Patches[i].Includes = overlay.includes
 		}
 		allPatches = append(allPatches, config.Patches...)
-		cmd.Printf("  - %s (%d patch(es))\n", filepath.Base(kfFile), len(config.Patches))
+		b.report.Overlays = append(b.report.Overlays, models.OverlayReport{
+			Path:       overlay.path,
+			Patches:    len(config.Patches),
+			IncludedBy: overlay.includedBy,
+		})
+		if overlay.includedBy != "" {
+			b.printf("  - %s (%d patch(es), included by %s)\n",
+				filepath.Base(overlay.path), len(config.Patches), filepath.Base(overlay.includedBy))
+		} else {
+			b.printf("  - %s (%d patch(es))\n", filepath.Base(overlay.path), len(config.Patches))
+		}
+	}
+	for _, warning := range warnings {
+		b.warnf("%s", warning)
 	}
 
 	return allPatches, nil
 }
 
-func applyPatchesToModules(
-	cmd *cobra.Command,
-	absRoot string,
-	outputDir string,
+// overlayEvalContext resolves the variables and locals declared across all
+// overlay files and returns the context in which patch expressions are
+// evaluated.
+func (b *builder) overlayEvalContext(kfFiles []string) (*hcl.EvalContext, error) {
+	var declarations []models.OverlayVariable
+	var locals []models.OverlayLocal
+	for _, kfFile := range kfFiles {
+		variables, err := parser.ParseVariableDeclarations(kfFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", kfFile, err)
+		}
+		declarations = append(declarations, variables...)
+
+		fileLocals, err := parser.ParseLocalDeclarations(kfFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", kfFile, err)
+		}
+		locals = append(locals, fileLocals...)
+	}
+
+	vars, _ := b.cmd.Flags().GetStringArray("var")
+	varFiles, _ := b.cmd.Flags().GetStringArray("var-file")
+	values, err := parser.ResolveVariables(declarations, parser.VariableInputs{
+		Vars:            vars,
+		VarFiles:        varFiles,
+		Environ:         os.Environ(),
+		ProjectVarFiles: b.settings.VarFiles,
+		ProjectVars:     b.settings.Vars,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve overlay variables: %w", err)
+	}
+
+	ctx := parser.NewEvalContext(values)
+	if err := parser.EvaluateLocals(ctx, locals); err != nil {
+		return nil, fmt.Errorf("failed to evaluate overlay locals: %w", err)
+	}
+	return ctx, nil
+}
+
+// applyPatchesToModules patches every module that has at least one matching
+// patch and returns the names of the modules that were generated.
+func (b *builder) applyPatchesToModules(
 	modules []models.ModuleCall,
-	patchesBySource map[string][]models.Patch,
-) error {
-	for source, patches := range patchesBySource {
-		module := findModuleBySource(modules, source)
-		if module == nil {
-			cmd.Printf("\nWarning: No module found for source %s, skipping patches\n", source)
+	patches []models.Patch,
+) (map[string]bool, error) {
+	for _, source := range unmatchedSources(modules, patches) {
+		b.warnf("No module found for source %s, skipping patches", source)
+	}
+
+	// Modules are patched in root module declaration order so that output and
+	// logs are reproducible between runs.
+	patchedModules := make(map[string]bool)
+	for i := range modules {
+		module := &modules[i]
+		modulePatches, err := b.patchesForModule(*module, patches)
+		if err != nil {
+			return nil, err
+		}
+		if len(modulePatches) == 0 {
 			continue
 		}
 
-		if err := patchSingleModule(cmd, absRoot, outputDir, module, patches); err != nil {
-			return err
+		patched, err := b.patchSingleModule(module, modulePatches)
+		if err != nil {
+			return nil, err
+		}
+		if patched {
+			patchedModules[module.Name] = true
 		}
 	}
-	return nil
+	return patchedModules, nil
 }
 
-func patchSingleModule(
-	cmd *cobra.Command,
-	absRoot string,
-	outputDir string,
-	module *models.ModuleCall,
-	patches []models.Patch,
-) error {
-	cmd.Printf("\nPatching module %s (source: %s)\n", module.Name, module.Source)
-	cmd.Printf("  Module path: %s\n", module.Path)
+// patchSingleModule applies patches to a module and writes the result. It
+// reports false without writing anything when no patch matched a resource.
+func (b *builder) patchSingleModule(module *models.ModuleCall, patches []models.Patch) (bool, error) {
+	b.printf("\nPatching module %s (source: %s)\n", module.Name, module.Source)
+	b.printf("  Module path: %s\n", module.Path)
 
 	if _, statErr := os.Stat(module.Path); os.IsNotExist(statErr) {
-		return fmt.Errorf("module path does not exist: %s", module.Path)
+		return false, fmt.Errorf("module path does not exist: %s", module.Path)
 	}
 
 	tfFiles, findErr := FindTerraformFiles(module.Path)
 	if findErr != nil {
-		return fmt.Errorf("failed to find terraform files in %s: %w", module.Path, findErr)
+		return false, fmt.Errorf("failed to find terraform files in %s: %w", module.Path, findErr)
 	}
 
 	parsedFiles, err := parseModuleFiles(tfFiles)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	patchedFiles, patchErr := patcher.ApplyPatches(parsedFiles, patches)
+	result, patchErr := patcher.ApplyPatchesWithChanges(parsedFiles, patches)
 	if patchErr != nil {
-		return fmt.Errorf("failed to apply patches: %w", patchErr)
+		return false, fmt.Errorf("failed to apply patches: %w", patchErr)
+	}
+
+	for _, warning := range result.Warnings {
+		b.warnf("%s", warning)
+	}
+
+	for _, applied := range result.Applied {
+		applied.Module = module.Name
+		if relPath, relErr := filepath.Rel(module.Path, applied.File); relErr == nil {
+			applied.File = relPath
+		}
+		b.report.Patches = append(b.report.Patches, applied)
+	}
+
+	for _, move := range result.Moves {
+		move.Module = module.Name
+		if relPath, relErr := filepath.Rel(module.Path, move.File); relErr == nil {
+			move.File = relPath
+		}
+		b.printf("  Moved %s to %s\n", move.From, move.To)
+		b.report.Moves = append(b.report.Moves, move)
 	}
 
-	return writeModuleFiles(cmd, absRoot, outputDir, module, patchedFiles)
+	if len(result.Applied) == 0 {
+		b.printf("  No matching resources, module left unchanged\n")
+		return false, nil
+	}
+
+	return true, b.writeModuleFiles(module, result.Files)
 }
 
 func parseModuleFiles(tfFiles []string) (map[string]*models.HCLFile, error) {
@@ -229,19 +462,20 @@ func parseModuleFiles(tfFiles []string) (map[string]*models.HCLFile, error) {
 	return parsedFiles, nil
 }
 
-func writeModuleFiles(
-	cmd *cobra.Command,
-	absRoot string,
-	outputDir string,
-	module *models.ModuleCall,
-	patchedFiles map[string]*models.HCLFile,
-) error {
-	moduleOutputDir := filepath.Join(absRoot, outputDir, module.Name)
+func (b *builder) writeModuleFiles(module *models.ModuleCall, patchedFiles map[string]*models.HCLFile) error {
+	moduleOutputDir := b.moduleOutputDir(module.Name)
 	if mkdirErr := os.MkdirAll(moduleOutputDir, 0750); mkdirErr != nil {
 		return fmt.Errorf("failed to create output directory: %w", mkdirErr)
 	}
 
-	for originalPath, hclFile := range patchedFiles {
+	originalPaths := make([]string, 0, len(patchedFiles))
+	for originalPath := range patchedFiles {
+		originalPaths = append(originalPaths, originalPath)
+	}
+	sort.Strings(originalPaths)
+
+	for _, originalPath := range originalPaths {
+		hclFile := patchedFiles[originalPath]
 		relPath, relErr := filepath.Rel(module.Path, originalPath)
 		if relErr != nil {
 			return fmt.Errorf("failed to calculate relative path: %w", relErr)
@@ -255,30 +489,152 @@ func writeModuleFiles(
 		if writeErr := parser.WriteHCLFile(outputPath, hclFile); writeErr != nil {
 			return fmt.Errorf("failed to write %s: %w", outputPath, writeErr)
 		}
-		cmd.Printf("    Wrote: %s\n", relPath)
+		b.report.FilesWritten = append(b.report.FilesWritten, outputPath)
+		b.printf("    Wrote: %s\n", relPath)
 	}
 
 	return nil
 }
 
-func groupPatchesBySource(patches []models.Patch) map[string][]models.Patch {
-	result := make(map[string][]models.Patch)
+// installedVersions replaces the version constraints of modules with the
+// versions recorded in modules.json by terraform init, where available.
+func installedVersions(rootPath string, modules []models.ModuleCall) {
+	data, err := os.ReadFile(modulesJSONPath(rootPath))
+	if err != nil {
+		return
+	}
+	var manifest models.ModulesManifest
+	if json.Unmarshal(data, &manifest) != nil {
+		return
+	}
+
+	versions := make(map[string]string, len(manifest.Modules))
+	for _, entry := range manifest.Modules {
+		versions[entry.Key] = entry.Version
+	}
+	for i := range modules {
+		if version := versions[modules[i].Name]; version != "" {
+			modules[i].Version = version
+		}
+	}
+}
+
+// moduleOutputDir returns the absolute directory a patched module is
+// written to.
+func (b *builder) moduleOutputDir(moduleName string) string {
+	if filepath.IsAbs(b.outputDir) {
+		return filepath.Join(b.outputDir, moduleName)
+	}
+	return filepath.Join(b.absRoot, b.outputDir, moduleName)
+}
+
+// activateBuild records the modules generated by this build as its variant
+// and points modules.json at them.
+func (b *builder) activateBuild(patchedModules map[string]bool) ([]models.ManifestChange, error) {
+	state, err := loadBuildState(b.absRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make(map[string]string, len(patchedModules))
+	for moduleName := range patchedModules {
+		dirs[moduleName] = manifestDir(b.absRoot, b.moduleOutputDir(moduleName))
+	}
+	state.Variants[b.variantName()] = dirs
+
+	return activateVariant(b.absRoot, state, b.variantName())
+}
+
+// variantName is the name this build is recorded under for kungfu use.
+func (b *builder) variantName() string {
+	if b.report.Variant == "" {
+		return defaultVariant
+	}
+	return b.report.Variant
+}
+
+// patchesForModule returns the patches whose source selects module and whose
+// when condition holds for it, in overlay declaration order, with values that
+// refer to the module call evaluated. Patches without a source or with a glob
+// source are marked module-wide.
+func (b *builder) patchesForModule(module models.ModuleCall, patches []models.Patch) ([]models.Patch, error) {
+	ctx := parser.ModuleEvalContext(b.evalCtx, module, b.report.Variant, os.Environ())
+
+	var result []models.Patch
 	for _, patch := range patches {
-		if patch.Source == "" {
+		if !sourceMatches(patch.Source, module.Source) {
 			continue
 		}
-		result[patch.Source] = append(result[patch.Source], patch)
+
+		applies, err := parser.EvaluateWhen(patch, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s for module %s: %w", patchLocation(patch), module.Name, err)
+		}
+		if !applies {
+			continue
+		}
+
+		resolved, err := parser.ResolveModuleValues(patch, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s for module %s: %w", patchLocation(patch), module.Name, err)
+		}
+
+		resolved.ModuleWide = resolved.Source == "" || models.IsPattern(resolved.Source)
+		result = append(result, resolved)
 	}
-	return result
+	return result, nil
 }
 
-func findModuleBySource(modules []models.ModuleCall, source string) *models.ModuleCall {
-	for _, mod := range modules {
-		if mod.Source == source {
-			return &mod
+// patchLocation describes where a patch was declared for error messages.
+func patchLocation(patch models.Patch) string {
+	return fmt.Sprintf("patch at %s:%d", patch.Range.Filename, patch.Range.Start.Line)
+}
+
+// sourceMatches reports whether a patch source selects a module source. An
+// empty pattern selects every module, and glob patterns are matched against
+// both the raw and the registry-normalized module source.
+func sourceMatches(pattern, source string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	normalized := normalizeModuleSource(source)
+	if !models.IsPattern(pattern) {
+		return pattern == source || pattern == normalized
+	}
+
+	for _, candidate := range []string{source, normalized} {
+		if matched, err := path.Match(pattern, candidate); err == nil && matched {
+			return true
 		}
 	}
-	return nil
+	return false
+}
+
+// unmatchedSources returns the sorted, distinct patch sources that do not
+// select any module.
+func unmatchedSources(modules []models.ModuleCall, patches []models.Patch) []string {
+	seen := make(map[string]bool)
+	var sources []string
+	for _, patch := range patches {
+		if patch.Source == "" || seen[patch.Source] {
+			continue
+		}
+		seen[patch.Source] = true
+
+		matched := false
+		for _, module := range modules {
+			if sourceMatches(patch.Source, module.Source) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			sources = append(sources, patch.Source)
+		}
+	}
+	sort.Strings(sources)
+	return sources
 }
 
 // FindKungfuFiles finds all .kf.hcl files in a directory.
@@ -318,52 +674,6 @@ func FindTerraformFiles(modulePath string) ([]string, error) {
 	return tfFiles, err
 }
 
-func updateModulesJSON(rootPath string, patchedSources map[string][]models.Patch, _ []models.ModuleCall) error {
-	modulesJSONPath := filepath.Join(rootPath, ".terraform", "modules", "modules.json")
-
-	if _, statErr := os.Stat(modulesJSONPath); os.IsNotExist(statErr) {
-		return errors.New("modules.json not found - run 'terraform init' first")
-	}
-
-	data, err := os.ReadFile(modulesJSONPath)
-	if err != nil {
-		return fmt.Errorf("failed to read modules.json: %w", err)
-	}
-
-	var manifest models.ModulesManifest
-	if unmarshalErr := json.Unmarshal(data, &manifest); unmarshalErr != nil {
-		return fmt.Errorf("failed to parse modules.json: %w", unmarshalErr)
-	}
-
-	for i := range manifest.Modules {
-		entry := &manifest.Modules[i]
-
-		if entry.Key == "" {
-			continue
-		}
-
-		// Normalize the source to match patch sources
-		// OpenTofu/Terraform adds registry prefix like "registry.opentofu.org/"
-		normalizedSource := normalizeModuleSource(entry.Source)
-
-		if _, patched := patchedSources[normalizedSource]; patched {
-			newDir := filepath.Join(".terraform", "kungfu", "modules", entry.Key)
-			entry.Dir = newDir
-		}
-	}
-
-	updatedData, marshalErr := json.MarshalIndent(manifest, "", "  ")
-	if marshalErr != nil {
-		return fmt.Errorf("failed to marshal modules.json: %w", marshalErr)
-	}
-
-	if writeErr := os.WriteFile(modulesJSONPath, updatedData, 0600); writeErr != nil {
-		return fmt.Errorf("failed to write modules.json: %w", writeErr)
-	}
-
-	return nil
-}
-
 // normalizeModuleSource removes registry prefixes to allow matching with patch sources.
 func normalizeModuleSource(source string) string {
 	// Remove common registry prefixes
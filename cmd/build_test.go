@@ -1,9 +1,16 @@
 package cmd_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/dragonfleas/kungfu/cmd"
+	"github.com/dragonfleas/kungfu/internal/models"
 	"github.com/dragonfleas/kungfu/internal/testutil"
 )
 
@@ -93,3 +100,439 @@ func TestFindTerraformFiles_MultipleFiles(t *testing.T) {
 		t.Errorf("expected 3 files, got %d", len(files))
 	}
 }
+
+// writeRootModule writes files, keyed by path relative to a new root module
+// directory, and returns the root directory.
+func writeRootModule(t *testing.T, files map[string]string) string {
+	t.Helper()
+	rootDir := t.TempDir()
+	for relPath, content := range files {
+		fullPath := filepath.Join(rootDir, relPath)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0750); err != nil {
+			t.Fatalf("failed to create %s: %v", filepath.Dir(fullPath), err)
+		}
+		testutil.WriteTestFile(t, filepath.Dir(fullPath), filepath.Base(fullPath), content)
+	}
+	return rootDir
+}
+
+func setupRootModule(t *testing.T, overlay string) string {
+	t.Helper()
+	return writeRootModule(t, map[string]string{
+		"main.tf": `module "app" {
+  source = "./modules/app"
+}`,
+		"modules/app/main.tf": `resource "aws_instance" "web" {
+  instance_type = "t3.micro"
+}`,
+		"overlays/production.kf.hcl": overlay,
+		".terraform/modules/modules.json": `{"Modules":[{"Key":"","Source":"","Dir":"."},` +
+			`{"Key":"app","Source":"./modules/app","Dir":"modules/app"}]}`,
+	})
+}
+
+// runJSONBuild runs kungfu build with a JSON report and returns the report.
+func runJSONBuild(t *testing.T, args ...string) models.BuildReport {
+	t.Helper()
+	var stdout bytes.Buffer
+	root := cmd.NewRootCmd()
+	root.SetOut(&stdout)
+	root.SetArgs(append([]string{"build", "--output-format", "json"}, args...))
+	if err := root.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var report models.BuildReport
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		t.Fatalf("expected stdout to be a JSON report: %v\n%s", err, stdout.String())
+	}
+	return report
+}
+
+func TestBuild_JSONReport(t *testing.T) {
+	rootDir := setupRootModule(t, `patch "aws_instance" "web" {
+  source        = "./modules/app"
+  instance_type = "t3.large"
+}`)
+
+	report := runJSONBuild(t, rootDir)
+
+	if !report.Success {
+		t.Errorf("expected success, got error %q", report.Error)
+	}
+	if len(report.Patches) != 1 || len(report.Patches[0].Attributes) != 1 {
+		t.Fatalf("expected 1 patch with 1 attribute, got %+v", report.Patches)
+	}
+
+	change := report.Patches[0].Attributes[0]
+	if change.Before == nil || *change.Before != `"t3.micro"` || change.After != `"t3.large"` {
+		t.Errorf("unexpected attribute change: %+v", change)
+	}
+	if len(report.ManifestChanges) != 1 || report.ManifestChanges[0].Key != "app" {
+		t.Errorf("expected manifest change for app, got %+v", report.ManifestChanges)
+	}
+}
+
+func TestBuild_ModuleWidePatch(t *testing.T) {
+	rootDir := writeRootModule(t, map[string]string{
+		"main.tf": `module "web" {
+  source = "./modules/web"
+}
+
+module "db" {
+  source = "./modules/db"
+}
+
+module "dns" {
+  source = "./modules/dns"
+}`,
+		"modules/web/main.tf": `resource "aws_instance" "web" {
+  ami = "ami-123"
+}`,
+		"modules/db/main.tf": `resource "aws_db_instance" "db" {
+  engine = "postgres"
+}`,
+		"modules/dns/main.tf": `resource "cloudflare_record" "www" {
+  name = "www"
+}`,
+		"overlays/baseline.kf.hcl": `patch {
+  target {
+    provider = "aws"
+  }
+
+  tags = merge({
+    ManagedBy = "kungfu"
+  })
+}`,
+		".terraform/modules/modules.json": `{"Modules":[` +
+			`{"Key":"web","Source":"./modules/web","Dir":"modules/web"},` +
+			`{"Key":"db","Source":"./modules/db","Dir":"modules/db"},` +
+			`{"Key":"dns","Source":"./modules/dns","Dir":"modules/dns"}]}`,
+	})
+
+	report := runJSONBuild(t, rootDir)
+
+	patchedModules := make(map[string]bool)
+	for _, applied := range report.Patches {
+		patchedModules[applied.Module] = true
+	}
+	if len(patchedModules) != 2 || !patchedModules["web"] || !patchedModules["db"] {
+		t.Errorf("expected web and db to be patched, got %v", patchedModules)
+	}
+	if len(report.ManifestChanges) != 2 {
+		t.Errorf("expected 2 manifest changes, got %+v", report.ManifestChanges)
+	}
+}
+
+func TestBuild_SourceGlob(t *testing.T) {
+	rootDir := setupRootModule(t, `patch "aws_instance" "web" {
+  source        = "./modules/*"
+  instance_type = "t3.large"
+}`)
+
+	report := runJSONBuild(t, rootDir)
+
+	if len(report.Patches) != 1 || report.Patches[0].Module != "app" {
+		t.Errorf("expected glob source to select app, got %+v", report.Patches)
+	}
+}
+
+func TestBuild_OverlayVariables(t *testing.T) {
+	rootDir := setupRootModule(t, `variable "size" {
+  type = string
+}
+
+patch "aws_instance" "web" {
+  source        = "./modules/app"
+  instance_type = var.size
+}`)
+
+	report := runJSONBuild(t, rootDir, "--var", "size=m5.large")
+
+	if len(report.Patches) != 1 || report.Patches[0].Attributes[0].After != `"m5.large"` {
+		t.Errorf("expected instance_type from --var, got %+v", report.Patches)
+	}
+}
+
+func TestBuild_OverlayIncludes(t *testing.T) {
+	rootDir := setupRootModule(t, `include = ["../base", "../base/security.kf.hcl"]
+
+patch "aws_instance" "web" {
+  source        = "./modules/app"
+  instance_type = "m5.large"
+}`)
+	baseDir := filepath.Join(rootDir, "base")
+	if err := os.MkdirAll(baseDir, 0750); err != nil {
+		t.Fatalf("failed to create base: %v", err)
+	}
+	testutil.WriteTestFile(t, baseDir, "security.kf.hcl", `patch "aws_instance" "web" {
+  source        = "./modules/app"
+  instance_type = "t3.large"
+  monitoring    = true
+}`)
+
+	report := runJSONBuild(t, rootDir, "--overlay", "overlays/production.kf.hcl")
+
+	if len(report.Overlays) != 2 || report.Overlays[0].IncludedBy == "" {
+		t.Fatalf("expected base to be loaded once before the including overlay, got %+v", report.Overlays)
+	}
+	last := report.Patches[len(report.Patches)-1]
+	if last.Attributes[0].After != `"m5.large"` {
+		t.Errorf("expected including overlay to be applied last, got %+v", report.Patches)
+	}
+}
+
+func TestBuild_SiblingOverlaysConflict(t *testing.T) {
+	rootDir := setupRootModule(t, `include = ["../base/monitoring.kf.hcl"]
+
+patch "aws_instance" "web" {
+  source        = "./modules/app"
+  instance_type = "m5.large"
+}`)
+	testutil.WriteTestFile(t, filepath.Join(rootDir, "overlays"), "staging.kf.hcl", `patch "aws_instance" "web" {
+  source        = "./modules/app"
+  instance_type = "t3.large"
+}`)
+	baseDir := filepath.Join(rootDir, "base")
+	if err := os.MkdirAll(baseDir, 0750); err != nil {
+		t.Fatalf("failed to create base: %v", err)
+	}
+	testutil.WriteTestFile(t, baseDir, "monitoring.kf.hcl", `patch "aws_instance" "web" {
+  source     = "./modules/app"
+  monitoring = true
+}`)
+
+	root := cmd.NewRootCmd()
+	root.SetOut(&bytes.Buffer{})
+	root.SetErr(&bytes.Buffer{})
+	root.SetArgs([]string{"build", rootDir})
+
+	if err := root.Execute(); err == nil || !strings.Contains(err.Error(), "conflicting patches") {
+		t.Errorf("expected a conflict between sibling overlays, got %v", err)
+	}
+}
+
+func TestBuild_OverlayIncludeCycle(t *testing.T) {
+	rootDir := writeRootModule(t, map[string]string{
+		"main.tf":             `module "app" { source = "./modules/app" }`,
+		"overlays/a.kf.hcl":   `include = ["b.kf.hcl"]`,
+		"overlays/b.kf.hcl":   `include = ["a.kf.hcl"]`,
+		"modules/app/main.tf": `resource "aws_instance" "web" {}`,
+	})
+
+	root := cmd.NewRootCmd()
+	root.SetOut(&bytes.Buffer{})
+	root.SetErr(&bytes.Buffer{})
+	root.SetArgs([]string{"build", rootDir})
+
+	if err := root.Execute(); err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("expected include cycle error, got %v", err)
+	}
+}
+
+func TestBuild_ProjectManifestVariant(t *testing.T) {
+	rootDir := setupRootModule(t, `variable "size" {
+  type = string
+}
+
+patch "aws_instance" "web" {
+  source        = "./modules/app"
+  instance_type = var.size
+}`)
+	testutil.WriteTestFile(t, rootDir, "kungfu.hcl", `overlays = ["overlays/production.kf.hcl"]
+vars     = { size = "t3.small" }
+
+variant "production" {
+  vars = { size = "m5.large" }
+}`)
+
+	report := runJSONBuild(t, rootDir, "--variant", "production")
+
+	if report.Variant != "production" {
+		t.Errorf("expected variant in report, got %q", report.Variant)
+	}
+	if len(report.Patches) != 1 || report.Patches[0].Attributes[0].After != `"m5.large"` {
+		t.Errorf("expected variant vars to override top-level vars, got %+v", report.Patches)
+	}
+}
+
+func TestBuild_StrictFailsOnWarnings(t *testing.T) {
+	rootDir := setupRootModule(t, `patch "aws_instance" "web" {
+  source        = "./modules/missing"
+  instance_type = "t3.large"
+}`)
+	testutil.WriteTestFile(t, rootDir, "kungfu.hcl", `strict = true`)
+
+	root := cmd.NewRootCmd()
+	root.SetOut(&bytes.Buffer{})
+	root.SetErr(&bytes.Buffer{})
+	root.SetArgs([]string{"build", rootDir})
+
+	if err := root.Execute(); err == nil || !strings.Contains(err.Error(), "strict mode") {
+		t.Errorf("expected strict mode error, got %v", err)
+	}
+}
+
+func TestBuild_WarnsOnBareStrategyMarkers(t *testing.T) {
+	rootDir := setupRootModule(t, `patch "aws_instance" "web" {
+  source = "./modules/app"
+  tags   = merge({ Team = "platform" })
+  labels = kf::merge({ Team = "platform" })
+}`)
+
+	report := runJSONBuild(t, rootDir)
+
+	if len(report.Warnings) != 1 || !strings.Contains(report.Warnings[0], "write kf::merge(...) instead") {
+		t.Errorf("expected a warning for the bare merge marker, got %v", report.Warnings)
+	}
+}
+
+func TestBuild_WhenConditions(t *testing.T) {
+	rootDir := writeRootModule(t, map[string]string{
+		"main.tf": `module "web" {
+  source     = "./modules/app"
+  create_vpc = true
+}
+
+module "worker" {
+  source     = "./modules/app"
+  create_vpc = false
+  name       = var.worker_name
+}`,
+		"modules/app/main.tf": `resource "aws_instance" "web" {
+  instance_type = "t3.micro"
+}`,
+		"overlays/vpc.kf.hcl": `variable "env" {
+  type = string
+}
+
+patch "aws_instance" "web" {
+  source        = "./modules/app"
+  when          = kungfu.module.args.create_vpc && var.env == "prod"
+  instance_type = "m5.large"
+}`,
+		".terraform/modules/modules.json": `{"Modules":[` +
+			`{"Key":"web","Source":"./modules/app","Dir":"modules/app"},` +
+			`{"Key":"worker","Source":"./modules/app","Dir":"modules/app"}]}`,
+	})
+
+	report := runJSONBuild(t, rootDir, "--var", "env=prod")
+
+	if len(report.Patches) != 1 || report.Patches[0].Module != "web" {
+		t.Errorf("expected only web to be patched, got %+v", report.Patches)
+	}
+
+	report = runJSONBuild(t, rootDir, "--var", "env=dev")
+
+	if len(report.Patches) != 0 {
+		t.Errorf("expected no patches outside prod, got %+v", report.Patches)
+	}
+}
+
+func TestBuild_WhenOnUnknownArgument(t *testing.T) {
+	rootDir := setupRootModule(t, `patch "aws_instance" "web" {
+  source        = "./modules/app"
+  when          = kungfu.module.args.name == "web"
+  instance_type = "m5.large"
+}`)
+	testutil.WriteTestFile(t, rootDir, "main.tf", `module "app" {
+  source = "./modules/app"
+  name   = var.name
+}`)
+
+	root := cmd.NewRootCmd()
+	root.SetOut(&bytes.Buffer{})
+	root.SetErr(&bytes.Buffer{})
+	root.SetArgs([]string{"build", rootDir})
+
+	if err := root.Execute(); err == nil || !strings.Contains(err.Error(), "cannot evaluate") {
+		t.Errorf("expected error for when on an unknown argument, got %v", err)
+	}
+}
+
+func TestBuild_ModuleArgumentsInValues(t *testing.T) {
+	rootDir := writeRootModule(t, map[string]string{
+		"main.tf": `module "orders" {
+  source = "./modules/app"
+  name   = "orders"
+}
+
+module "billing" {
+  source = "./modules/app"
+  name   = "billing"
+}`,
+		"modules/app/main.tf": `resource "aws_kms_alias" "this" {
+  target_key_id = aws_kms_key.this.key_id
+}`,
+		"overlays/kms.kf.hcl": `patch "aws_kms_alias" "this" {
+  source        = "./modules/app"
+  name          = "alias/${kungfu.module.args.name}-${kungfu.module.name}"
+  target_key_id = aws_kms_key.this.arn
+  description   = module.args.description
+}`,
+		".terraform/modules/modules.json": `{"Modules":[` +
+			`{"Key":"orders","Source":"./modules/app","Dir":"modules/app"},` +
+			`{"Key":"billing","Source":"./modules/app","Dir":"modules/app"}]}`,
+	})
+
+	report := runJSONBuild(t, rootDir)
+
+	names := make(map[string]string)
+	for _, applied := range report.Patches {
+		for _, change := range applied.Attributes {
+			if change.Name == "name" {
+				names[applied.Module] = change.After
+			}
+			if change.Name == "target_key_id" && change.After != "aws_kms_key.this.arn" {
+				t.Errorf("expected module reference to be kept verbatim, got %s", change.After)
+			}
+			if change.Name == "description" && change.After != "module.args.description" {
+				t.Errorf("expected reference to a nested module named args to be kept verbatim, got %s", change.After)
+			}
+		}
+	}
+	if names["orders"] != `"alias/orders-orders"` || names["billing"] != `"alias/billing-billing"` {
+		t.Errorf("expected alias derived from each module's name, got %v", names)
+	}
+}
+
+func TestBuild_RenameGeneratesMovedBlocks(t *testing.T) {
+	rootDir := setupRootModule(t, `patch "aws_instance" "web" {
+  source = "./modules/app"
+
+  kungfu {
+    rename = "app"
+  }
+}`)
+
+	report := runJSONBuild(t, rootDir)
+
+	want := []models.ResourceMove{{
+		Module: "app",
+		File:   "kungfu_moved.tf",
+		From:   "aws_instance.web",
+		To:     "aws_instance.app",
+	}}
+	if !reflect.DeepEqual(report.Moves, want) {
+		t.Errorf("expected moves %+v, got %+v", want, report.Moves)
+	}
+
+	moved, err := os.ReadFile(filepath.Join(rootDir, ".terraform", "kungfu", "modules", "app", "kungfu_moved.tf"))
+	if err != nil {
+		t.Fatalf("expected moved blocks to be written: %v", err)
+	}
+	if !strings.Contains(string(moved), "to   = aws_instance.app") {
+		t.Errorf("unexpected moved blocks:\n%s", moved)
+	}
+}
+
+func TestBuild_InvalidOutputFormat(t *testing.T) {
+	root := cmd.NewRootCmd()
+	root.SetOut(&bytes.Buffer{})
+	root.SetErr(&bytes.Buffer{})
+	root.SetArgs([]string{"build", t.TempDir(), "--output-format", "yaml"})
+
+	if err := root.Execute(); err == nil {
+		t.Error("expected error for unsupported output format")
+	}
+}
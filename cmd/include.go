@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/parser"
+)
+
+// overlayFile is an overlay selected for a build, either directly or through
+// the include argument of another overlay.
+type overlayFile struct {
+	path string
+	// includedBy is the overlay that first included this one.
+	includedBy string
+	// includes are the overlays this one includes, directly or through other
+	// includes. Its patches override theirs.
+	includes map[string]bool
+}
+
+// includeResolver expands overlay includes depth-first. Included overlays are
+// listed before the overlay that includes them, and an overlay reached through
+// several includes is loaded once, at its first position.
+type includeResolver struct {
+	files    []overlayFile
+	includes map[string]map[string]bool
+	visiting []string
+}
+
+// resolveIncludes returns kfFiles together with every overlay they include,
+// ordered so that bases come before the overlays built on them.
+func resolveIncludes(kfFiles []string) ([]overlayFile, error) {
+	resolver := &includeResolver{includes: make(map[string]map[string]bool)}
+	for _, kfFile := range kfFiles {
+		if _, err := resolver.visit(kfFile, ""); err != nil {
+			return nil, err
+		}
+	}
+	return resolver.files, nil
+}
+
+// visit loads an overlay and its includes and returns the path of the
+// overlay and of every overlay it includes, directly or indirectly.
+func (r *includeResolver) visit(path, includedBy string) (map[string]bool, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve overlay path %s: %w", path, err)
+	}
+
+	for i, active := range r.visiting {
+		if active == absPath {
+			cycle := append(append([]string{}, r.visiting[i:]...), absPath)
+			return nil, fmt.Errorf("overlay include cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	if included, loaded := r.includes[absPath]; loaded {
+		return withPath(included, absPath), nil
+	}
+
+	includes, err := parser.ParseIncludes(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", absPath, err)
+	}
+
+	r.visiting = append(r.visiting, absPath)
+	included := make(map[string]bool)
+	for _, include := range includes {
+		includedFiles, expandErr := expandInclude(include, absPath)
+		if expandErr != nil {
+			return nil, expandErr
+		}
+		for _, includedFile := range includedFiles {
+			reached, visitErr := r.visit(includedFile, absPath)
+			if visitErr != nil {
+				return nil, visitErr
+			}
+			for reachedPath := range reached {
+				included[reachedPath] = true
+			}
+		}
+	}
+	r.visiting = r.visiting[:len(r.visiting)-1]
+
+	r.includes[absPath] = included
+	r.files = append(r.files, overlayFile{path: absPath, includedBy: includedBy, includes: included})
+	return withPath(included, absPath), nil
+}
+
+// withPath returns a copy of paths with path added.
+func withPath(paths map[string]bool, path string) map[string]bool {
+	result := make(map[string]bool, len(paths)+1)
+	for existing := range paths {
+		result[existing] = true
+	}
+	result[path] = true
+	return result
+}
+
+// expandInclude resolves an include entry to overlay files: a directory
+// expands to the .kf.hcl files it contains.
+func expandInclude(include, includedBy string) ([]string, error) {
+	info, err := os.Stat(include)
+	if err != nil {
+		return nil, fmt.Errorf("overlay %s includes %s, which does not exist", includedBy, include)
+	}
+
+	if !info.IsDir() {
+		if !strings.HasSuffix(include, ".kf.hcl") {
+			return nil, fmt.Errorf("overlay %s includes %s, which does not have the .kf.hcl extension",
+				includedBy, include)
+		}
+		return []string{include}, nil
+	}
+
+	files, err := FindKungfuFiles(include)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find overlay files in %s: %w", include, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("overlay %s includes %s, which contains no .kf.hcl files", includedBy, include)
+	}
+	return files, nil
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/dragonfleas/kungfu/internal/parser"
+	"github.com/spf13/cobra"
+)
+
+// loadProjectSettings combines the kungfu.hcl manifest of the root module, if
+// any, with the command line. Flags that were set override the manifest,
+// manifest var files are resolved relative to the root module, and a variant
+// build writes to a subdirectory of the output directory named after it.
+// Only kungfu build reads the manifest; kungfu use works from the build state.
+func loadProjectSettings(cmd *cobra.Command, absRoot string) (models.ProjectSettings, error) {
+	manifest, err := parser.ParseProjectManifest(filepath.Join(absRoot, models.ProjectFileName))
+	if err != nil {
+		return models.ProjectSettings{}, fmt.Errorf("failed to parse %s: %w", models.ProjectFileName, err)
+	}
+
+	variant, _ := cmd.Flags().GetString("variant")
+	var settings models.ProjectSettings
+	switch {
+	case manifest != nil:
+		settings, err = manifest.ForVariant(variant)
+		if err != nil {
+			return models.ProjectSettings{}, err
+		}
+	case variant != "":
+		return models.ProjectSettings{}, errors.New("--variant requires a kungfu.hcl project manifest")
+	}
+
+	flags := cmd.Flags()
+	if overlay, _ := flags.GetString("overlay"); flags.Changed("overlay") && overlay != "" {
+		settings.Overlays = []string{overlay}
+	}
+	if len(settings.Overlays) == 0 {
+		settings.Overlays = []string{defaultOverlayDir}
+	}
+
+	if flags.Changed("output") || settings.Output == "" {
+		settings.Output, _ = flags.GetString("output")
+	}
+	if variant != "" {
+		// Each variant is built into its own tree so that kungfu use can
+		// switch between them without rebuilding.
+		settings.Output = filepath.Join(settings.Output, variant)
+	}
+
+	if flags.Changed("strict") {
+		strict, _ := flags.GetBool("strict")
+		settings.Strict = &strict
+	}
+
+	varFiles := make([]string, 0, len(settings.VarFiles))
+	for _, varFile := range settings.VarFiles {
+		if !filepath.IsAbs(varFile) {
+			varFile = filepath.Join(absRoot, varFile)
+		}
+		varFiles = append(varFiles, varFile)
+	}
+	settings.VarFiles = varFiles
+
+	return settings, nil
+}
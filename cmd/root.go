@@ -22,6 +22,7 @@ utilized by your main OpenTofu code.`,
 	}
 
 	cmd.AddCommand(NewBuildCmd())
+	cmd.AddCommand(NewUseCmd())
 
 	return cmd
 }
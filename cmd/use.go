@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+// NewUseCmd creates the use command.
+func NewUseCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "use <variant> [root-module-path]",
+		Short: "Switch modules.json to a previously built variant",
+		Long: `Use points modules.json at the patched modules of a variant that was
+already built, without rebuilding. Builds without --variant are recorded as
+the "default" variant. With --reset, modules.json is pointed back at the
+original modules.
+
+Use only reads the build state recorded by kungfu build. It does not read
+kungfu.hcl, so a variant can be used as long as it was built, even after it
+is removed from the manifest.
+
+Example:
+  kungfu build . --variant staging
+  kungfu build . --variant production
+  kungfu use staging
+  kungfu use --reset`,
+		Args: cobra.RangeArgs(0, 2),
+		RunE: runUse,
+	}
+
+	cmd.Flags().Bool(
+		"reset", false,
+		"Point modules.json back at the original modules")
+
+	return cmd
+}
+
+func runUse(cmd *cobra.Command, args []string) error {
+	reset, _ := cmd.Flags().GetBool("reset")
+
+	var variant string
+	rootArgs := args
+	switch {
+	case reset && len(args) > 1:
+		return errors.New("--reset takes at most one argument, the root module path")
+	case reset:
+	case len(args) == 0:
+		return errors.New("requires a variant name, or --reset")
+	default:
+		variant, rootArgs = args[0], args[1:]
+	}
+
+	absRoot, err := resolveRootPath(rootArgs)
+	if err != nil {
+		return err
+	}
+
+	state, err := loadBuildState(absRoot)
+	if err != nil {
+		return err
+	}
+
+	if variant != "" {
+		dirs, built := state.Variants[variant]
+		if !built {
+			return fmt.Errorf("variant %s has not been built; run 'kungfu build %s'", variant, buildHint(variant))
+		}
+		for key, dir := range dirs {
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(absRoot, dir)
+			}
+			if _, statErr := os.Stat(dir); statErr != nil {
+				return fmt.Errorf("patched module %s of variant %s is missing at %s; rebuild the variant", key, variant, dir)
+			}
+		}
+	}
+
+	changes, err := activateVariant(absRoot, state, variant)
+	if err != nil {
+		return fmt.Errorf("failed to update modules.json: %w", err)
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	for _, change := range changes {
+		cmd.Printf("  %s: %s -> %s\n", change.Key, change.OldDir, change.NewDir)
+	}
+	if variant == "" {
+		cmd.Printf("modules.json now points to the original modules\n")
+	} else {
+		cmd.Printf("modules.json now points to variant %s\n", variant)
+	}
+	return nil
+}
+
+func buildHint(variant string) string {
+	if variant == defaultVariant {
+		return "."
+	}
+	return ". --variant " + variant
+}
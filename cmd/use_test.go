@@ -0,0 +1,115 @@
+package cmd_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dragonfleas/kungfu/cmd"
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/dragonfleas/kungfu/internal/testutil"
+)
+
+func runCommand(t *testing.T, args ...string) {
+	t.Helper()
+	root := cmd.NewRootCmd()
+	root.SetOut(&bytes.Buffer{})
+	root.SetErr(&bytes.Buffer{})
+	root.SetArgs(args)
+	if err := root.Execute(); err != nil {
+		t.Fatalf("kungfu %v: unexpected error: %v", args, err)
+	}
+}
+
+func moduleDir(t *testing.T, rootDir, key string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(rootDir, ".terraform", "modules", "modules.json"))
+	if err != nil {
+		t.Fatalf("failed to read modules.json: %v", err)
+	}
+	var manifest models.ModulesManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("failed to parse modules.json: %v", err)
+	}
+	for _, entry := range manifest.Modules {
+		if entry.Key == key {
+			return entry.Dir
+		}
+	}
+	t.Fatalf("module %s not found in modules.json", key)
+	return ""
+}
+
+func TestUse_SwitchesBetweenVariants(t *testing.T) {
+	rootDir := setupRootModule(t, `variable "size" {
+  type = string
+}
+
+patch "aws_instance" "web" {
+  source        = "./modules/app"
+  instance_type = var.size
+}`)
+	testutil.WriteTestFile(t, rootDir, "kungfu.hcl", `variant "staging" {
+  vars = { size = "t3.medium" }
+}
+
+variant "production" {
+  vars = { size = "m5.large" }
+}`)
+
+	runCommand(t, "build", rootDir, "--variant", "staging")
+	runCommand(t, "build", rootDir, "--variant", "production")
+
+	stagingDir := filepath.Join(".terraform", "kungfu", "modules", "staging", "app")
+	productionDir := filepath.Join(".terraform", "kungfu", "modules", "production", "app")
+	if got := moduleDir(t, rootDir, "app"); got != productionDir {
+		t.Errorf("expected last build to be active, got %s", got)
+	}
+	if _, err := os.Stat(filepath.Join(rootDir, stagingDir, "main.tf")); err != nil {
+		t.Errorf("expected staging tree to be kept: %v", err)
+	}
+
+	runCommand(t, "use", "staging", rootDir)
+	if got := moduleDir(t, rootDir, "app"); got != stagingDir {
+		t.Errorf("expected staging to be active, got %s", got)
+	}
+
+	runCommand(t, "use", "--reset", rootDir)
+	if got := moduleDir(t, rootDir, "app"); got != "modules/app" {
+		t.Errorf("expected original directory to be restored, got %s", got)
+	}
+}
+
+func TestUse_IgnoresProjectManifest(t *testing.T) {
+	rootDir := setupRootModule(t, `patch "aws_instance" "web" {
+  source        = "./modules/app"
+  instance_type = "t3.large"
+}`)
+	testutil.WriteTestFile(t, rootDir, "kungfu.hcl", `variant "staging" {}`)
+
+	runCommand(t, "build", rootDir, "--variant", "staging")
+
+	// use switches to what was built, whatever kungfu.hcl now declares.
+	testutil.WriteTestFile(t, rootDir, "kungfu.hcl", `output = "elsewhere"`)
+	runCommand(t, "use", "staging", rootDir)
+
+	want := filepath.Join(".terraform", "kungfu", "modules", "staging", "app")
+	if got := moduleDir(t, rootDir, "app"); got != want {
+		t.Errorf("expected staging to be active, got %s", got)
+	}
+}
+
+func TestUse_UnbuiltVariant(t *testing.T) {
+	rootDir := setupRootModule(t, "")
+
+	root := cmd.NewRootCmd()
+	root.SetOut(&bytes.Buffer{})
+	root.SetErr(&bytes.Buffer{})
+	root.SetArgs([]string{"use", "production", rootDir})
+
+	if err := root.Execute(); err == nil {
+		t.Error("expected error for a variant that was never built")
+	}
+}
@@ -5,18 +5,18 @@ patch "aws_instance" "bastion" {
   monitoring              = true
   disable_api_termination = true
 
-  tags = merge({
+  tags = kf::merge({
     Owner       = "platform-team"
     ManagedBy   = "kungfu"
   })
 
-  vpc_security_group_ids = append(["sg-restricted", "sg-monitoring"])
+  vpc_security_group_ids = kf::append(["sg-restricted", "sg-monitoring"])
 }
 
 patch "aws_security_group" "bastion_sg" {
-  description = replace("Security group for bastion host - restricted access")
+  description = kf::replace("Security group for bastion host - restricted access")
 
-  tags = merge({
+  tags = kf::merge({
     Owner     = "security-team"
     ManagedBy = "kungfu"
   })
@@ -9,7 +9,7 @@ patch "aws_vpc" "this" {
   enable_dns_support   = true
 
   # Add production-specific tags
-  tags = merge({
+  tags = kf::merge({
     Owner       = "platform-team"
     ManagedBy   = "kungfu"
     Environment = "production"
@@ -21,7 +21,7 @@ patch "aws_vpc" "this" {
 patch "aws_flow_log" "this" {
   source = "terraform-aws-modules/vpc/aws"
 
-  tags = merge({
+  tags = kf::merge({
     Owner     = "security-team"
     ManagedBy = "kungfu"
   })
@@ -41,10 +41,10 @@ patch "aws_instance" "this" {
   disable_api_termination = true
 
   # Add additional security groups
-  vpc_security_group_ids = append(["sg-prod-monitoring", "sg-prod-logging"])
+  vpc_security_group_ids = kf::append(["sg-prod-monitoring", "sg-prod-logging"])
 
   # Production-specific root volume configuration
-  root_block_device = merge({
+  root_block_device = kf::merge({
     encrypted   = true
     volume_size = 100
     volume_type = "gp3"
@@ -53,7 +53,7 @@ patch "aws_instance" "this" {
   })
 
   # Add production tags
-  tags = merge({
+  tags = kf::merge({
     Owner       = "app-team"
     ManagedBy   = "kungfu"
     Environment = "production"
@@ -61,7 +61,7 @@ patch "aws_instance" "this" {
   })
 
   # Merge volume tags
-  volume_tags = merge({
+  volume_tags = kf::merge({
     Owner       = "app-team"
     ManagedBy   = "kungfu"
     Encrypted   = "true"
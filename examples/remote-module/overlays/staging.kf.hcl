@@ -6,7 +6,7 @@ patch "aws_vpc" "this" {
   enable_dns_hostnames = true
   enable_dns_support   = true
 
-  tags = merge({
+  tags = kf::merge({
     Owner       = "platform-team"
     ManagedBy   = "kungfu"
     Environment = "staging"
@@ -24,7 +24,7 @@ patch "aws_instance" "this" {
   monitoring = false
 
   # Staging-specific tags
-  tags = merge({
+  tags = kf::merge({
     Owner       = "app-team"
     ManagedBy   = "kungfu"
     Environment = "staging"
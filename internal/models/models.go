@@ -1,34 +1,281 @@
 package models
 
 import (
+	"regexp"
+	"strings"
+
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
 )
 
+// OriginalVariable is the name patch values use to refer to the value of the
+// argument they patch, as in name = format("%s-hardened", original).
+const OriginalVariable = "original"
+
 type MergeStrategy int
 
 const (
 	StrategyReplace MergeStrategy = iota
 	StrategyMerge
 	StrategyAppend
+	StrategyPrepend
+	StrategyRemove
+	StrategyUnion
+	StrategyIndex
+	StrategyShallowMerge
+	StrategyDefaults
+	StrategyDeleteKeys
+	StrategyMergeBy
+	StrategyPrefix
+	StrategySuffix
+	StrategyRegexReplace
+	StrategyTemplate
+)
+
+func (s MergeStrategy) String() string {
+	switch s {
+	case StrategyReplace:
+		return "replace"
+	case StrategyMerge:
+		return "merge"
+	case StrategyAppend:
+		return "append"
+	case StrategyPrepend:
+		return "prepend"
+	case StrategyRemove:
+		return "remove"
+	case StrategyUnion:
+		return "union"
+	case StrategyIndex:
+		return "at"
+	case StrategyShallowMerge:
+		return "shallow_merge"
+	case StrategyDefaults:
+		return "defaults"
+	case StrategyDeleteKeys:
+		return "delete_keys"
+	case StrategyMergeBy:
+		return "merge_by"
+	case StrategyPrefix:
+		return "prefix"
+	case StrategySuffix:
+		return "suffix"
+	case StrategyRegexReplace:
+		return "regex_replace"
+	case StrategyTemplate:
+		return "template"
+	default:
+		return "unknown"
+	}
+}
+
+// ConditionOperator is the comparison performed by a where condition.
+type ConditionOperator int
+
+const (
+	ConditionPresent ConditionOperator = iota
+	ConditionEquals
+	ConditionNotEquals
+	ConditionPrefix
+	ConditionSuffix
+	ConditionMatches
+	ConditionContains
+	ConditionHasKey
+	ConditionLacksKey
+)
+
+func (o ConditionOperator) String() string {
+	switch o {
+	case ConditionPresent:
+		return "present"
+	case ConditionEquals:
+		return "equals"
+	case ConditionNotEquals:
+		return "not_equals"
+	case ConditionPrefix:
+		return "prefix"
+	case ConditionSuffix:
+		return "suffix"
+	case ConditionMatches:
+		return "matches"
+	case ConditionContains:
+		return "contains"
+	case ConditionHasKey:
+		return "has_key"
+	case ConditionLacksKey:
+		return "lacks_key"
+	default:
+		return "unknown"
+	}
+}
+
+// Condition is a predicate on the existing configuration of a resource that
+// must hold for a patch to be applied to it.
+type Condition struct {
+	// Attribute is a dotted path to an attribute or nested block of the
+	// resource, such as "tags" or "metadata_options.http_tokens".
+	Attribute string
+	Operator  ConditionOperator
+	Value     cty.Value
+	// Pattern is the compiled regular expression for ConditionMatches.
+	Pattern *regexp.Regexp
+}
+
+// PatchKind is the kind of module configuration a patch changes.
+type PatchKind int
+
+const (
+	// PatchResource patches resource blocks selected by type and name.
+	PatchResource PatchKind = iota
+	// PatchTerraform patches the terraform blocks of a module.
+	PatchTerraform
+	// PatchProvider patches the provider blocks a module declares.
+	PatchProvider
+	// PatchCheck patches or adds a check block of a module.
+	PatchCheck
+	// PatchRemoved patches or adds a removed block of a module.
+	PatchRemoved
 )
 
 type KungfuConfig struct {
-	Patches []Patch
+	Patches   []Patch
+	Variables []OverlayVariable
+	Locals    []OverlayLocal
+	// Warnings are problems found while parsing that do not stop the build,
+	// such as strategy markers written without the kf:: namespace.
+	Warnings []string
+}
+
+// OverlayVariable is a variable block declared in an overlay file.
+type OverlayVariable struct {
+	Name        string
+	Description string
+	// Type is the declared type constraint, cty.DynamicPseudoType when absent.
+	Type cty.Type
+	// Default is the default value, cty.NilVal when the variable is required.
+	Default cty.Value
+	Range   hcl.Range
+}
+
+// OverlayLocal is a named value declared in a locals block of an overlay file.
+type OverlayLocal struct {
+	Name  string
+	Expr  hcl.Expression
+	Range hcl.Range
 }
 
 type Patch struct {
+	// Kind is the kind of configuration the patch changes. The resource
+	// selector fields only apply to resource patches.
+	Kind PatchKind
+	// ResourceType and ResourceName select the patched resources. They may be
+	// glob patterns; an empty value matches any type or name.
 	ResourceType string
 	ResourceName string
-	Source       string
+	// Provider restricts the patch to resources of a provider, derived from the
+	// resource type prefix (e.g. "aws" for aws_s3_bucket).
+	Provider string
+	// NameRegex, when set, must also match the resource name.
+	NameRegex *regexp.Regexp
+	// ProviderConfig selects the provider blocks of a provider patch by
+	// address, such as aws or aws.us_east_1. It may be a glob pattern.
+	ProviderConfig string
+	// Remove deletes the selected provider blocks instead of patching them.
+	Remove bool
+	// CheckName is the name of the check block a check patch changes.
+	CheckName string
+	// Source selects the modules the patch applies to. It may be a glob
+	// pattern; an empty source applies the patch to every module.
+	Source string
+	// ModuleWide marks a patch that applies to several modules. Modules without
+	// a matching resource are skipped instead of failing the patch.
+	ModuleWide bool
+	// Priority orders patches that touch the same attribute. Patches with a
+	// higher priority are applied later and win over lower ones.
+	Priority int
+	// Includes holds the overlay files the declaring overlay includes,
+	// directly or through other includes, keyed by path as in Range.Filename.
+	// Within a priority, the patch is applied after theirs and overrides them
+	// without a conflict.
+	Includes map[string]bool
+	// When is a condition evaluated once per selected module call, with
+	// access to the call's arguments; nil means the patch always applies.
+	When hcl.Expression
+	// Where holds conditions on the existing resource configuration. All of
+	// them must hold for the patch to apply to a resource.
+	Where []Condition
+	// Rename is the new name of the patched resource, empty when the patch
+	// keeps its name. Renames are applied after every other patch of the
+	// module, so patches always select resources by their upstream name.
+	Rename string
+	// InstanceKeys are the for_each keys of the resource's instances when the
+	// patch switches it between count and for_each, or adds for_each to it.
+	// Instance i of a counted resource moves to key InstanceKeys[i].
+	InstanceKeys []string
 	Attributes   map[string]*PatchAttribute
-	Body         *hclwrite.Body
-	Range        hcl.Range
+	// Blocks holds the nested blocks the patch sets arguments in, keyed by
+	// block type.
+	Blocks map[string]*PatchBlock
+	// Added holds the blocks the patch appends, such as the assert blocks of
+	// a check.
+	Added []*AddedBlock
+	Body  *hclwrite.Body
+	Range hcl.Range
+}
+
+// PatchBlock holds the arguments a patch sets inside a nested block of the
+// resource, such as lifecycle. The block is created when it does not exist.
+type PatchBlock struct {
+	Attributes map[string]*PatchAttribute
+	// Added holds the blocks appended inside the block, such as the
+	// preconditions of a lifecycle block.
+	Added []*AddedBlock
+}
+
+// AddedBlock is a block a patch appends rather than merges, such as an assert
+// block or a precondition. Patching never changes existing blocks of its type.
+type AddedBlock struct {
+	Type       string
+	Labels     []string
+	Attributes map[string]*PatchAttribute
+	Blocks     []*AddedBlock
 }
 
 type PatchAttribute struct {
-	Value    interface{}
+	// Value is a cty.Value the overlay evaluated, or hclwrite.Tokens holding
+	// an expression only Terraform can evaluate. See NormalizeValue.
+	Value interface{}
+	// Expr, when set, is an expression that refers to the module call being
+	// patched. It is evaluated into Value separately for each module call.
+	Expr     hcl.Expression
 	Strategy MergeStrategy
+	// MergeKey is the field list elements are matched on by the merge_by
+	// strategy.
+	MergeKey string
+	// Pattern is the regular expression replaced by the regex_replace
+	// strategy.
+	Pattern string
+	// Nested holds the strategy markers nested in the object of a merge
+	// patch, such as kf::append([...]) in { Statement = kf::append([...]) },
+	// by the key they are nested under.
+	Nested map[string]*NestedMarker
+	// Functions are the functions a template can call when it is evaluated
+	// against the module's value.
+	Functions map[string]function.Function
+	// Order is the position of the attribute within its patch block, used to
+	// apply and add attributes in overlay declaration order.
+	Order int
+}
+
+// NestedMarker is a key of a merge patch object whose value is a strategy
+// marker, or an object with markers nested in it.
+type NestedMarker struct {
+	// Attribute is the marker, or nil when the key holds an object.
+	Attribute *PatchAttribute
+	// Object holds the markers nested in the object the key holds.
+	Object map[string]*NestedMarker
 }
 
 type HCLFile struct {
@@ -40,6 +287,14 @@ type HCLFile struct {
 	Outputs   map[string]*Output
 	Locals    map[string]*Local
 	Data      map[string]*DataSource
+	// TerraformBlocks are the terraform blocks of the file, in source order.
+	TerraformBlocks []*hclwrite.Block
+	// Providers are the provider blocks of the file, keyed by address.
+	Providers map[string]*ProviderConfig
+	// Checks are the check blocks of the file, keyed by name.
+	Checks map[string]*hclwrite.Block
+	// RemovedBlocks are the removed blocks of the file, in source order.
+	RemovedBlocks []*hclwrite.Block
 }
 
 type Resource struct {
@@ -66,6 +321,23 @@ type Local struct {
 	Range hcl.Range
 }
 
+// ProviderConfig is a provider block declared in a module.
+type ProviderConfig struct {
+	Name string
+	// Alias is the alias of the configuration, empty for the default one.
+	Alias string
+	Block *hclwrite.Block
+}
+
+// Address returns the address of the configuration, such as aws or
+// aws.us_east_1.
+func (p *ProviderConfig) Address() string {
+	if p.Alias == "" {
+		return p.Name
+	}
+	return p.Name + "." + p.Alias
+}
+
 type DataSource struct {
 	Type  string
 	Name  string
@@ -76,3 +348,8 @@ type DataSource struct {
 func ResourceKey(resourceType, resourceName string) string {
 	return resourceType + "." + resourceName
 }
+
+// IsPattern reports whether s contains glob metacharacters.
+func IsPattern(s string) bool {
+	return strings.ContainsAny(s, "*?[\\")
+}
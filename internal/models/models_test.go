@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/zclconf/go-cty/cty"
 )
 
 func TestResourceKey(t *testing.T) {
@@ -14,3 +15,89 @@ func TestResourceKey(t *testing.T) {
 		t.Errorf("expected %s, got %s", expected, result)
 	}
 }
+
+func TestProjectManifest_ForVariant(t *testing.T) {
+	strict := true
+	manifest := &models.ProjectManifest{
+		Settings: models.ProjectSettings{
+			Overlays: []string{"overlays/base"},
+			Output:   ".terraform/kungfu/modules",
+			VarFiles: []string{"common.hcl"},
+			Vars:     map[string]cty.Value{"region": cty.StringVal("us-east-1"), "size": cty.StringVal("small")},
+		},
+		Variants: map[string]models.ProjectSettings{
+			"production": {
+				Overlays: []string{"overlays/prod"},
+				Strict:   &strict,
+				VarFiles: []string{"prod.hcl"},
+				Vars:     map[string]cty.Value{"size": cty.StringVal("large")},
+			},
+		},
+	}
+
+	settings, err := manifest.ForVariant("production")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(settings.Overlays) != 1 || settings.Overlays[0] != "overlays/prod" {
+		t.Errorf("expected variant overlays, got %v", settings.Overlays)
+	}
+	if settings.Output != ".terraform/kungfu/modules" {
+		t.Errorf("expected top-level output, got %s", settings.Output)
+	}
+	if settings.Strict == nil || !*settings.Strict {
+		t.Error("expected variant to enable strict mode")
+	}
+	if len(settings.VarFiles) != 2 || settings.VarFiles[1] != "prod.hcl" {
+		t.Errorf("expected variant var files after top-level ones, got %v", settings.VarFiles)
+	}
+	if settings.Vars["size"].AsString() != "large" || settings.Vars["region"].AsString() != "us-east-1" {
+		t.Errorf("expected variant vars merged over top-level vars, got %v", settings.Vars)
+	}
+
+	if _, err := manifest.ForVariant("staging"); err == nil {
+		t.Error("expected error for undeclared variant")
+	}
+}
+
+func TestNormalizeValue(t *testing.T) {
+	tests := map[string]struct {
+		value    interface{}
+		expected cty.Value
+	}{
+		"cty value": {cty.StringVal("web"), cty.StringVal("web")},
+		"nil":       {nil, cty.NullVal(cty.DynamicPseudoType)},
+		"string":    {"web", cty.StringVal("web")},
+		"map":       {map[string]string{"Name": "web"}, cty.MapVal(map[string]cty.Value{"Name": cty.StringVal("web")})},
+		"slice":     {[]int{1, 2}, cty.ListVal([]cty.Value{cty.NumberIntVal(1), cty.NumberIntVal(2)})},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			normalized, err := models.NormalizeValue(tt.value)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if val, ok := normalized.(cty.Value); !ok || !val.RawEquals(tt.expected) {
+				t.Errorf("expected %#v, got %#v", tt.expected, normalized)
+			}
+		})
+	}
+}
+
+func TestNormalizeValue_Errors(t *testing.T) {
+	tests := map[string]interface{}{
+		"unknown":  cty.UnknownVal(cty.String),
+		"nested":   cty.ListVal([]cty.Value{cty.UnknownVal(cty.String)}),
+		"function": func() {},
+	}
+
+	for name, value := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := models.NormalizeValue(value); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
@@ -1,7 +1,15 @@
 package models
 
+import "github.com/zclconf/go-cty/cty"
+
 type ModuleCall struct {
 	Name   string
 	Source string
 	Path   string
+	// Version is the version constraint of the module block, replaced by the
+	// installed version from modules.json when it is known.
+	Version string
+	// Args holds the other arguments of the module block. Arguments whose
+	// value depends on the root module, such as var.name, are unknown.
+	Args map[string]cty.Value
 }
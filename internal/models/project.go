@@ -0,0 +1,74 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+// ProjectFileName is the name of the project manifest in the root module.
+const ProjectFileName = "kungfu.hcl"
+
+// ProjectManifest is the kungfu.hcl file of a root module. Its top-level
+// settings apply to every build, and each variant refines them.
+type ProjectManifest struct {
+	Path     string
+	Settings ProjectSettings
+	Variants map[string]ProjectSettings
+	// VariantNames lists the variants in declaration order.
+	VariantNames []string
+}
+
+// ProjectSettings are the build settings declared in a project manifest.
+// Paths are relative to the root module.
+type ProjectSettings struct {
+	// Overlays are overlay files or directories, used instead of overlays/.
+	Overlays []string
+	// Output is the directory patched modules are written to.
+	Output string
+	// Strict, when set, turns build warnings into errors.
+	Strict *bool
+	// VarFiles are loaded in order before any --var-file.
+	VarFiles []string
+	// Vars are overlay variable values, overriding VarFiles.
+	Vars map[string]cty.Value
+}
+
+// ForVariant returns the settings for a build of the named variant, or the
+// top-level settings when name is empty. Variant overlays, output and strict
+// replace the top-level ones, variant var files are loaded after the
+// top-level ones, and variant vars override top-level vars of the same name.
+func (m *ProjectManifest) ForVariant(name string) (ProjectSettings, error) {
+	if name == "" {
+		return m.Settings, nil
+	}
+
+	variant, exists := m.Variants[name]
+	if !exists {
+		return ProjectSettings{}, fmt.Errorf("variant %q is not declared in %s", name, m.Path)
+	}
+
+	settings := ProjectSettings{
+		Overlays: m.Settings.Overlays,
+		Output:   m.Settings.Output,
+		Strict:   m.Settings.Strict,
+		VarFiles: append(append([]string{}, m.Settings.VarFiles...), variant.VarFiles...),
+		Vars:     make(map[string]cty.Value, len(m.Settings.Vars)+len(variant.Vars)),
+	}
+	if len(variant.Overlays) > 0 {
+		settings.Overlays = variant.Overlays
+	}
+	if variant.Output != "" {
+		settings.Output = variant.Output
+	}
+	if variant.Strict != nil {
+		settings.Strict = variant.Strict
+	}
+	for varName, val := range m.Settings.Vars {
+		settings.Vars[varName] = val
+	}
+	for varName, val := range variant.Vars {
+		settings.Vars[varName] = val
+	}
+	return settings, nil
+}
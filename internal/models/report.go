@@ -0,0 +1,64 @@
+package models
+
+// BuildReport is the machine-readable summary of a single build.
+type BuildReport struct {
+	Success         bool             `json:"success"`
+	Error           string           `json:"error,omitempty"`
+	RootModule      string           `json:"root_module"`
+	Variant         string           `json:"variant,omitempty"`
+	OutputDir       string           `json:"output_dir"`
+	Overlays        []OverlayReport  `json:"overlays"`
+	Patches         []AppliedPatch   `json:"patches"`
+	FilesWritten    []string         `json:"files_written"`
+	ManifestChanges []ManifestChange `json:"manifest_changes"`
+	Moves           []ResourceMove   `json:"moves,omitempty"`
+	Warnings        []string         `json:"warnings"`
+}
+
+// OverlayReport describes an overlay file that was read during a build.
+type OverlayReport struct {
+	Path    string `json:"path"`
+	Patches int    `json:"patches"`
+	// IncludedBy is the overlay that first included this one, empty for
+	// overlays selected with --overlay.
+	IncludedBy string `json:"included_by,omitempty"`
+}
+
+// AppliedPatch records a patch that was applied to a resource in a module.
+type AppliedPatch struct {
+	Module       string `json:"module"`
+	Source       string `json:"source"`
+	ResourceType string `json:"resource_type"`
+	ResourceName string `json:"resource_name"`
+	File         string `json:"file"`
+	// Removed is set when the patch deleted the block instead of changing it.
+	Removed    bool              `json:"removed,omitempty"`
+	Attributes []AttributeChange `json:"attributes"`
+}
+
+// AttributeChange records the before and after HCL of a single patched attribute.
+// Before is nil when the attribute did not exist prior to patching.
+type AttributeChange struct {
+	Name     string  `json:"name"`
+	Strategy string  `json:"strategy"`
+	Before   *string `json:"before"`
+	After    string  `json:"after"`
+}
+
+// ManifestChange records a modules.json entry that was redirected to a patched module.
+type ManifestChange struct {
+	Key    string `json:"key"`
+	Source string `json:"source"`
+	OldDir string `json:"old_dir"`
+	NewDir string `json:"new_dir"`
+}
+
+// ResourceMove records a moved block generated for a resource whose address
+// was changed by a patch.
+type ResourceMove struct {
+	Module string `json:"module"`
+	// File is the generated file the moved block is declared in.
+	File string `json:"file"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"bytes"
+	"sort"
+)
+
+// SourceEdit replaces the bytes between Start and End of a source with Text.
+type SourceEdit struct {
+	Start int
+	End   int
+	Text  []byte
+}
+
+// ApplySourceEdits returns src[start:end] with edits applied. Edits must not
+// overlap and must lie within the range.
+func ApplySourceEdits(src []byte, start, end int, edits []SourceEdit) []byte {
+	sort.SliceStable(edits, func(i, j int) bool {
+		return edits[i].Start < edits[j].Start
+	})
+
+	var buf bytes.Buffer
+	pos := start
+	for _, edit := range edits {
+		buf.Write(src[pos:edit.Start])
+		buf.Write(edit.Text)
+		pos = edit.End
+	}
+	buf.Write(src[pos:end])
+	return buf.Bytes()
+}
@@ -0,0 +1,15 @@
+package models
+
+// BuildState is kungfu's record of the module directories it redirects
+// modules.json to, kept in .terraform/kungfu/state.json so that variants can
+// be switched without rebuilding.
+type BuildState struct {
+	// Original maps each module key to the directory terraform init chose.
+	Original map[string]string `json:"original"`
+	// Variants maps each built variant to the directories of its patched
+	// modules, keyed by module key.
+	Variants map[string]map[string]string `json:"variants"`
+	// Active is the variant modules.json currently points to, empty when it
+	// points to the original modules.
+	Active string `json:"active,omitempty"`
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/gocty"
+)
+
+// NormalizeValue returns v as a patch attribute value. Go values are
+// converted to the cty type they imply, so a Go map becomes a cty map and a
+// slice a list; nil is a null value. Values that are not wholly known cannot
+// be written to a module and are an error.
+func NormalizeValue(v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case nil:
+		return cty.NullVal(cty.DynamicPseudoType), nil
+	case hclwrite.Tokens:
+		return value, nil
+	case cty.Value:
+		if !value.IsWhollyKnown() {
+			return nil, errors.New("the value is not known until Terraform evaluates it")
+		}
+		return value, nil
+	}
+
+	ty, err := gocty.ImpliedType(v)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported value type %T: %w", v, err)
+	}
+	val, err := gocty.ToCtyValue(v, ty)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported value type %T: %w", v, err)
+	}
+	return val, nil
+}
@@ -0,0 +1,234 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+const (
+	// checkPatchLabel is the first label of a patch block that patches or adds
+	// a check block, as in patch "check" "bucket_private" { ... }.
+	checkPatchLabel = "check"
+	// removedPatchLabel is the single label of a patch block that patches or
+	// adds a removed block, as in patch "removed" { from = ... }.
+	removedPatchLabel = "removed"
+)
+
+// parseCheckPatch parses a patch of a check block. Its assert blocks are
+// appended to the check, which is created when the module does not have it.
+func parseCheckPatch(block *hclsyntax.Block, src []byte, ctx *hcl.EvalContext) (models.Patch, error) {
+	patch := models.Patch{
+		Kind:       models.PatchCheck,
+		CheckName:  block.Labels[1],
+		Attributes: make(map[string]*models.PatchAttribute),
+		Blocks:     make(map[string]*models.PatchBlock),
+		Range:      block.Range(),
+	}
+	if !hclsyntax.ValidIdentifier(patch.CheckName) {
+		return models.Patch{}, fmt.Errorf("invalid check name %q", patch.CheckName)
+	}
+
+	if err := parseKungfuBlocks(block.Body, &patch, false, ctx); err != nil {
+		return models.Patch{}, err
+	}
+
+	asserts, dataBlocks := 0, 0
+	for _, nested := range block.Body.Blocks {
+		var added *models.AddedBlock
+		var err error
+		switch nested.Type {
+		case kungfuBlockType:
+			continue
+		case "assert":
+			added, err = parseConditionBlock(nested, src, ctx)
+			asserts++
+		case "data":
+			added, err = parseScopedDataBlock(nested, src, ctx)
+			if dataBlocks++; dataBlocks > 1 {
+				err = errors.New("check patch can only add a single data block")
+			}
+		default:
+			err = fmt.Errorf("unsupported block %q in check patch; only assert and data blocks can be added", nested.Type)
+		}
+		if err != nil {
+			return models.Patch{}, err
+		}
+		patch.Added = append(patch.Added, added)
+	}
+	if asserts == 0 {
+		return models.Patch{}, errors.New("check patch must contain at least one assert block")
+	}
+
+	for _, attr := range sortedAttributes(block.Body) {
+		handled, err := parseCommonArgument(attr, &patch, ctx)
+		if err != nil {
+			return models.Patch{}, err
+		}
+		if !handled {
+			return models.Patch{}, fmt.Errorf("unsupported argument %q in check patch", attr.Name)
+		}
+	}
+	return patch, nil
+}
+
+func parseScopedDataBlock(block *hclsyntax.Block, src []byte, ctx *hcl.EvalContext) (*models.AddedBlock, error) {
+	if len(block.Labels) != expectedResourceLabels {
+		return nil, errors.New("data block requires exactly 2 labels (type and name)")
+	}
+	return parseAddedBlock(block, src, ctx)
+}
+
+// parseRemovedPatch parses a patch of a removed block, which is matched by
+// its from address and created when the module does not have it.
+func parseRemovedPatch(block *hclsyntax.Block, src []byte, ctx *hcl.EvalContext) (models.Patch, error) {
+	patch := models.Patch{
+		Kind:       models.PatchRemoved,
+		Attributes: make(map[string]*models.PatchAttribute),
+		Blocks:     make(map[string]*models.PatchBlock),
+		Range:      block.Range(),
+	}
+
+	if err := parseKungfuBlocks(block.Body, &patch, false, ctx); err != nil {
+		return models.Patch{}, err
+	}
+
+	for _, nested := range block.Body.Blocks {
+		if nested.Type == kungfuBlockType {
+			continue
+		}
+		if nested.Type != "lifecycle" {
+			return models.Patch{}, fmt.Errorf("unsupported block %q in removed patch", nested.Type)
+		}
+		if _, exists := patch.Blocks[nested.Type]; exists {
+			return models.Patch{}, fmt.Errorf("duplicate %s block in removed patch", nested.Type)
+		}
+		lifecycle, err := parseRemovedLifecycle(nested, src, ctx)
+		if err != nil {
+			return models.Patch{}, err
+		}
+		patch.Blocks[nested.Type] = lifecycle
+	}
+
+	for order, attr := range sortedAttributes(block.Body) {
+		handled, err := parseCommonArgument(attr, &patch, ctx)
+		if err != nil {
+			return models.Patch{}, err
+		}
+		if handled {
+			continue
+		}
+		if attr.Name != "from" {
+			return models.Patch{}, fmt.Errorf("unsupported argument %q in removed patch", attr.Name)
+		}
+
+		traversal, diags := hcl.AbsTraversalForExpr(attr.Expr)
+		if diags.HasErrors() || !isRemovableAddress(traversal) {
+			return models.Patch{}, errors.New("from must refer to a resource or module call, such as aws_s3_bucket.logs")
+		}
+		patch.Attributes[attr.Name] = &models.PatchAttribute{
+			Value:    expressionTokens(attr.Expr, src),
+			Strategy: models.StrategyReplace,
+			Order:    order,
+		}
+	}
+
+	if _, ok := patch.Attributes["from"]; !ok {
+		return models.Patch{}, errors.New("removed patch requires a from argument")
+	}
+	return patch, nil
+}
+
+// isRemovableAddress reports whether traversal is the address of a resource
+// or module call without instance keys.
+func isRemovableAddress(traversal hcl.Traversal) bool {
+	if traversal.RootName() == "data" || len(traversal) != expectedResourceLabels {
+		return false
+	}
+	_, ok := traversal[1].(hcl.TraverseAttr)
+	return ok
+}
+
+func parseRemovedLifecycle(block *hclsyntax.Block, src []byte, ctx *hcl.EvalContext) (*models.PatchBlock, error) {
+	if len(block.Labels) != 0 || len(block.Body.Blocks) != 0 {
+		return nil, errors.New("lifecycle block of a removed patch only takes the destroy argument")
+	}
+	patchBlock := &models.PatchBlock{Attributes: make(map[string]*models.PatchAttribute)}
+	arguments := map[string]metaArgument{
+		"destroy": {strategies: []models.MergeStrategy{models.StrategyReplace}, validate: validateLiteralBool},
+	}
+	for order, attr := range sortedAttributes(block.Body) {
+		if _, known := arguments[attr.Name]; !known {
+			return nil, fmt.Errorf("unsupported argument %q in lifecycle of a removed patch", attr.Name)
+		}
+		patchAttr, err := parsePatchAttribute(attr, order, arguments, src, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("lifecycle: %w", err)
+		}
+		patchBlock.Attributes[attr.Name] = patchAttr
+	}
+	return patchBlock, nil
+}
+
+// parseConditionBlock parses a custom condition to add: a precondition or
+// postcondition of a lifecycle block, or an assert of a check block.
+func parseConditionBlock(block *hclsyntax.Block, src []byte, ctx *hcl.EvalContext) (*models.AddedBlock, error) {
+	if len(block.Labels) != 0 {
+		return nil, fmt.Errorf("%s block does not take labels", block.Type)
+	}
+	if len(block.Body.Blocks) != 0 {
+		return nil, fmt.Errorf("unsupported block %q in %s", block.Body.Blocks[0].Type, block.Type)
+	}
+
+	added, err := parseAddedBlock(block, src, ctx)
+	if err != nil {
+		return nil, err
+	}
+	for name := range added.Attributes {
+		if name != "condition" && name != "error_message" {
+			return nil, fmt.Errorf("unsupported argument %q in %s", name, block.Type)
+		}
+	}
+	for _, required := range []string{"condition", "error_message"} {
+		if _, ok := added.Attributes[required]; !ok {
+			return nil, fmt.Errorf("%s block requires a %s argument", block.Type, required)
+		}
+	}
+	if condition, ok := added.Attributes["condition"].Value.(cty.Value); ok && condition.Type() != cty.Bool {
+		return nil, fmt.Errorf("%s condition must be a bool", block.Type)
+	}
+	return added, nil
+}
+
+// parseAddedBlock parses a block a patch appends. Its arguments are evaluated
+// like other patch values, falling back to their source, and cannot use
+// strategy markers.
+func parseAddedBlock(block *hclsyntax.Block, src []byte, ctx *hcl.EvalContext) (*models.AddedBlock, error) {
+	added := &models.AddedBlock{
+		Type:       block.Type,
+		Labels:     block.Labels,
+		Attributes: make(map[string]*models.PatchAttribute),
+	}
+	for order, attr := range sortedAttributes(block.Body) {
+		patchAttr, err := parsePatchAttribute(attr, order, nil, src, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", block.Type, err)
+		}
+		if patchAttr.Strategy != models.StrategyReplace {
+			return nil, fmt.Errorf("%s: strategy markers cannot be used in added blocks", block.Type)
+		}
+		added.Attributes[attr.Name] = patchAttr
+	}
+	for _, nested := range block.Body.Blocks {
+		nestedBlock, err := parseAddedBlock(nested, src, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", block.Type, err)
+		}
+		added.Blocks = append(added.Blocks, nestedBlock)
+	}
+	return added, nil
+}
@@ -0,0 +1,43 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// ParseIncludes returns the overlays listed in the top-level include argument
+// of an overlay file, resolved relative to the file's directory. Each entry is
+// an overlay file or a directory of overlay files.
+func ParseIncludes(path string) ([]string, error) {
+	body, _, err := parseOverlayFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	attr, exists := body.Attributes["include"]
+	if !exists {
+		return nil, nil
+	}
+
+	val, diags := attr.Expr.Value(nil)
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("failed to evaluate include: %s", diags.Error())
+	}
+	paths, err := stringList(val)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include: %w", err)
+	}
+
+	includes := make([]string, 0, len(paths))
+	for _, include := range paths {
+		if include == "" {
+			return nil, errors.New("invalid include: paths must not be empty")
+		}
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		includes = append(includes, include)
+	}
+	return includes, nil
+}
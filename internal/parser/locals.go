@@ -0,0 +1,153 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// ParseLocalDeclarations returns the values declared in the locals blocks of
+// an overlay file.
+func ParseLocalDeclarations(path string) ([]models.OverlayLocal, error) {
+	body, _, err := parseOverlayFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var locals []models.OverlayLocal
+	for _, block := range body.Blocks {
+		if block.Type != "locals" {
+			continue
+		}
+		blockLocals, localsErr := parseLocalsBlock(block)
+		if localsErr != nil {
+			return nil, localsErr
+		}
+		locals = append(locals, blockLocals...)
+	}
+	return locals, nil
+}
+
+func parseLocalsBlock(block *hclsyntax.Block) ([]models.OverlayLocal, error) {
+	if len(block.Labels) != 0 {
+		return nil, fmt.Errorf("locals block does not take labels, got %d", len(block.Labels))
+	}
+	if len(block.Body.Blocks) != 0 {
+		return nil, fmt.Errorf("locals block may only contain assignments, found %s block", block.Body.Blocks[0].Type)
+	}
+
+	locals := make([]models.OverlayLocal, 0, len(block.Body.Attributes))
+	for _, attr := range sortedAttributes(block.Body) {
+		locals = append(locals, models.OverlayLocal{
+			Name:  attr.Name,
+			Expr:  attr.Expr,
+			Range: attr.SrcRange,
+		})
+	}
+	return locals, nil
+}
+
+// EvaluateLocals evaluates locals in dependency order and exposes them in ctx
+// as local.<name>. Locals may refer to variables, functions and each other.
+func EvaluateLocals(ctx *hcl.EvalContext, locals []models.OverlayLocal) error {
+	declared := make(map[string]models.OverlayLocal, len(locals))
+	for _, local := range locals {
+		if previous, exists := declared[local.Name]; exists {
+			return fmt.Errorf("local value %s is declared more than once (%s and %s)",
+				local.Name, previous.Range.String(), local.Range.String())
+		}
+		declared[local.Name] = local
+	}
+
+	order, err := localEvaluationOrder(declared)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]cty.Value, len(order))
+	for _, name := range order {
+		ctx.Variables["local"] = localObject(values)
+		val, diags := declared[name].Expr.Value(ctx)
+		if diags.HasErrors() {
+			return fmt.Errorf("failed to evaluate local.%s: %s", name, diags.Error())
+		}
+		values[name] = val
+	}
+	ctx.Variables["local"] = localObject(values)
+	return nil
+}
+
+// localEvaluationOrder sorts locals so that every local comes after the
+// locals it refers to, reporting references to undeclared locals and cycles.
+func localEvaluationOrder(declared map[string]models.OverlayLocal) ([]string, error) {
+	names := make([]string, 0, len(declared))
+	for name := range declared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(declared))
+	order := make([]string, 0, len(declared))
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("local values refer to each other in a cycle: %s",
+				strings.Join(append(path, name), " -> "))
+		}
+		state[name] = visiting
+
+		for _, dep := range localReferences(declared[name].Expr) {
+			if _, exists := declared[dep]; !exists {
+				return fmt.Errorf("local.%s refers to undeclared local value local.%s", name, dep)
+			}
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// localReferences returns the names of the locals that expr refers to.
+func localReferences(expr hcl.Expression) []string {
+	var refs []string
+	for _, traversal := range expr.Variables() {
+		if traversal.RootName() != "local" || len(traversal) < 2 {
+			continue
+		}
+		if attr, ok := traversal[1].(hcl.TraverseAttr); ok {
+			refs = append(refs, attr.Name)
+		}
+	}
+	return refs
+}
+
+func localObject(values map[string]cty.Value) cty.Value {
+	if len(values) == 0 {
+		return cty.EmptyObjectVal
+	}
+	return cty.ObjectVal(values)
+}
@@ -0,0 +1,196 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// metaArgument describes how a Terraform meta-argument is parsed in a patch.
+type metaArgument struct {
+	// strategies lists the strategies the argument may be patched with.
+	strategies []models.MergeStrategy
+	// validate checks the unwrapped patch value and returns its value.
+	validate func(expr hclsyntax.Expression, src []byte, ctx *hcl.EvalContext) (interface{}, error)
+}
+
+func (m metaArgument) parse(
+	name string,
+	patchAttr *models.PatchAttribute,
+	expr hclsyntax.Expression,
+	src []byte,
+	ctx *hcl.EvalContext,
+) error {
+	allowed := false
+	for _, strategy := range m.strategies {
+		allowed = allowed || strategy == patchAttr.Strategy
+	}
+	if !allowed {
+		return fmt.Errorf("%s cannot be patched with the %s strategy", name, patchAttr.Strategy)
+	}
+
+	value, err := m.validate(expr, src, ctx)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	patchAttr.Value = value
+	return nil
+}
+
+// resourceMetaArguments returns the meta-arguments that can be patched on a
+// resource.
+func resourceMetaArguments() map[string]metaArgument {
+	replaceOnly := []models.MergeStrategy{models.StrategyReplace}
+	return map[string]metaArgument{
+		"provider":   {strategies: replaceOnly, validate: validateProviderReference},
+		"depends_on": {strategies: listStrategies(), validate: validateReferenceList(validateDependency)},
+		"count":      {strategies: replaceOnly, validate: verbatimOrValue},
+		"for_each":   {strategies: replaceOnly, validate: verbatimOrValue},
+	}
+}
+
+// lifecycleArguments returns the arguments that can be patched in a lifecycle
+// block.
+func lifecycleArguments() map[string]metaArgument {
+	replaceOnly := []models.MergeStrategy{models.StrategyReplace}
+	return map[string]metaArgument{
+		"prevent_destroy":       {strategies: replaceOnly, validate: validateLiteralBool},
+		"create_before_destroy": {strategies: replaceOnly, validate: validateLiteralBool},
+		"ignore_changes":        {strategies: listStrategies(), validate: validateIgnoreChanges},
+		"replace_triggered_by": {
+			strategies: listStrategies(),
+			validate:   validateReferenceList(validateDependency),
+		},
+	}
+}
+
+func listStrategies() []models.MergeStrategy {
+	return []models.MergeStrategy{
+		models.StrategyReplace,
+		models.StrategyAppend,
+		models.StrategyPrepend,
+		models.StrategyRemove,
+		models.StrategyUnion,
+	}
+}
+
+func parseLifecycleBlock(block *hclsyntax.Block, src []byte, ctx *hcl.EvalContext) (*models.PatchBlock, error) {
+	if len(block.Labels) != 0 {
+		return nil, errors.New("lifecycle block does not take labels")
+	}
+
+	allowed := lifecycleArguments()
+	patchBlock := &models.PatchBlock{Attributes: make(map[string]*models.PatchAttribute)}
+	for _, nested := range block.Body.Blocks {
+		if nested.Type != "precondition" && nested.Type != "postcondition" {
+			return nil, fmt.Errorf("unsupported block %q in lifecycle", nested.Type)
+		}
+		condition, err := parseConditionBlock(nested, src, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("lifecycle: %w", err)
+		}
+		patchBlock.Added = append(patchBlock.Added, condition)
+	}
+
+	for order, attr := range sortedAttributes(block.Body) {
+		if _, known := allowed[attr.Name]; !known {
+			return nil, fmt.Errorf("unsupported argument %q in lifecycle", attr.Name)
+		}
+		patchAttr, err := parsePatchAttribute(attr, order, allowed, src, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("lifecycle: %w", err)
+		}
+		patchBlock.Attributes[attr.Name] = patchAttr
+	}
+	return patchBlock, nil
+}
+
+// verbatimOrValue evaluates expr when possible and otherwise keeps its source,
+// as for ordinary patch arguments.
+func verbatimOrValue(expr hclsyntax.Expression, src []byte, ctx *hcl.EvalContext) (interface{}, error) {
+	val, diags := expr.Value(ctx)
+	if diags.HasErrors() {
+		return expressionTokens(expr, src), nil
+	}
+	return val, nil
+}
+
+func validateLiteralBool(expr hclsyntax.Expression, _ []byte, ctx *hcl.EvalContext) (interface{}, error) {
+	val, diags := expr.Value(ctx)
+	if diags.HasErrors() || val.IsNull() || !val.IsKnown() || val.Type() != cty.Bool {
+		return nil, errors.New("must be true or false")
+	}
+	return val, nil
+}
+
+// validateProviderReference accepts a provider configuration reference such
+// as aws or aws.us_east_1.
+func validateProviderReference(expr hclsyntax.Expression, src []byte, _ *hcl.EvalContext) (interface{}, error) {
+	traversal, diags := hcl.AbsTraversalForExpr(expr)
+	if diags.HasErrors() || len(traversal) > 2 {
+		return nil, errors.New("must be a provider reference such as aws or aws.us_east_1")
+	}
+	if len(traversal) == 2 {
+		if _, ok := traversal[1].(hcl.TraverseAttr); !ok {
+			return nil, errors.New("must be a provider reference such as aws or aws.us_east_1")
+		}
+	}
+	return expressionTokens(expr, src), nil
+}
+
+// validateReferenceList returns a validator for a list of references, each
+// checked by validateElement.
+func validateReferenceList(
+	validateElement func(hcl.Traversal) error,
+) func(hclsyntax.Expression, []byte, *hcl.EvalContext) (interface{}, error) {
+	return func(expr hclsyntax.Expression, src []byte, _ *hcl.EvalContext) (interface{}, error) {
+		tuple, ok := expr.(*hclsyntax.TupleConsExpr)
+		if !ok {
+			return nil, errors.New("must be a list of references")
+		}
+		for _, element := range tuple.Exprs {
+			traversal, diags := hcl.AbsTraversalForExpr(element)
+			if diags.HasErrors() {
+				return nil, fmt.Errorf("%q is not a reference", element.Range().SliceBytes(src))
+			}
+			if err := validateElement(traversal); err != nil {
+				return nil, fmt.Errorf("%q %w", element.Range().SliceBytes(src), err)
+			}
+		}
+		return expressionTokens(expr, src), nil
+	}
+}
+
+// validateDependency accepts references to resources, data sources and
+// module calls.
+func validateDependency(traversal hcl.Traversal) error {
+	minLength := 2
+	switch traversal.RootName() {
+	case "var", "local", "count", "each", "path", "self", "terraform":
+		return errors.New("must refer to a resource, data source or module call")
+	case "data":
+		minLength = 3
+	}
+	if len(traversal) < minLength {
+		return errors.New("must refer to a resource, data source or module call")
+	}
+	return nil
+}
+
+// validateIgnoreChanges accepts the keyword all or a list of references to
+// attributes of the resource itself.
+func validateIgnoreChanges(expr hclsyntax.Expression, src []byte, ctx *hcl.EvalContext) (interface{}, error) {
+	if hcl.ExprAsKeyword(expr) == "all" {
+		return expressionTokens(expr, src), nil
+	}
+	validate := validateReferenceList(func(hcl.Traversal) error { return nil })
+	value, err := validate(expr, src, ctx)
+	if err != nil {
+		return nil, errors.New("must be all or a list of attribute references such as tags")
+	}
+	return value, nil
+}
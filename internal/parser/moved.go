@@ -0,0 +1,71 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// parseRename parses the rename argument of a patch, the new name of the
+// patched resource.
+func parseRename(attr *hclsyntax.Attribute, ctx *hcl.EvalContext) (string, error) {
+	val, diags := attr.Expr.Value(ctx)
+	if diags.HasErrors() {
+		return "", fmt.Errorf("failed to evaluate rename attribute: %s", diags.Error())
+	}
+	if val.IsNull() || !val.IsKnown() || val.Type() != cty.String {
+		return "", errors.New("rename attribute must be a string")
+	}
+	name := val.AsString()
+	if !hclsyntax.ValidIdentifier(name) {
+		return "", fmt.Errorf("rename attribute %q is not a valid resource name", name)
+	}
+	return name, nil
+}
+
+// parseInstanceKeys parses the instance_keys argument of a patch, the
+// for_each keys of the resource's instances in count index order.
+func parseInstanceKeys(attr *hclsyntax.Attribute, ctx *hcl.EvalContext) ([]string, error) {
+	val, diags := attr.Expr.Value(ctx)
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("failed to evaluate instance_keys attribute: %s", diags.Error())
+	}
+	if val.IsNull() || !val.IsWhollyKnown() || !(val.Type().IsTupleType() || val.Type().IsListType()) {
+		return nil, errors.New("instance_keys attribute must be a list of strings")
+	}
+
+	keys := make([]string, 0, val.LengthInt())
+	seen := make(map[string]bool)
+	for it := val.ElementIterator(); it.Next(); {
+		_, key := it.Element()
+		if key.IsNull() || key.Type() != cty.String {
+			return nil, errors.New("instance_keys attribute must be a list of strings")
+		}
+		if seen[key.AsString()] {
+			return nil, fmt.Errorf("duplicate instance key %q", key.AsString())
+		}
+		seen[key.AsString()] = true
+		keys = append(keys, key.AsString())
+	}
+	return keys, nil
+}
+
+// validateMove checks that a patch that changes the address of resources
+// selects a single resource by name.
+func validateMove(patch models.Patch) error {
+	if patch.Rename == "" {
+		return nil
+	}
+	if patch.ResourceType == "" || patch.ResourceName == "" || patch.NameRegex != nil ||
+		models.IsPattern(patch.ResourceType) || models.IsPattern(patch.ResourceName) {
+		return errors.New("rename requires a patch for a single resource, not a selector")
+	}
+	if patch.Rename == patch.ResourceName {
+		return fmt.Errorf("rename attribute %q is the current name of the resource", patch.Rename)
+	}
+	return nil
+}
@@ -5,12 +5,16 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/dragonfleas/kungfu/internal/models"
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hclparse"
 	"github.com/hashicorp/hcl/v2/hclsyntax"
 	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/gocty"
 )
 
 const (
@@ -21,104 +25,429 @@ const (
 )
 
 func ParseKungfuFile(path string) (*models.KungfuConfig, error) {
-	src, err := os.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
-	}
+	return ParseKungfuFileWithContext(path, nil)
+}
 
-	parser := hclparse.NewParser()
-	file, diags := parser.ParseHCL(src, path)
-	if diags.HasErrors() {
-		return nil, fmt.Errorf("failed to parse HCL: %s", diags.Error())
+// ParseKungfuFileWithContext parses an overlay file, evaluating patch
+// expressions in ctx. Expressions that cannot be evaluated, such as references
+// to the patched module's own variables or resources, are kept verbatim.
+func ParseKungfuFileWithContext(path string, ctx *hcl.EvalContext) (*models.KungfuConfig, error) {
+	body, src, err := parseOverlayFile(path)
+	if err != nil {
+		return nil, err
 	}
 
 	config := &models.KungfuConfig{
 		Patches: make([]models.Patch, 0),
 	}
 
-	body, ok := file.Body.(*hclsyntax.Body)
-	if !ok {
-		return nil, errors.New("unexpected body type")
-	}
 	for _, block := range body.Blocks {
-		if block.Type == "patch" {
-			patch, patchErr := parsePatchBlock(block)
+		switch block.Type {
+		case "patch":
+			patch, patchErr := parsePatchBlock(block, src, ctx)
 			if patchErr != nil {
 				return nil, fmt.Errorf("failed to parse patch block: %w", patchErr)
 			}
 			config.Patches = append(config.Patches, patch)
+			config.Warnings = append(config.Warnings, bareMarkerWarnings(block.Body)...)
+		case "variable":
+			variable, varErr := parseVariableBlock(block)
+			if varErr != nil {
+				return nil, fmt.Errorf("failed to parse variable block: %w", varErr)
+			}
+			config.Variables = append(config.Variables, variable)
+		case "locals":
+			locals, localsErr := parseLocalsBlock(block)
+			if localsErr != nil {
+				return nil, localsErr
+			}
+			config.Locals = append(config.Locals, locals...)
 		}
 	}
 
 	return config, nil
 }
 
-func parsePatchBlock(block *hclsyntax.Block) (models.Patch, error) {
-	if len(block.Labels) != expectedPatchLabels {
-		return models.Patch{}, fmt.Errorf(
-			"patch block requires exactly %d labels (type and name), got %d",
-			expectedPatchLabels, len(block.Labels))
+func parseOverlayFile(path string) (*hclsyntax.Body, []byte, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	parser := hclparse.NewParser()
+	file, diags := parser.ParseHCL(src, path)
+	if diags.HasErrors() {
+		return nil, nil, fmt.Errorf("failed to parse HCL: %s", diags.Error())
+	}
+
+	body, ok := file.Body.(*hclsyntax.Body)
+	if !ok {
+		return nil, nil, errors.New("unexpected body type")
+	}
+	return body, src, nil
+}
+
+func parsePatchBlock(block *hclsyntax.Block, src []byte, ctx *hcl.EvalContext) (models.Patch, error) {
+	switch labels := block.Labels; {
+	case len(labels) == 1 && labels[0] == terraformPatchLabel:
+		return parseTerraformPatch(block, src, ctx)
+	case len(labels) == expectedPatchLabels && labels[0] == providerPatchLabel:
+		return parseProviderPatch(block, src, ctx)
+	case len(labels) == expectedPatchLabels && labels[0] == checkPatchLabel:
+		return parseCheckPatch(block, src, ctx)
+	case len(labels) == 1 && labels[0] == removedPatchLabel:
+		return parseRemovedPatch(block, src, ctx)
+	case len(labels) == 1 && labels[0] == "import":
+		return models.Patch{}, errors.New(
+			"import blocks are only allowed in the root module, which kungfu does not patch")
 	}
 
 	patch := models.Patch{
-		ResourceType: block.Labels[0],
-		ResourceName: block.Labels[1],
-		Attributes:   make(map[string]*models.PatchAttribute),
-		Range:        block.Range(),
+		Attributes: make(map[string]*models.PatchAttribute),
+		Blocks:     make(map[string]*models.PatchBlock),
+		Range:      block.Range(),
 	}
 
-	for name, attr := range block.Body.Attributes {
-		if name == "source" {
-			val, diags := attr.Expr.Value(nil)
-			if diags.HasErrors() {
-				return models.Patch{}, fmt.Errorf("failed to evaluate source attribute: %s", diags.Error())
+	if err := parsePatchTarget(block, &patch, ctx); err != nil {
+		return models.Patch{}, err
+	}
+	if err := parseKungfuBlocks(block.Body, &patch, true, ctx); err != nil {
+		return models.Patch{}, err
+	}
+
+	for _, nested := range block.Body.Blocks {
+		switch nested.Type {
+		case "target", kungfuBlockType:
+		case "where":
+			conditions, whereErr := parseWhereBlock(nested, ctx)
+			if whereErr != nil {
+				return models.Patch{}, whereErr
+			}
+			patch.Where = append(patch.Where, conditions...)
+		case "lifecycle":
+			if _, exists := patch.Blocks[nested.Type]; exists {
+				return models.Patch{}, fmt.Errorf("duplicate %s block in patch", nested.Type)
 			}
-			patch.Source = val.AsString()
+			patchBlock, blockErr := parseLifecycleBlock(nested, src, ctx)
+			if blockErr != nil {
+				return models.Patch{}, blockErr
+			}
+			patch.Blocks[nested.Type] = patchBlock
+		default:
+			return models.Patch{}, fmt.Errorf("unsupported block %q in patch; only lifecycle blocks can be patched", nested.Type)
+		}
+	}
+
+	for order, attr := range sortedAttributes(block.Body) {
+		name := attr.Name
+		handled, commonErr := parseCommonArgument(attr, &patch, ctx)
+		if commonErr != nil {
+			return models.Patch{}, commonErr
+		}
+		if handled {
 			continue
 		}
 
-		patchAttr := &models.PatchAttribute{
-			Strategy: models.StrategyReplace,
+		patchAttr, attrErr := parsePatchAttribute(attr, order, resourceMetaArguments(), src, ctx)
+		if attrErr != nil {
+			return models.Patch{}, attrErr
+		}
+		patch.Attributes[name] = patchAttr
+	}
+
+	if _, hasCount := patch.Attributes["count"]; hasCount {
+		if _, hasForEach := patch.Attributes["for_each"]; hasForEach {
+			return models.Patch{}, errors.New("count and for_each cannot be set by the same patch")
 		}
+	}
 
-		strategy, value := detectMergeStrategy(attr.Expr)
-		patchAttr.Strategy = strategy
+	if err := validateMove(patch); err != nil {
+		return models.Patch{}, err
+	}
+
+	return patch, nil
+}
 
-		evalValue, diags := value.Value(nil)
+// parseCommonArgument parses the reserved arguments shared by every kind of
+// patch: source and when. It reports whether attr was one of them.
+func parseCommonArgument(attr *hclsyntax.Attribute, patch *models.Patch, ctx *hcl.EvalContext) (bool, error) {
+	switch attr.Name {
+	case "source":
+		val, diags := attr.Expr.Value(ctx)
 		if diags.HasErrors() {
-			patchAttr.Value = value
-		} else {
-			patchAttr.Value = evalValue
+			return true, fmt.Errorf("failed to evaluate source attribute: %s", diags.Error())
 		}
+		if val.IsNull() || val.Type() != cty.String {
+			return true, errors.New("source attribute must be a string")
+		}
+		patch.Source = val.AsString()
+	case "when":
+		patch.When = attr.Expr
+	default:
+		return false, nil
+	}
+	return true, nil
+}
 
-		patch.Attributes[name] = patchAttr
+// kungfuBlockType is the type of the block holding the settings of a patch
+// that control how kungfu applies it, such as its priority. Keeping them out
+// of the patch's own arguments leaves every argument name to the patched
+// configuration, so that a patch can set the priority of a load balancer
+// listener rule.
+const kungfuBlockType = "kungfu"
+
+// parseKungfuBlocks parses the kungfu block of a patch body, if it has one.
+// moves reports whether rename and instance_keys are allowed, as they are in
+// resource patches.
+func parseKungfuBlocks(body *hclsyntax.Body, patch *models.Patch, moves bool, ctx *hcl.EvalContext) error {
+	var block *hclsyntax.Block
+	for _, nested := range body.Blocks {
+		if nested.Type != kungfuBlockType {
+			continue
+		}
+		if block != nil {
+			return fmt.Errorf("duplicate %s block in patch", kungfuBlockType)
+		}
+		block = nested
+	}
+	if block == nil {
+		return nil
+	}
+	if len(block.Labels) != 0 {
+		return fmt.Errorf("%s block does not take labels", kungfuBlockType)
+	}
+	if len(block.Body.Blocks) != 0 {
+		return fmt.Errorf("unsupported block %q in %s block", block.Body.Blocks[0].Type, kungfuBlockType)
 	}
 
-	return patch, nil
+	for _, attr := range sortedAttributes(block.Body) {
+		var err error
+		switch {
+		case attr.Name == "priority":
+			patch.Priority, err = parsePriority(attr, ctx)
+		case attr.Name == "rename" && moves:
+			patch.Rename, err = parseRename(attr, ctx)
+		case attr.Name == "instance_keys" && moves:
+			patch.InstanceKeys, err = parseInstanceKeys(attr, ctx)
+		default:
+			err = fmt.Errorf("unsupported argument %q in %s block", attr.Name, kungfuBlockType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePatchAttribute parses a patch argument, validating it when it is one
+// of the given meta-arguments.
+func parsePatchAttribute(
+	attr *hclsyntax.Attribute,
+	order int,
+	metaArguments map[string]metaArgument,
+	src []byte,
+	ctx *hcl.EvalContext,
+) (*models.PatchAttribute, error) {
+	name := attr.Name
+	patchAttr := &models.PatchAttribute{
+		Strategy: models.StrategyReplace,
+		Order:    order,
+	}
+
+	strategy, value, strategyErr := detectMergeStrategy(attr.Expr)
+	if strategyErr != nil {
+		return nil, fmt.Errorf("invalid value for %s: %w", name, strategyErr)
+	}
+	patchAttr.Strategy = strategy
+	if _, twoArguments := twoArgumentMarkers()[strategy]; twoArguments {
+		if err := parseMarkerArgument(patchAttr, attr.Expr.(*hclsyntax.FunctionCallExpr)); err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+	}
+
+	if containsNestedMarker(value) {
+		_, isMeta := metaArguments[name]
+		if err := parseNestedMarkers(patchAttr, isMeta, value, src, ctx); err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+		return patchAttr, nil
+	}
+
+	if referencesOriginal(value) {
+		_, isMeta := metaArguments[name]
+		if err := parseTemplate(patchAttr, isMeta, value, src, ctx); err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+		return patchAttr, nil
+	}
+
+	if meta, isMeta := metaArguments[name]; isMeta {
+		if err := meta.parse(name, patchAttr, value, src, ctx); err != nil {
+			return nil, err
+		}
+		return patchAttr, nil
+	}
+
+	if referencesModuleCall(value) {
+		patchAttr.Expr = value
+		return patchAttr, nil
+	}
+
+	evalValue, diags := value.Value(ctx)
+	if diags.HasErrors() {
+		patchAttr.Value = expressionTokens(value, src)
+	} else {
+		patchAttr.Value = evalValue
+	}
+	if err := validateStrategyValue(patchAttr, value, src, evalValue, diags.HasErrors()); err != nil {
+		return nil, fmt.Errorf("invalid value for %s: %w", name, err)
+	}
+	return patchAttr, nil
+}
+
+// sortedAttributes returns the attributes of body in source order.
+func sortedAttributes(body *hclsyntax.Body) []*hclsyntax.Attribute {
+	attrs := make([]*hclsyntax.Attribute, 0, len(body.Attributes))
+	for _, attr := range body.Attributes {
+		attrs = append(attrs, attr)
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		return attrs[i].SrcRange.Start.Byte < attrs[j].SrcRange.Start.Byte
+	})
+	return attrs
+}
+
+// expressionTokens returns the tokens of an expression's source text, so that
+// it can be written into the patched module unchanged.
+func expressionTokens(expr hclsyntax.Expression, src []byte) hclwrite.Tokens {
+	exprSrc := expr.Range().SliceBytes(src)
+	tokens, diags := hclwrite.ParseConfig(append(append([]byte("value = "), exprSrc...), '\n'), "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return hclwrite.Tokens{{Type: hclsyntax.TokenIdent, Bytes: exprSrc}}
+	}
+	exprTokens := tokens.Body().GetAttribute("value").Expr().BuildTokens(nil)
+	if len(exprTokens) > 0 {
+		exprTokens[0].SpacesBefore = 0
+	}
+	return exprTokens
 }
 
-func detectMergeStrategy(expr hclsyntax.Expression) (models.MergeStrategy, hclsyntax.Expression) {
+func parsePriority(attr *hclsyntax.Attribute, ctx *hcl.EvalContext) (int, error) {
+	val, diags := attr.Expr.Value(ctx)
+	if diags.HasErrors() {
+		return 0, fmt.Errorf("failed to evaluate priority attribute: %s", diags.Error())
+	}
+	if val.IsNull() || val.Type() != cty.Number {
+		return 0, errors.New("priority attribute must be a number")
+	}
+
+	var priority int
+	if err := gocty.FromCtyValue(val, &priority); err != nil {
+		return 0, fmt.Errorf("priority attribute must be a whole number: %w", err)
+	}
+	return priority, nil
+}
+
+// detectMergeStrategy unwraps a strategy marker around a patch value. Markers
+// are written kf::merge(...), kf::append(...) or kf::replace(...). The bare
+// forms merge(...), append(...) and replace(...) with a single argument are
+// also accepted; calls with any other number of arguments are ordinary
+// function calls, so merge(a, b) evaluates Terraform's merge function.
+// The markers in twoArgumentMarkers take another argument before the value.
+func detectMergeStrategy(
+	expr hclsyntax.Expression,
+) (models.MergeStrategy, hclsyntax.Expression, error) {
 	callExpr, ok := expr.(*hclsyntax.FunctionCallExpr)
 	if !ok {
-		return models.StrategyReplace, expr
+		return models.StrategyReplace, expr, nil
 	}
 
-	switch callExpr.Name {
-	case "merge":
-		if len(callExpr.Args) == 1 {
-			return models.StrategyMerge, callExpr.Args[0]
+	name, namespaced := strings.CutPrefix(callExpr.Name, StrategyNamespace)
+	strategy, isMarker := strategyMarkers()[name]
+	if namespaced && !isMarker {
+		return models.StrategyReplace, nil, fmt.Errorf("unknown strategy %s", callExpr.Name)
+	}
+	if !namespaced && !legacyMarkers()[name] {
+		return models.StrategyReplace, expr, nil
+	}
+	if !isMarker || (!namespaced && len(callExpr.Args) != 1) {
+		return models.StrategyReplace, expr, nil
+	}
+	if arguments, twoArguments := twoArgumentMarkers()[strategy]; twoArguments {
+		if len(callExpr.Args) != 2 || callExpr.ExpandFinal {
+			return models.StrategyReplace, nil, fmt.Errorf("%s takes %s", callExpr.Name, arguments)
 		}
-	case "append":
-		if len(callExpr.Args) == 1 {
-			return models.StrategyAppend, callExpr.Args[0]
+		return strategy, callExpr.Args[1], nil
+	}
+	if len(callExpr.Args) != 1 || callExpr.ExpandFinal {
+		return models.StrategyReplace, nil, fmt.Errorf("%s takes exactly one argument", callExpr.Name)
+	}
+	return strategy, callExpr.Args[0], nil
+}
+
+func strategyMarkers() map[string]models.MergeStrategy {
+	return map[string]models.MergeStrategy{
+		"merge":   models.StrategyMerge,
+		"append":  models.StrategyAppend,
+		"replace": models.StrategyReplace,
+		"prepend": models.StrategyPrepend,
+		"remove":  models.StrategyRemove,
+		"union":   models.StrategyUnion,
+		"at":      models.StrategyIndex,
+
+		"shallow_merge": models.StrategyShallowMerge,
+		"defaults":      models.StrategyDefaults,
+		"delete_keys":   models.StrategyDeleteKeys,
+		"merge_by":      models.StrategyMergeBy,
+
+		"prefix":        models.StrategyPrefix,
+		"suffix":        models.StrategySuffix,
+		"regex_replace": models.StrategyRegexReplace,
+	}
+}
+
+// twoArgumentMarkers are the markers that take an argument before the value,
+// described for error messages.
+func twoArgumentMarkers() map[models.MergeStrategy]string {
+	return map[models.MergeStrategy]string{
+		models.StrategyMergeBy:      "a key name and a list of objects",
+		models.StrategyRegexReplace: "a pattern and a replacement",
+	}
+}
+
+// legacyMarkers are the strategy markers that may also be written without the
+// kf:: namespace. Newer strategies are only recognized with it, so calls to
+// functions such as a provider-defined remove are never taken for markers.
+func legacyMarkers() map[string]bool {
+	return map[string]bool{
+		"merge":   true,
+		"append":  true,
+		"replace": true,
+	}
+}
+
+// bareMarkerWarnings warns about the arguments of a patch body, and of its
+// nested blocks, whose value is a strategy marker without the kf:: namespace,
+// such as merge({...}). Whether such a call is a marker depends only on its
+// number of arguments, so the namespaced form is clearer.
+func bareMarkerWarnings(body *hclsyntax.Body) []string {
+	var warnings []string
+	for _, attr := range sortedAttributes(body) {
+		call, ok := attr.Expr.(*hclsyntax.FunctionCallExpr)
+		if !ok || !legacyMarkers()[call.Name] || len(call.Args) != 1 {
+			continue
 		}
-	case "replace":
-		if len(callExpr.Args) == 1 {
-			return models.StrategyReplace, callExpr.Args[0]
+		warnings = append(warnings, fmt.Sprintf(
+			"%s:%d: %s(...) with a single argument is read as the %s%s strategy; write %s%s(...) instead",
+			attr.SrcRange.Filename, attr.SrcRange.Start.Line, call.Name,
+			StrategyNamespace, call.Name, StrategyNamespace, call.Name))
+	}
+	for _, block := range body.Blocks {
+		if block.Type != kungfuBlockType {
+			warnings = append(warnings, bareMarkerWarnings(block.Body)...)
 		}
 	}
-
-	return models.StrategyReplace, expr
+	return warnings
 }
 
 func ParseHCLFile(path string) (*models.HCLFile, error) {
@@ -141,6 +470,8 @@ func ParseHCLFile(path string) (*models.HCLFile, error) {
 		Outputs:   make(map[string]*models.Output),
 		Locals:    make(map[string]*models.Local),
 		Data:      make(map[string]*models.DataSource),
+		Providers: make(map[string]*models.ProviderConfig),
+		Checks:    make(map[string]*hclwrite.Block),
 	}
 
 	body := writeFile.Body()
@@ -176,6 +507,24 @@ func ParseHCLFile(path string) (*models.HCLFile, error) {
 			hclFile.Locals["locals"] = &models.Local{
 				Block: block,
 			}
+		case "terraform":
+			hclFile.TerraformBlocks = append(hclFile.TerraformBlocks, block)
+		case "check":
+			if labels := block.Labels(); len(labels) == 1 {
+				hclFile.Checks[labels[0]] = block
+			}
+		case "removed":
+			hclFile.RemovedBlocks = append(hclFile.RemovedBlocks, block)
+		case "provider":
+			labels := block.Labels()
+			if len(labels) == 1 {
+				provider := &models.ProviderConfig{
+					Name:  labels[0],
+					Alias: providerAlias(block),
+					Block: block,
+				}
+				hclFile.Providers[provider.Address()] = provider
+			}
 		case "data":
 			labels := block.Labels()
 			if len(labels) == expectedResourceLabels {
@@ -247,14 +596,27 @@ func parseModulesFromFile(tfFile, rootPath string) []models.ModuleCall {
 func extractModuleCall(block *hclsyntax.Block, rootPath string) models.ModuleCall {
 	moduleCall := models.ModuleCall{
 		Name: block.Labels[0],
+		Args: make(map[string]cty.Value),
 	}
 
 	for name, attr := range block.Body.Attributes {
-		if name == "source" {
-			val, evalDiags := attr.Expr.Value(nil)
-			if !evalDiags.HasErrors() {
+		val, evalDiags := attr.Expr.Value(nil)
+		switch name {
+		case "source":
+			if !evalDiags.HasErrors() && val.Type() == cty.String && !val.IsNull() {
 				moduleCall.Source = val.AsString()
 			}
+		case "version":
+			if !evalDiags.HasErrors() && val.Type() == cty.String && !val.IsNull() {
+				moduleCall.Version = val.AsString()
+			}
+		case "count", "for_each", "depends_on", "providers":
+			// Meta-arguments are not inputs of the module.
+		default:
+			if evalDiags.HasErrors() {
+				val = cty.DynamicVal
+			}
+			moduleCall.Args[name] = val
 		}
 	}
 
@@ -1,10 +1,16 @@
 package parser_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/dragonfleas/kungfu/internal/parser"
 	"github.com/dragonfleas/kungfu/internal/testutil"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
 )
 
 func TestParseKungfuFile_ReplaceStrategy(t *testing.T) {
@@ -90,3 +96,747 @@ func TestParseHCLFile_ResourceKey(t *testing.T) {
 		t.Error("expected resource key aws_instance.api to exist")
 	}
 }
+
+func TestParseKungfuFile_Priority(t *testing.T) {
+	content := `patch "aws_instance" "web" {
+  instance_type = "t3.large"
+
+  kungfu {
+    priority = 10
+  }
+}`
+
+	config, _ := testutil.WriteAndParseKungfuFile(t, content)
+
+	patch := config.Patches[0]
+
+	if patch.Priority != 10 {
+		t.Errorf("expected priority 10, got %d", patch.Priority)
+	}
+	if _, exists := patch.Attributes["priority"]; exists {
+		t.Error("expected priority to not be treated as a patched attribute")
+	}
+}
+
+func TestParseKungfuFile_ResourceArgumentNamedPriority(t *testing.T) {
+	content := `patch "aws_lb_listener_rule" "api" {
+  priority = 100
+  rename   = "internal"
+}`
+
+	config, _ := testutil.WriteAndParseKungfuFile(t, content)
+
+	patch := config.Patches[0]
+
+	if patch.Priority != 0 || patch.Rename != "" {
+		t.Errorf("expected no patch settings, got priority %d and rename %q", patch.Priority, patch.Rename)
+	}
+	attr, exists := patch.Attributes["priority"]
+	if !exists || !attr.Value.(cty.Value).RawEquals(cty.NumberIntVal(100)) {
+		t.Errorf("expected priority to be patched as a resource argument, got %#v", attr)
+	}
+	if _, exists := patch.Attributes["rename"]; !exists {
+		t.Error("expected rename to be patched as a resource argument")
+	}
+}
+
+func TestParseKungfuFile_InvalidKungfuBlock(t *testing.T) {
+	tests := map[string]string{
+		"unknown setting":   "patch \"aws_s3_bucket\" \"this\" {\n  kungfu {\n    tags = {}\n  }\n}",
+		"duplicate":         "patch \"aws_s3_bucket\" \"this\" {\n  kungfu {}\n  kungfu {}\n}",
+		"labels":            "patch \"aws_s3_bucket\" \"this\" {\n  kungfu \"x\" {}\n}",
+		"rename in check":   "patch \"check\" \"health\" {\n  kungfu {\n    rename = \"x\"\n  }\n  assert {\n    condition     = true\n    error_message = \"x\"\n  }\n}",
+		"priority a string": "patch \"aws_s3_bucket\" \"this\" {\n  kungfu {\n    priority = \"high\"\n  }\n}",
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := testutil.WriteTestFile(t, t.TempDir(), "test.kf.hcl", content)
+			if _, err := parser.ParseKungfuFile(path); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestParseKungfuFile_AttributeOrder(t *testing.T) {
+	content := `patch "aws_instance" "web" {
+  source        = "./modules/app"
+  monitoring    = true
+  instance_type = "t3.large"
+  ami           = "ami-123"
+}`
+
+	config, _ := testutil.WriteAndParseKungfuFile(t, content)
+
+	attrs := config.Patches[0].Attributes
+	if !(attrs["monitoring"].Order < attrs["instance_type"].Order && attrs["instance_type"].Order < attrs["ami"].Order) {
+		t.Errorf("expected attributes ordered by declaration, got monitoring=%d instance_type=%d ami=%d",
+			attrs["monitoring"].Order, attrs["instance_type"].Order, attrs["ami"].Order)
+	}
+}
+
+func TestParseKungfuFile_TargetBlock(t *testing.T) {
+	content := `patch {
+  target {
+    type       = "aws_s3_*"
+    name_regex = "^logs-"
+    provider   = "aws"
+  }
+
+  force_destroy = false
+}`
+
+	config, _ := testutil.WriteAndParseKungfuFile(t, content)
+
+	patch := config.Patches[0]
+
+	if patch.ResourceType != "aws_s3_*" || patch.ResourceName != "" || patch.Provider != "aws" {
+		t.Errorf("unexpected target: type=%q name=%q provider=%q",
+			patch.ResourceType, patch.ResourceName, patch.Provider)
+	}
+	if patch.NameRegex == nil || !patch.NameRegex.MatchString("logs-archive") {
+		t.Error("expected name_regex to be compiled")
+	}
+}
+
+func TestParseKungfuFile_TargetBlockWithLabels(t *testing.T) {
+	content := `patch "aws_s3_bucket" "*" {
+  target {
+    type = "aws_s3_bucket"
+  }
+}`
+
+	tmpDir := t.TempDir()
+	path := testutil.WriteTestFile(t, tmpDir, "test.kf.hcl", content)
+
+	if _, err := parser.ParseKungfuFile(path); err == nil {
+		t.Error("expected error when combining labels and a target block")
+	}
+}
+
+func TestParseKungfuFile_WhereBlocks(t *testing.T) {
+	content := `patch "aws_instance" "*" {
+  where {
+    attribute = "instance_type"
+    prefix    = "m5"
+  }
+
+  where {
+    attribute = "tags"
+    lacks_key = "Owner"
+  }
+
+  monitoring = true
+}`
+
+	config, _ := testutil.WriteAndParseKungfuFile(t, content)
+
+	where := config.Patches[0].Where
+	if len(where) != 2 {
+		t.Fatalf("expected 2 conditions, got %d", len(where))
+	}
+	if where[0].Attribute != "instance_type" || where[0].Operator != models.ConditionPrefix {
+		t.Errorf("unexpected first condition: %+v", where[0])
+	}
+	if where[1].Operator != models.ConditionLacksKey {
+		t.Errorf("expected lacks_key condition, got %s", where[1].Operator)
+	}
+}
+
+func TestParseKungfuFile_WhereUnknownOperator(t *testing.T) {
+	content := `patch "aws_instance" "*" {
+  where {
+    attribute = "instance_type"
+    startswith = "m5"
+  }
+}`
+
+	tmpDir := t.TempDir()
+	path := testutil.WriteTestFile(t, tmpDir, "test.kf.hcl", content)
+
+	if _, err := parser.ParseKungfuFile(path); err == nil {
+		t.Error("expected error for unsupported where operator")
+	}
+}
+
+func TestParseKungfuFileWithContext_Variables(t *testing.T) {
+	content := `variable "size" {
+  type    = string
+  default = "t3.small"
+}
+
+variable "replicas" {
+  type = number
+}
+
+patch "aws_instance" "web" {
+  instance_type = var.size
+  count         = var.replicas
+  subnet_id     = var.subnet_id
+}`
+
+	tmpDir := t.TempDir()
+	path := testutil.WriteTestFile(t, tmpDir, "test.kf.hcl", content)
+	varFile := testutil.WriteTestFile(t, tmpDir, "prod.kfvars.hcl", `size = "m5.large"
+replicas = 2`)
+
+	declarations, err := parser.ParseVariableDeclarations(path)
+	if err != nil {
+		t.Fatalf("failed to parse declarations: %v", err)
+	}
+	values, err := parser.ResolveVariables(declarations, parser.VariableInputs{
+		Vars:     []string{"replicas=3"},
+		VarFiles: []string{varFile},
+		Environ:  []string{"KUNGFU_VAR_size=t3.medium", "KUNGFU_VAR_other=ignored"},
+	})
+	if err != nil {
+		t.Fatalf("failed to resolve variables: %v", err)
+	}
+
+	config, err := parser.ParseKungfuFileWithContext(path, parser.NewEvalContext(values))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	attrs := config.Patches[0].Attributes
+	if got := attrs["instance_type"].Value.(cty.Value); !got.RawEquals(cty.StringVal("m5.large")) {
+		t.Errorf("expected var file to override environment, got %#v", got)
+	}
+	if got := attrs["count"].Value.(cty.Value); !got.RawEquals(cty.NumberIntVal(3)) {
+		t.Errorf("expected --var to override var file, got %#v", got)
+	}
+	if got, ok := attrs["subnet_id"].Value.(hclwrite.Tokens); !ok || string(got.Bytes()) != "var.subnet_id" {
+		t.Errorf("expected unresolved reference to be kept verbatim, got %#v", attrs["subnet_id"].Value)
+	}
+}
+
+func TestResolveVariables_Errors(t *testing.T) {
+	declarations := []models.OverlayVariable{
+		{Name: "size", Type: cty.String, Default: cty.NilVal},
+		{Name: "replicas", Type: cty.Number, Default: cty.NumberIntVal(1)},
+	}
+
+	tests := []struct {
+		name string
+		vars []string
+	}{
+		{name: "missing required", vars: nil},
+		{name: "undeclared", vars: []string{"size=a", "zone=b"}},
+		{name: "wrong type", vars: []string{"size=a", "replicas=many"}},
+		{name: "malformed", vars: []string{"size"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parser.ResolveVariables(declarations, parser.VariableInputs{Vars: tt.vars}); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestFunctions_MatchTerraform(t *testing.T) {
+	tests := map[string]struct {
+		expr string
+		want string
+	}{
+		"cidrsubnet ipv4":      {`cidrsubnet("10.1.2.0/24", 4, 15)`, "10.1.2.240/28"},
+		"cidrsubnet ipv6":      {`cidrsubnet("fd00:fd12:3456:7890::/56", 16, 162)`, "fd00:fd12:3456:7800:a200::/72"},
+		"cidrhost":             {`cidrhost("10.12.112.0/20", 268)`, "10.12.113.12"},
+		"cidrhost negative":    {`cidrhost("10.12.112.0/20", -1)`, "10.12.127.255"},
+		"cidrhost ipv6":        {`cidrhost("fd00:fd12:3456:7890:00a2::/72", 34)`, "fd00:fd12:3456:7890::22"},
+		"cidrnetmask":          {`cidrnetmask("172.16.0.0/12")`, "255.240.0.0"},
+		"base64encode":         {`base64encode("Hello World")`, "SGVsbG8gV29ybGQ="},
+		"base64decode":         {`base64decode("SGVsbG8gV29ybGQ=")`, "Hello World"},
+		"length of string":     {`tostring(length("héllo"))`, "5"},
+		"length of list":       {`tostring(length(["a", "b"]))`, "2"},
+		"replace substring":    {`replace("1 + 2 + 3", "+", "-")`, "1 - 2 - 3"},
+		"replace regular expr": {`replace("hello world", "/w.*d/", "everybody")`, "hello everybody"},
+	}
+
+	ctx := parser.NewEvalContext(nil)
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			expr, diags := hclsyntax.ParseExpression([]byte(tt.expr), "", hcl.InitialPos)
+			if diags.HasErrors() {
+				t.Fatalf("failed to parse: %s", diags.Error())
+			}
+			got, diags := expr.Value(ctx)
+			if diags.HasErrors() {
+				t.Fatalf("failed to evaluate: %s", diags.Error())
+			}
+			if !got.RawEquals(cty.StringVal(tt.want)) {
+				t.Errorf("expected %q, got %#v", tt.want, got)
+			}
+		})
+	}
+
+	for _, expr := range []string{
+		`cidrsubnet("10.0.0.0/30", 4, 0)`,
+		`cidrsubnet("10.0.0.0/16", 2, 4)`,
+		`cidrhost("10.0.0.0/30", 4)`,
+		`base64decode("not base64")`,
+	} {
+		parsed, _ := hclsyntax.ParseExpression([]byte(expr), "", hcl.InitialPos)
+		if _, diags := parsed.Value(ctx); !diags.HasErrors() {
+			t.Errorf("expected %s to fail", expr)
+		}
+	}
+}
+
+func TestParseKungfuFileWithContext_LocalsAndFunctions(t *testing.T) {
+	content := `locals {
+  tags    = merge(local.base, { Env = upper(var.env) })
+  base    = { Team = "platform" }
+  subnets = [for i in range(2) : cidrsubnet("10.0.0.0/16", 8, i)]
+}
+
+patch "aws_instance" "web" {
+  tags       = kf::merge(local.tags)
+  subnet_ids = local.subnets
+  name       = format("%s-web", var.env)
+}`
+
+	tmpDir := t.TempDir()
+	path := testutil.WriteTestFile(t, tmpDir, "test.kf.hcl", content)
+
+	locals, err := parser.ParseLocalDeclarations(path)
+	if err != nil {
+		t.Fatalf("failed to parse locals: %v", err)
+	}
+	ctx := parser.NewEvalContext(map[string]cty.Value{"env": cty.StringVal("prod")})
+	if err := parser.EvaluateLocals(ctx, locals); err != nil {
+		t.Fatalf("failed to evaluate locals: %v", err)
+	}
+
+	config, err := parser.ParseKungfuFileWithContext(path, ctx)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	attrs := config.Patches[0].Attributes
+	if attrs["tags"].Strategy != models.StrategyMerge {
+		t.Errorf("expected kf::merge to select the merge strategy, got %s", attrs["tags"].Strategy)
+	}
+	wantTags := cty.ObjectVal(map[string]cty.Value{"Team": cty.StringVal("platform"), "Env": cty.StringVal("PROD")})
+	if got := attrs["tags"].Value.(cty.Value); !got.RawEquals(wantTags) {
+		t.Errorf("unexpected tags %#v", got)
+	}
+	wantSubnets := cty.TupleVal([]cty.Value{cty.StringVal("10.0.0.0/24"), cty.StringVal("10.0.1.0/24")})
+	if got := attrs["subnet_ids"].Value.(cty.Value); !got.RawEquals(wantSubnets) {
+		t.Errorf("unexpected subnets %#v", got)
+	}
+	if got := attrs["name"].Value.(cty.Value); !got.RawEquals(cty.StringVal("prod-web")) {
+		t.Errorf("unexpected name %#v", got)
+	}
+}
+
+func TestParseKungfuFile_StrategyMarkers(t *testing.T) {
+	content := `patch "aws_instance" "web" {
+  tags     = merge({ A = "a" }, { B = "b" })
+  legacy   = merge({ A = "a" })
+  explicit = kf::replace(merge({ A = "a" }))
+}`
+
+	config, _ := testutil.WriteAndParseKungfuFile(t, content)
+
+	attrs := config.Patches[0].Attributes
+	if attrs["tags"].Strategy != models.StrategyReplace {
+		t.Errorf("expected multi-argument merge to be a function call, got %s", attrs["tags"].Strategy)
+	}
+	if attrs["legacy"].Strategy != models.StrategyMerge {
+		t.Errorf("expected single-argument merge to be a strategy marker, got %s", attrs["legacy"].Strategy)
+	}
+	if attrs["explicit"].Strategy != models.StrategyReplace {
+		t.Errorf("expected kf::replace strategy, got %s", attrs["explicit"].Strategy)
+	}
+
+	if len(config.Warnings) != 1 || !strings.Contains(config.Warnings[0], ":3: merge(...) with a single argument") ||
+		!strings.Contains(config.Warnings[0], "write kf::merge(...) instead") {
+		t.Errorf("expected a warning for the bare merge marker only, got %v", config.Warnings)
+	}
+}
+
+func TestParseKungfuFile_ListAndMapStrategies(t *testing.T) {
+	content := `patch "aws_instance" "web" {
+  first   = kf::prepend(["sg-first"])
+  ids     = kf::remove(["sg-legacy"])
+  actions = kf::union(["s3:GetObject"])
+  subnets = kf::at({ 0 = "subnet-a", 2 = aws_subnet.c.id })
+  legacy  = remove(["a"])
+  tags    = kf::defaults({ Owner = "platform" })
+  labels  = kf::delete_keys(["legacy"])
+  config  = kf::shallow_merge({ logging = { level = "debug" } })
+
+  depends_on = kf::union([aws_iam_role.app])
+}`
+
+	config, _ := testutil.WriteAndParseKungfuFile(t, content)
+
+	expected := map[string]models.MergeStrategy{
+		"first":      models.StrategyPrepend,
+		"ids":        models.StrategyRemove,
+		"actions":    models.StrategyUnion,
+		"subnets":    models.StrategyIndex,
+		"legacy":     models.StrategyReplace,
+		"tags":       models.StrategyDefaults,
+		"labels":     models.StrategyDeleteKeys,
+		"config":     models.StrategyShallowMerge,
+		"depends_on": models.StrategyUnion,
+	}
+	attrs := config.Patches[0].Attributes
+	for name, strategy := range expected {
+		if attrs[name].Strategy != strategy {
+			t.Errorf("expected %s to use %s, got %s", name, strategy, attrs[name].Strategy)
+		}
+	}
+}
+
+func TestParseKungfuFile_MergeBy(t *testing.T) {
+	content := `patch "aws_instance" "web" {
+  ingress = kf::merge_by("name", [
+    { name = "https", cidr_blocks = ["10.0.0.0/8"] },
+    { name = "ssh", security_groups = [aws_security_group.bastion.id] },
+  ])
+}`
+
+	config, _ := testutil.WriteAndParseKungfuFile(t, content)
+
+	attr := config.Patches[0].Attributes["ingress"]
+	if attr.Strategy != models.StrategyMergeBy || attr.MergeKey != "name" {
+		t.Errorf("expected merge_by on name, got %s on %q", attr.Strategy, attr.MergeKey)
+	}
+	if _, verbatim := attr.Value.(hclwrite.Tokens); !verbatim {
+		t.Errorf("expected a list with references to be kept verbatim, got %T", attr.Value)
+	}
+}
+
+func TestParseKungfuFile_NestedMarkers(t *testing.T) {
+	content := `patch "aws_iam_role_policy" "app" {
+  policy = kf::merge({
+    Statement = kf::append([{ Effect = "Deny", Action = ["s3:DeleteObject"], Resource = "*" }])
+    Condition = { Tags = kf::delete_keys(["Owner"]) }
+  })
+}`
+
+	config, _ := testutil.WriteAndParseKungfuFile(t, content)
+
+	attr := config.Patches[0].Attributes["policy"]
+	if attr.Strategy != models.StrategyMerge {
+		t.Errorf("expected merge, got %s", attr.Strategy)
+	}
+	if _, verbatim := attr.Value.(hclwrite.Tokens); !verbatim {
+		t.Errorf("expected an object with nested strategies to be kept verbatim, got %T", attr.Value)
+	}
+
+	statement := attr.Nested["Statement"]
+	if statement == nil || statement.Attribute == nil || statement.Attribute.Strategy != models.StrategyAppend {
+		t.Errorf("expected Statement to be appended, got %+v", statement)
+	}
+	condition := attr.Nested["Condition"]
+	if condition == nil || condition.Attribute != nil {
+		t.Fatalf("expected Condition to hold nested markers, got %+v", condition)
+	}
+	if tags := condition.Object["Tags"]; tags == nil || tags.Attribute.Strategy != models.StrategyDeleteKeys {
+		t.Errorf("expected Condition.Tags to delete keys, got %+v", tags)
+	}
+}
+
+func TestParseKungfuFileWithContext_StringStrategies(t *testing.T) {
+	content := `patch "aws_s3_bucket" "logs" {
+  bucket = kf::prefix("${var.env}-")
+  policy = kf::regex_replace("_v[0-9]+$", "_v2")
+  name   = format("%s-%s", original, var.env)
+  region = coalesce(original, var.region)
+}`
+
+	path := testutil.WriteTestFile(t, t.TempDir(), "test.kf.hcl", content)
+	config, err := parser.ParseKungfuFileWithContext(path, parser.NewEvalContext(map[string]cty.Value{
+		"env": cty.StringVal("prod"),
+	}))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	attrs := config.Patches[0].Attributes
+	if attrs["bucket"].Strategy != models.StrategyPrefix || !attrs["bucket"].Value.(cty.Value).RawEquals(cty.StringVal("prod-")) {
+		t.Errorf("expected prefix prod-, got %s %#v", attrs["bucket"].Strategy, attrs["bucket"].Value)
+	}
+	if attrs["policy"].Strategy != models.StrategyRegexReplace || attrs["policy"].Pattern != "_v[0-9]+$" {
+		t.Errorf("expected regex_replace of _v[0-9]+$, got %s of %q", attrs["policy"].Strategy, attrs["policy"].Pattern)
+	}
+
+	templates := map[string]string{
+		"name":   `format("%s-%s", original, "prod")`,
+		"region": `coalesce(original, var.region)`,
+	}
+	for name, want := range templates {
+		attr := attrs[name]
+		if attr.Strategy != models.StrategyTemplate {
+			t.Errorf("expected %s to be a template, got %s", name, attr.Strategy)
+			continue
+		}
+		if got := string(attr.Value.(hclwrite.Tokens).Bytes()); got != want {
+			t.Errorf("expected %s to be %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestParseKungfuFile_InvalidStrategyMarker(t *testing.T) {
+	tests := map[string]string{
+		"unknown":         `tags = kf::shuffle(["a"])`,
+		"arguments":       `tags = kf::merge({ A = "a" }, { B = "b" })`,
+		"union string":    `ids = kf::union("a")`,
+		"append map":      `ids = kf::append({ A = "a" })`,
+		"at list":         `ids = kf::at(["a"])`,
+		"at negative":     `ids = kf::at({ "-1" = "a" })`,
+		"at name":         `ids = kf::at({ first = "a" })`,
+		"at duplicate":    `ids = kf::at({ 0 = "a", "0" = "b" })`,
+		"depends_on at":   `depends_on = kf::at({ 0 = aws_iam_role.app })`,
+		"remove list of":  `ids = kf::remove(1)`,
+		"defaults list":   `tags = kf::defaults(["a"])`,
+		"shallow string":  `tags = kf::shallow_merge("a")`,
+		"delete string":   `tags = kf::delete_keys("Owner")`,
+		"delete empty":    `tags = kf::delete_keys([])`,
+		"delete numbers":  `tags = kf::delete_keys([1])`,
+		"merge_by one":    `rules = kf::merge_by([{ id = "a" }])`,
+		"merge_by key":    `rules = kf::merge_by(var.key, [{ id = "a" }])`,
+		"merge_by list":   `rules = kf::merge_by("id", { id = "a" })`,
+		"merge_by field":  `rules = kf::merge_by("id", [{ name = "a" }])`,
+		"merge_by twice":  `rules = kf::merge_by("id", [{ id = "a" }, { id = "a", days = 1 }])`,
+		"merge_by refs":   `rules = kf::merge_by("id", [{ id = aws_s3_bucket.a.id }, { id = aws_s3_bucket.a.id }])`,
+		"merge_by meta":   `depends_on = kf::merge_by("id", [aws_iam_role.app])`,
+		"merge_by nested": `rules = kf::merge_by("id", [{ id = "a", tags = kf::merge({ a = "b" }) }])`,
+		"prefix number":   `name = kf::prefix(1)`,
+		"regex pattern":   `name = kf::regex_replace("(", "x")`,
+		"regex one":       `name = kf::regex_replace("x")`,
+		"regex refs":      `name = kf::regex_replace("x", aws_s3_bucket.a.id)`,
+		"original merge":  `tags = kf::merge(merge(original, { A = "a" }))`,
+		"original meta":   `count = original + 1`,
+		"original call":   `name = format("%s-%s", original, kungfu.module.name)`,
+		"nested append":   `ids = kf::append({ A = kf::append(["a"]) })`,
+		"nested invalid":  `policy = kf::merge({ Statement = kf::append("a") })`,
+		"nested meta":     `for_each = kf::merge({ a = { names = kf::append(["x"]) } })`,
+		"nested call":     `tags = kf::merge({ Names = kf::append([kungfu.module.name]) })`,
+	}
+
+	for name, attr := range tests {
+		t.Run(name, func(t *testing.T) {
+			content := "patch \"aws_instance\" \"web\" {\n  " + attr + "\n}"
+			path := testutil.WriteTestFile(t, t.TempDir(), "test.kf.hcl", content)
+			if _, err := parser.ParseKungfuFile(path); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestEvaluateLocals_Errors(t *testing.T) {
+	tests := map[string]string{
+		"cycle":      "a = local.b\n  b = local.a",
+		"undeclared": "a = local.missing",
+	}
+
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			content := "locals {\n  " + body + "\n}"
+			path := testutil.WriteTestFile(t, t.TempDir(), "test.kf.hcl", content)
+			locals, err := parser.ParseLocalDeclarations(path)
+			if err != nil {
+				t.Fatalf("failed to parse locals: %v", err)
+			}
+			if err := parser.EvaluateLocals(parser.NewEvalContext(nil), locals); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestParseRootModule_ModuleArguments(t *testing.T) {
+	rootDir := t.TempDir()
+	testutil.WriteTestFile(t, rootDir, "main.tf", `module "vpc" {
+  source     = "terraform-aws-modules/vpc/aws"
+  version    = "~> 5.0"
+  name       = "main"
+  create_igw = true
+  azs        = var.azs
+  count      = 1
+}`)
+
+	modules, err := parser.ParseRootModule(rootDir)
+	if err != nil {
+		t.Fatalf("failed to parse root module: %v", err)
+	}
+
+	module := modules[0]
+	if module.Version != "~> 5.0" {
+		t.Errorf("expected version constraint, got %q", module.Version)
+	}
+	if !module.Args["name"].RawEquals(cty.StringVal("main")) || !module.Args["create_igw"].RawEquals(cty.True) {
+		t.Errorf("unexpected literal arguments: %#v", module.Args)
+	}
+	if module.Args["azs"].IsKnown() {
+		t.Error("expected argument referring to the root module to be unknown")
+	}
+	if _, exists := module.Args["count"]; exists {
+		t.Error("expected meta-arguments to be excluded")
+	}
+}
+
+func TestParseKungfuFile_InvalidMetaArguments(t *testing.T) {
+	tests := map[string]string{
+		"provider expression":   `provider = "aws.west"`,
+		"provider too long":     `provider = aws.west.extra`,
+		"depends_on variable":   `depends_on = [var.role]`,
+		"depends_on not list":   `depends_on = aws_iam_role.reader`,
+		"merge into depends_on": `depends_on = kf::merge([aws_iam_role.reader])`,
+		"count and for_each":    "count = 1\n  for_each = var.items",
+		"prevent_destroy":       "lifecycle {\n    prevent_destroy = var.protect\n  }",
+		"ignore_changes":        "lifecycle {\n    ignore_changes = [\"tags\"]\n  }",
+		"lifecycle argument":    "lifecycle {\n    prevent_replace = true\n  }",
+		"nested block":          "root_block_device {\n    encrypted = true\n  }",
+	}
+
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			content := "patch \"aws_s3_bucket\" \"data\" {\n  " + body + "\n}"
+			path := testutil.WriteTestFile(t, t.TempDir(), "test.kf.hcl", content)
+			if _, err := parser.ParseKungfuFile(path); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestParseKungfuFile_InvalidMoves(t *testing.T) {
+	tests := map[string]string{
+		"rename selector":       "\"*\" {\n  kungfu {\n    rename = \"data\"\n  }\n}",
+		"rename identifier":     "\"this\" {\n  kungfu {\n    rename = \"1bucket\"\n  }\n}",
+		"rename same name":      "\"this\" {\n  kungfu {\n    rename = \"this\"\n  }\n}",
+		"instance_keys numbers": "\"this\" {\n  kungfu {\n    instance_keys = [0, 1]\n  }\n}",
+		"instance_keys dupes":   "\"this\" {\n  kungfu {\n    instance_keys = [\"a\", \"a\"]\n  }\n}",
+	}
+
+	for name, patch := range tests {
+		t.Run(name, func(t *testing.T) {
+			content := "patch \"aws_s3_bucket\" " + patch
+			path := testutil.WriteTestFile(t, t.TempDir(), "test.kf.hcl", content)
+			if _, err := parser.ParseKungfuFile(path); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestParseKungfuFile_TerraformPatch(t *testing.T) {
+	config, _ := testutil.WriteAndParseKungfuFile(t, `patch "terraform" {
+  source           = "terraform-aws-modules/vpc/aws"
+  required_version = ">= 1.5, < 2.0"
+
+  required_providers {
+    aws = kf::merge({ version = ">= 5.0" })
+  }
+}`)
+
+	if len(config.Patches) != 1 {
+		t.Fatalf("expected 1 patch, got %d", len(config.Patches))
+	}
+	patch := config.Patches[0]
+	if patch.Kind != models.PatchTerraform || patch.Source != "terraform-aws-modules/vpc/aws" {
+		t.Errorf("unexpected patch: %+v", patch)
+	}
+	if _, ok := patch.Attributes["required_version"]; !ok {
+		t.Error("expected required_version to be patched")
+	}
+	aws := patch.Blocks["required_providers"].Attributes["aws"]
+	if aws == nil || aws.Strategy != models.StrategyMerge {
+		t.Errorf("expected aws requirement to be merged, got %+v", aws)
+	}
+}
+
+func TestParseKungfuFile_InvalidTerraformPatch(t *testing.T) {
+	tests := map[string]string{
+		"unsupported argument": `experiments = [module_variable_optional_attrs]`,
+		"unsupported block":    "backend \"s3\" {\n  }",
+		"version constraint":   `required_version = "latest"`,
+		"version strategy":     `required_version = kf::merge(">= 1.5")`,
+		"provider version":     "required_providers {\n    aws = { version = \"five\" }\n  }",
+		"provider argument":    "required_providers {\n    aws = { versions = \">= 5.0\" }\n  }",
+		"provider append":      "required_providers {\n    aws = kf::append([\">= 5.0\"])\n  }",
+	}
+
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			content := "patch \"terraform\" {\n  " + body + "\n}"
+			path := testutil.WriteTestFile(t, t.TempDir(), "test.kf.hcl", content)
+			if _, err := parser.ParseKungfuFile(path); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestParseKungfuFile_ProviderPatch(t *testing.T) {
+	config, _ := testutil.WriteAndParseKungfuFile(t, `patch "provider" "aws.replica" {
+  region = "eu-central-1"
+
+  assume_role {
+    role_arn = "arn:aws:iam::123456789012:role/replication"
+  }
+}`)
+
+	patch := config.Patches[0]
+	if patch.Kind != models.PatchProvider || patch.ProviderConfig != "aws.replica" {
+		t.Errorf("unexpected patch: %+v", patch)
+	}
+	if _, ok := patch.Blocks["assume_role"].Attributes["role_arn"]; !ok {
+		t.Error("expected assume_role.role_arn to be patched")
+	}
+}
+
+func TestParseKungfuFile_InvalidProviderPatch(t *testing.T) {
+	tests := map[string]string{
+		"address":         "patch \"provider\" \"aws.replica.extra\" {\n  region = \"eu-central-1\"\n}",
+		"alias":           "patch \"provider\" \"aws\" {\n  alias = \"east\"\n}",
+		"remove and set":  "patch \"provider\" \"aws\" {\n  remove = true\n  region = \"eu-central-1\"\n}",
+		"deep block":      "patch \"provider\" \"aws\" {\n  assume_role {\n    tags {\n    }\n  }\n}",
+		"alias reference": "patch \"terraform\" {\n  required_providers {\n    aws = { configuration_aliases = [aws] }\n  }\n}",
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := testutil.WriteTestFile(t, t.TempDir(), "test.kf.hcl", content)
+			if _, err := parser.ParseKungfuFile(path); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestParseKungfuFile_InvalidChecks(t *testing.T) {
+	tests := map[string]string{
+		"import": "patch \"import\" {\n  to = aws_s3_bucket.this\n  id = \"bucket\"\n}",
+		"missing error_message": "patch \"aws_s3_bucket\" \"this\" {\n  lifecycle {\n    precondition {\n" +
+			"      condition = true\n    }\n  }\n}",
+		"condition type": "patch \"check\" \"ok\" {\n  assert {\n    condition = \"yes\"\n" +
+			"    error_message = \"no\"\n  }\n}",
+		"strategy marker": "patch \"check\" \"ok\" {\n  assert {\n    condition = kf::append([true])\n" +
+			"    error_message = \"no\"\n  }\n}",
+		"check without assert": "patch \"check\" \"ok\" {\n  data \"aws_caller_identity\" \"current\" {\n  }\n}",
+		"two data blocks": "patch \"check\" \"ok\" {\n  data \"aws_caller_identity\" \"a\" {\n  }\n" +
+			"  data \"aws_caller_identity\" \"b\" {\n  }\n  assert {\n    condition = true\n" +
+			"    error_message = \"no\"\n  }\n}",
+		"removed from":         "patch \"removed\" {\n  from = aws_s3_bucket.this[0]\n}",
+		"removed without from": "patch \"removed\" {\n  lifecycle {\n    destroy = false\n  }\n}",
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := testutil.WriteTestFile(t, t.TempDir(), "test.kf.hcl", content)
+			if _, err := parser.ParseKungfuFile(path); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// ReservedVariantName is the name builds without a variant are recorded
+// under, so it cannot be declared as a variant.
+const ReservedVariantName = "default"
+
+// ParseProjectManifest parses a kungfu.hcl project manifest. It returns nil
+// without an error when the file does not exist.
+func ParseProjectManifest(path string) (*models.ProjectManifest, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	body, _, err := parseOverlayFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := parseProjectSettings(body)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &models.ProjectManifest{
+		Path:     path,
+		Settings: settings,
+		Variants: make(map[string]models.ProjectSettings),
+	}
+
+	for _, block := range body.Blocks {
+		if block.Type != "variant" {
+			return nil, fmt.Errorf("unsupported block %q in project manifest", block.Type)
+		}
+		if len(block.Labels) != 1 {
+			return nil, fmt.Errorf("variant block requires exactly 1 label (name), got %d", len(block.Labels))
+		}
+		name := block.Labels[0]
+		if !hclsyntax.ValidIdentifier(name) || name == ReservedVariantName {
+			return nil, fmt.Errorf("invalid variant name %q", name)
+		}
+		if _, exists := manifest.Variants[name]; exists {
+			return nil, fmt.Errorf("variant %q is declared more than once", name)
+		}
+		if len(block.Body.Blocks) != 0 {
+			return nil, fmt.Errorf("unsupported block %q in variant %s", block.Body.Blocks[0].Type, name)
+		}
+
+		variant, variantErr := parseProjectSettings(block.Body)
+		if variantErr != nil {
+			return nil, fmt.Errorf("invalid variant %s: %w", name, variantErr)
+		}
+		manifest.Variants[name] = variant
+		manifest.VariantNames = append(manifest.VariantNames, name)
+	}
+
+	return manifest, nil
+}
+
+func parseProjectSettings(body *hclsyntax.Body) (models.ProjectSettings, error) {
+	var settings models.ProjectSettings
+	for _, attr := range sortedAttributes(body) {
+		val, diags := attr.Expr.Value(nil)
+		if diags.HasErrors() {
+			return models.ProjectSettings{}, fmt.Errorf("failed to evaluate %s: %s", attr.Name, diags.Error())
+		}
+
+		var err error
+		switch attr.Name {
+		case "overlays":
+			settings.Overlays, err = stringList(val)
+		case "var_files":
+			settings.VarFiles, err = stringList(val)
+		case "output":
+			if val.IsNull() || val.Type() != cty.String || val.AsString() == "" {
+				err = errors.New("must be a non-empty string")
+			} else {
+				settings.Output = val.AsString()
+			}
+		case "strict":
+			if val.IsNull() || val.Type() != cty.Bool {
+				err = errors.New("must be a bool")
+			} else {
+				strict := val.True()
+				settings.Strict = &strict
+			}
+		case "vars":
+			if val.IsNull() || !(val.Type().IsObjectType() || val.Type().IsMapType()) {
+				err = errors.New("must be an object of variable values")
+			} else {
+				settings.Vars = val.AsValueMap()
+			}
+		default:
+			return models.ProjectSettings{}, fmt.Errorf("unsupported argument %q in project manifest", attr.Name)
+		}
+		if err != nil {
+			return models.ProjectSettings{}, fmt.Errorf("invalid %s: %w", attr.Name, err)
+		}
+	}
+	return settings, nil
+}
+
+func stringList(val cty.Value) ([]string, error) {
+	ty := val.Type()
+	if val.IsNull() || !(ty.IsListType() || ty.IsTupleType()) {
+		return nil, errors.New("must be a list of strings")
+	}
+
+	result := make([]string, 0, val.LengthInt())
+	for _, element := range val.AsValueSlice() {
+		if element.IsNull() || element.Type() != cty.String {
+			return nil, errors.New("must be a list of strings")
+		}
+		result = append(result, element.AsString())
+	}
+	return result, nil
+}
@@ -0,0 +1,138 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// providerPatchLabel is the first label of a patch block that patches the
+// provider blocks of a module, as in patch "provider" "aws" { ... }.
+const providerPatchLabel = "provider"
+
+// providerAlias returns the literal alias of a provider block, empty when it
+// has none.
+func providerAlias(block *hclwrite.Block) string {
+	attr := block.Body().GetAttribute("alias")
+	if attr == nil {
+		return ""
+	}
+	src := attr.Expr().BuildTokens(nil).Bytes()
+	expr, diags := hclsyntax.ParseExpression(src, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return ""
+	}
+	val, diags := expr.Value(nil)
+	if diags.HasErrors() || val.IsNull() || !val.IsKnown() || val.Type() != cty.String {
+		return ""
+	}
+	return val.AsString()
+}
+
+func parseProviderPatch(block *hclsyntax.Block, src []byte, ctx *hcl.EvalContext) (models.Patch, error) {
+	patch := models.Patch{
+		Kind:           models.PatchProvider,
+		ProviderConfig: block.Labels[1],
+		Attributes:     make(map[string]*models.PatchAttribute),
+		Blocks:         make(map[string]*models.PatchBlock),
+		Range:          block.Range(),
+	}
+	if err := validateProviderAddress(patch.ProviderConfig); err != nil {
+		return models.Patch{}, err
+	}
+
+	if err := parseKungfuBlocks(block.Body, &patch, false, ctx); err != nil {
+		return models.Patch{}, err
+	}
+
+	for _, nested := range block.Body.Blocks {
+		if nested.Type == kungfuBlockType {
+			continue
+		}
+		if _, exists := patch.Blocks[nested.Type]; exists {
+			return models.Patch{}, fmt.Errorf("duplicate %s block in provider patch", nested.Type)
+		}
+		patchBlock, err := parseProviderBlock(nested, src, ctx)
+		if err != nil {
+			return models.Patch{}, err
+		}
+		patch.Blocks[nested.Type] = patchBlock
+	}
+
+	for order, attr := range sortedAttributes(block.Body) {
+		handled, err := parseCommonArgument(attr, &patch, ctx)
+		if err != nil {
+			return models.Patch{}, err
+		}
+		if handled {
+			continue
+		}
+
+		switch attr.Name {
+		case "remove":
+			val, diags := attr.Expr.Value(ctx)
+			if diags.HasErrors() || val.IsNull() || !val.IsKnown() || val.Type() != cty.Bool {
+				return models.Patch{}, errors.New("remove attribute must be true or false")
+			}
+			patch.Remove = val.True()
+			continue
+		case "alias":
+			return models.Patch{}, errors.New("the alias of a provider block cannot be patched")
+		}
+
+		patchAttr, err := parsePatchAttribute(attr, order, nil, src, ctx)
+		if err != nil {
+			return models.Patch{}, err
+		}
+		patch.Attributes[attr.Name] = patchAttr
+	}
+
+	if patch.Remove && (len(patch.Attributes) > 0 || len(patch.Blocks) > 0) {
+		return models.Patch{}, errors.New("a provider patch that removes provider blocks cannot also patch them")
+	}
+	return patch, nil
+}
+
+// validateProviderAddress checks a provider patch label: a provider name and
+// an optional alias, either of which may be a glob pattern.
+func validateProviderAddress(address string) error {
+	parts := strings.Split(address, ".")
+	if len(parts) > 2 {
+		return fmt.Errorf("invalid provider %q: expected a name such as aws or aws.us_east_1", address)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return fmt.Errorf("invalid provider %q: expected a name such as aws or aws.us_east_1", address)
+		}
+	}
+	return validateGlobs(parts...)
+}
+
+// parseProviderBlock parses a block nested in a provider patch, such as
+// assume_role or default_tags. The block is created when the provider block
+// does not have it.
+func parseProviderBlock(block *hclsyntax.Block, src []byte, ctx *hcl.EvalContext) (*models.PatchBlock, error) {
+	if len(block.Labels) != 0 {
+		return nil, fmt.Errorf("%s block does not take labels", block.Type)
+	}
+	if len(block.Body.Blocks) != 0 {
+		return nil, fmt.Errorf("unsupported block %q in %s; only one level of nested blocks can be patched",
+			block.Body.Blocks[0].Type, block.Type)
+	}
+
+	patchBlock := &models.PatchBlock{Attributes: make(map[string]*models.PatchAttribute)}
+	for order, attr := range sortedAttributes(block.Body) {
+		patchAttr, err := parsePatchAttribute(attr, order, nil, src, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", block.Type, err)
+		}
+		patchBlock.Attributes[attr.Name] = patchAttr
+	}
+	return patchBlock, nil
+}
@@ -0,0 +1,362 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// validateStrategyValue checks that the value of a list or map strategy has
+// the shape the strategy needs. Values that cannot be evaluated yet, such as
+// lists of references, are checked when they are applied.
+func validateStrategyValue(
+	patchAttr *models.PatchAttribute,
+	expr hclsyntax.Expression,
+	src []byte,
+	val cty.Value,
+	verbatim bool,
+) error {
+	strategy := patchAttr.Strategy
+	switch strategy {
+	case models.StrategyAppend, models.StrategyPrepend, models.StrategyRemove, models.StrategyUnion:
+		if verbatim {
+			return nil
+		}
+		ty := val.Type()
+		if val.IsNull() || !(ty.IsTupleType() || ty.IsListType() || ty.IsSetType()) {
+			return fmt.Errorf("%s%s takes a list", StrategyNamespace, strategy)
+		}
+		return nil
+	case models.StrategyMerge, models.StrategyShallowMerge, models.StrategyDefaults:
+		if verbatim {
+			return nil
+		}
+		ty := val.Type()
+		if val.IsNull() || !(ty.IsObjectType() || ty.IsMapType()) {
+			return fmt.Errorf("%s%s takes an object", StrategyNamespace, strategy)
+		}
+		return nil
+	case models.StrategyDeleteKeys:
+		ty := val.Type()
+		isList := ty.IsTupleType() || ty.IsListType() || ty.IsSetType()
+		if verbatim || val.IsNull() || !isList || !val.IsWhollyKnown() || val.LengthInt() == 0 {
+			return fmt.Errorf("%sdelete_keys takes a list of key names", StrategyNamespace)
+		}
+		for _, key := range val.AsValueSlice() {
+			if key.IsNull() || key.Type() != cty.String {
+				return fmt.Errorf("%sdelete_keys takes a list of key names", StrategyNamespace)
+			}
+		}
+		return nil
+	case models.StrategyPrefix, models.StrategySuffix, models.StrategyRegexReplace:
+		if verbatim && strategy != models.StrategyRegexReplace {
+			return nil
+		}
+		if verbatim || val.IsNull() || val.Type() != cty.String {
+			return fmt.Errorf("%s%s takes a string", StrategyNamespace, strategy)
+		}
+		return nil
+	case models.StrategyMergeBy:
+		return validateMergeByValue(patchAttr.MergeKey, expr, src, val, verbatim)
+	case models.StrategyIndex:
+		obj, ok := expr.(*hclsyntax.ObjectConsExpr)
+		if !ok || len(obj.Items) == 0 {
+			return fmt.Errorf("%sat takes an object of list indexes and values, such as { 0 = \"value\" }",
+				StrategyNamespace)
+		}
+		seen := make(map[int]bool, len(obj.Items))
+		for _, item := range obj.Items {
+			index, err := listIndex(item.KeyExpr)
+			if err != nil {
+				return err
+			}
+			if seen[index] {
+				return fmt.Errorf("duplicate list index %d", index)
+			}
+			seen[index] = true
+		}
+		return nil
+	default:
+		return nil
+	}
+}
+
+// listIndex returns the list index an object key of a kf::at value names.
+func listIndex(expr hclsyntax.Expression) (int, error) {
+	name, ok := objectKeyName(expr)
+	if !ok {
+		val, diags := expr.Value(nil)
+		if diags.HasErrors() || val.IsNull() || !val.IsKnown() {
+			return 0, errors.New("list indexes must be literal numbers")
+		}
+		str, err := convert.Convert(val, cty.String)
+		if err != nil {
+			return 0, errors.New("list indexes must be literal numbers")
+		}
+		name = str.AsString()
+	}
+
+	index, err := strconv.Atoi(name)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("invalid list index %q: must be a whole number of zero or more", name)
+	}
+	return index, nil
+}
+
+// parseMarkerArgument reads the first argument of a marker from
+// twoArgumentMarkers: the key of kf::merge_by or the pattern of
+// kf::regex_replace.
+func parseMarkerArgument(patchAttr *models.PatchAttribute, call *hclsyntax.FunctionCallExpr) error {
+	if patchAttr.Strategy == models.StrategyRegexReplace {
+		val, diags := call.Args[0].Value(nil)
+		if diags.HasErrors() || val.IsNull() || !val.IsKnown() || val.Type() != cty.String {
+			return fmt.Errorf("the pattern of %sregex_replace must be a literal string", StrategyNamespace)
+		}
+		if _, err := regexp.Compile(val.AsString()); err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+		patchAttr.Pattern = val.AsString()
+		return nil
+	}
+
+	name, ok := objectKeyName(call.Args[0])
+	if !ok || name == "" {
+		return fmt.Errorf("the first argument of %smerge_by must be a key name such as \"name\"", StrategyNamespace)
+	}
+	patchAttr.MergeKey = name
+	return nil
+}
+
+// validateMergeByValue checks that the value of kf::merge_by is a list of
+// objects that all set the key.
+func validateMergeByValue(key string, expr hclsyntax.Expression, src []byte, val cty.Value, verbatim bool) error {
+	seen := make(map[string]bool)
+	if verbatim {
+		tuple, ok := expr.(*hclsyntax.TupleConsExpr)
+		if !ok {
+			return fmt.Errorf("%smerge_by takes a list of objects", StrategyNamespace)
+		}
+		for i, element := range tuple.Exprs {
+			obj, ok := element.(*hclsyntax.ObjectConsExpr)
+			if !ok {
+				return fmt.Errorf("%smerge_by takes a list of objects", StrategyNamespace)
+			}
+			if containsNestedMarker(obj) {
+				return fmt.Errorf("strategies cannot be nested in %smerge_by", StrategyNamespace)
+			}
+			keySource := ""
+			for _, item := range obj.Items {
+				if name, ok := objectKeyName(item.KeyExpr); ok && name == key {
+					keySource = strings.Join(strings.Fields(string(item.ValueExpr.Range().SliceBytes(src))), "")
+				}
+			}
+			if keySource == "" {
+				return fmt.Errorf("element %d does not set the merge key %q", i, key)
+			}
+			if seen[keySource] {
+				return fmt.Errorf("element %d repeats the merge key %s", i, keySource)
+			}
+			seen[keySource] = true
+		}
+		return nil
+	}
+
+	ty := val.Type()
+	if val.IsNull() || !(ty.IsTupleType() || ty.IsListType()) {
+		return fmt.Errorf("%smerge_by takes a list of objects", StrategyNamespace)
+	}
+	for i, element := range val.AsValueSlice() {
+		elementType := element.Type()
+		if element.IsNull() || !(elementType.IsObjectType() || elementType.IsMapType()) {
+			return fmt.Errorf("%smerge_by takes a list of objects", StrategyNamespace)
+		}
+		keyVal, exists := element.AsValueMap()[key]
+		if !exists || keyVal.IsNull() || !keyVal.Type().IsPrimitiveType() {
+			return fmt.Errorf("element %d does not set the merge key %q", i, key)
+		}
+		keySource := string(hclwrite.TokensForValue(keyVal).Bytes())
+		if seen[keySource] {
+			return fmt.Errorf("element %d repeats the merge key %s", i, keySource)
+		}
+		seen[keySource] = true
+	}
+	return nil
+}
+
+func referencesOriginal(expr hclsyntax.Expression) bool {
+	for _, traversal := range expr.Variables() {
+		if traversal.RootName() == models.OriginalVariable {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTemplate parses a value that refers to original. The overlay values it
+// refers to, such as locals, are written into it as literals, so that it can
+// be evaluated against the module's value when the patch is applied.
+func parseTemplate(
+	patchAttr *models.PatchAttribute,
+	isMeta bool,
+	expr hclsyntax.Expression,
+	src []byte,
+	ctx *hcl.EvalContext,
+) error {
+	switch {
+	case isMeta:
+		return fmt.Errorf("meta-arguments cannot refer to %s", models.OriginalVariable)
+	case patchAttr.Strategy != models.StrategyReplace:
+		return fmt.Errorf("only replaced values can refer to %s, not %s%s", models.OriginalVariable,
+			StrategyNamespace, patchAttr.Strategy)
+	case referencesModuleCall(expr):
+		return fmt.Errorf("a value that refers to %s cannot also refer to the module call", models.OriginalVariable)
+	}
+
+	bound := bindOverlayValues(expr, src, ctx, models.OriginalVariable)
+	boundExpr, diags := hclsyntax.ParseExpression(bound, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return fmt.Errorf("failed to bind overlay values: %s", diags.Error())
+	}
+	patchAttr.Strategy = models.StrategyTemplate
+	patchAttr.Value = expressionTokens(boundExpr, bound)
+	patchAttr.Functions = Functions()
+	if ctx != nil && ctx.Functions != nil {
+		patchAttr.Functions = ctx.Functions
+	}
+	return nil
+}
+
+// bindOverlayValues returns the source of expr with the references ctx can
+// evaluate, such as overlay variables and locals, written as literals. The
+// references to the skipped root names, and any others kungfu cannot
+// evaluate, are left for Terraform.
+func bindOverlayValues(expr hclsyntax.Expression, src []byte, ctx *hcl.EvalContext, skip ...string) []byte {
+	skipped := make(map[string]bool, len(skip))
+	for _, name := range skip {
+		skipped[name] = true
+	}
+
+	exprRange := expr.Range()
+	var edits []models.SourceEdit
+	for _, traversal := range expr.Variables() {
+		if skipped[traversal.RootName()] {
+			continue
+		}
+		val, diags := traversal.TraverseAbs(ctx)
+		if diags.HasErrors() || !val.IsWhollyKnown() {
+			continue
+		}
+		traversalRange := traversal.SourceRange()
+		edits = append(edits, models.SourceEdit{
+			Start: traversalRange.Start.Byte,
+			End:   traversalRange.End.Byte,
+			Text:  hclwrite.TokensForValue(val).Bytes(),
+		})
+	}
+	return models.ApplySourceEdits(src, exprRange.Start.Byte, exprRange.End.Byte, edits)
+}
+
+// containsNestedMarker reports whether an object literal has a strategy
+// marker as the value of one of its keys, at any depth, as in
+// { Statement = kf::append([...]) }.
+func containsNestedMarker(expr hclsyntax.Expression) bool {
+	obj, ok := expr.(*hclsyntax.ObjectConsExpr)
+	if !ok {
+		return false
+	}
+	for _, item := range obj.Items {
+		if isNamespacedMarker(item.ValueExpr) || containsNestedMarker(item.ValueExpr) {
+			return true
+		}
+	}
+	return false
+}
+
+func isNamespacedMarker(expr hclsyntax.Expression) bool {
+	call, ok := expr.(*hclsyntax.FunctionCallExpr)
+	return ok && strings.HasPrefix(call.Name, StrategyNamespace)
+}
+
+// parseNestedMarkers parses a merge patch whose object has strategy markers
+// nested in it. The markers are checked, and the object is kept as source with
+// overlay values bound, so that each marker is applied to the key it is
+// nested under when the patch is applied.
+func parseNestedMarkers(
+	patchAttr *models.PatchAttribute,
+	isMeta bool,
+	expr hclsyntax.Expression,
+	src []byte,
+	ctx *hcl.EvalContext,
+) error {
+	switch patchAttr.Strategy {
+	case models.StrategyMerge, models.StrategyShallowMerge, models.StrategyDefaults:
+	default:
+		return fmt.Errorf("strategies can only be nested in %smerge, %sshallow_merge and %sdefaults",
+			StrategyNamespace, StrategyNamespace, StrategyNamespace)
+	}
+	if isMeta || referencesModuleCall(expr) {
+		return errors.New("nested strategies cannot be used for meta-arguments or refer to the module call")
+	}
+
+	bound := bindOverlayValues(expr, src, ctx)
+	boundExpr, diags := hclsyntax.ParseExpression(bound, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return fmt.Errorf("failed to bind overlay values: %s", diags.Error())
+	}
+	nested, err := parseMarkerObject(boundExpr.(*hclsyntax.ObjectConsExpr), bound)
+	if err != nil {
+		return err
+	}
+	patchAttr.Value = expressionTokens(boundExpr, bound)
+	patchAttr.Nested = nested
+	return nil
+}
+
+// parseMarkerObject parses the strategy markers nested in obj, at any depth,
+// by the key they are nested under.
+func parseMarkerObject(obj *hclsyntax.ObjectConsExpr, src []byte) (map[string]*models.NestedMarker, error) {
+	markers := make(map[string]*models.NestedMarker)
+	for _, item := range obj.Items {
+		key, _ := objectKeyName(item.KeyExpr)
+		if nested, isObject := item.ValueExpr.(*hclsyntax.ObjectConsExpr); isObject {
+			object, err := parseMarkerObject(nested, src)
+			if err != nil {
+				return nil, err
+			}
+			if len(object) > 0 {
+				markers[key] = &models.NestedMarker{Object: object}
+			}
+			continue
+		}
+		if !isNamespacedMarker(item.ValueExpr) {
+			continue
+		}
+		marker, err := parseNestedMarker(key, item.ValueExpr.Range().SliceBytes(src))
+		if err != nil {
+			return nil, err
+		}
+		markers[key] = &models.NestedMarker{Attribute: marker}
+	}
+	return markers, nil
+}
+
+// parseNestedMarker parses the source of a strategy marker nested in a merge
+// patch under the key name, such as kf::append([...]) in
+// { Statement = kf::append([...]) }.
+func parseNestedMarker(name string, src []byte) (*models.PatchAttribute, error) {
+	expr, diags := hclsyntax.ParseExpression(src, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("invalid value for %s: %s", name, diags.Error())
+	}
+	attr := &hclsyntax.Attribute{Name: name, Expr: expr, SrcRange: expr.Range()}
+	return parsePatchAttribute(attr, 0, nil, src, NewEvalContext(nil))
+}
@@ -0,0 +1,90 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// parsePatchTarget fills the resource selector of patch from either the two
+// block labels or a nested target block.
+func parsePatchTarget(block *hclsyntax.Block, patch *models.Patch, ctx *hcl.EvalContext) error {
+	var targetBlock *hclsyntax.Block
+	for _, nested := range block.Body.Blocks {
+		if nested.Type != "target" {
+			continue
+		}
+		if targetBlock != nil {
+			return errors.New("patch block may contain at most one target block")
+		}
+		targetBlock = nested
+	}
+
+	switch {
+	case targetBlock != nil && len(block.Labels) > 0:
+		return errors.New("patch block must use either labels or a target block, not both")
+	case targetBlock != nil:
+		return parseTargetBlock(targetBlock, patch, ctx)
+	case len(block.Labels) != expectedPatchLabels:
+		return fmt.Errorf(
+			"patch block requires exactly %d labels (type and name) or a target block, got %d labels",
+			expectedPatchLabels, len(block.Labels))
+	}
+
+	patch.ResourceType = block.Labels[0]
+	patch.ResourceName = block.Labels[1]
+	return validateGlobs(patch.ResourceType, patch.ResourceName)
+}
+
+func parseTargetBlock(block *hclsyntax.Block, patch *models.Patch, ctx *hcl.EvalContext) error {
+	if len(block.Labels) != 0 {
+		return errors.New("target block does not take labels")
+	}
+	if len(block.Body.Blocks) != 0 {
+		return errors.New("target block does not support nested blocks")
+	}
+
+	for name, attr := range block.Body.Attributes {
+		val, diags := attr.Expr.Value(ctx)
+		if diags.HasErrors() {
+			return fmt.Errorf("failed to evaluate target %s: %s", name, diags.Error())
+		}
+		if val.IsNull() || val.Type() != cty.String {
+			return fmt.Errorf("target %s must be a string", name)
+		}
+
+		switch name {
+		case "type":
+			patch.ResourceType = val.AsString()
+		case "name":
+			patch.ResourceName = val.AsString()
+		case "provider":
+			patch.Provider = val.AsString()
+		case "name_regex":
+			re, err := regexp.Compile(val.AsString())
+			if err != nil {
+				return fmt.Errorf("invalid target name_regex: %w", err)
+			}
+			patch.NameRegex = re
+		default:
+			return fmt.Errorf("unsupported target attribute %q", name)
+		}
+	}
+
+	return validateGlobs(patch.ResourceType, patch.ResourceName)
+}
+
+func validateGlobs(patterns ...string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
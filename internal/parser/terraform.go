@@ -0,0 +1,209 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// terraformPatchLabel is the single label of a patch block that patches the
+// terraform block of a module, as in patch "terraform" { ... }.
+const terraformPatchLabel = "terraform"
+
+// versionConstraintPattern matches a single version constraint such as
+// ">= 5.0" or "~> 1.5.0".
+var versionConstraintPattern = regexp.MustCompile(
+	`^\s*(=|!=|>|>=|<|<=|~>)?\s*v?[0-9]+(\.[0-9]+){0,2}(-[0-9A-Za-z.-]+)?\s*$`)
+
+func parseTerraformPatch(block *hclsyntax.Block, src []byte, ctx *hcl.EvalContext) (models.Patch, error) {
+	patch := models.Patch{
+		Kind:       models.PatchTerraform,
+		Attributes: make(map[string]*models.PatchAttribute),
+		Blocks:     make(map[string]*models.PatchBlock),
+		Range:      block.Range(),
+	}
+
+	if err := parseKungfuBlocks(block.Body, &patch, false, ctx); err != nil {
+		return models.Patch{}, err
+	}
+
+	for _, nested := range block.Body.Blocks {
+		if nested.Type == kungfuBlockType {
+			continue
+		}
+		if nested.Type != "required_providers" {
+			return models.Patch{}, fmt.Errorf(
+				"unsupported block %q in terraform patch; only required_providers can be patched", nested.Type)
+		}
+		if _, exists := patch.Blocks[nested.Type]; exists {
+			return models.Patch{}, fmt.Errorf("duplicate %s block in terraform patch", nested.Type)
+		}
+		patchBlock, err := parseRequiredProviders(nested, src, ctx)
+		if err != nil {
+			return models.Patch{}, err
+		}
+		patch.Blocks[nested.Type] = patchBlock
+	}
+
+	arguments := terraformArguments()
+	for order, attr := range sortedAttributes(block.Body) {
+		handled, err := parseCommonArgument(attr, &patch, ctx)
+		if err != nil {
+			return models.Patch{}, err
+		}
+		if handled {
+			continue
+		}
+		if _, known := arguments[attr.Name]; !known {
+			return models.Patch{}, fmt.Errorf(
+				"unsupported argument %q in terraform patch; only required_version and required_providers can be patched",
+				attr.Name)
+		}
+		patchAttr, err := parsePatchAttribute(attr, order, arguments, src, ctx)
+		if err != nil {
+			return models.Patch{}, err
+		}
+		patch.Attributes[attr.Name] = patchAttr
+	}
+
+	return patch, nil
+}
+
+// terraformArguments returns the arguments that can be patched in a terraform
+// block.
+func terraformArguments() map[string]metaArgument {
+	return map[string]metaArgument{
+		"required_version": {
+			strategies: []models.MergeStrategy{models.StrategyReplace},
+			validate:   validateVersionConstraint,
+		},
+	}
+}
+
+func parseRequiredProviders(block *hclsyntax.Block, src []byte, ctx *hcl.EvalContext) (*models.PatchBlock, error) {
+	if len(block.Labels) != 0 {
+		return nil, errors.New("required_providers block does not take labels")
+	}
+	if len(block.Body.Blocks) != 0 {
+		return nil, fmt.Errorf("unsupported block %q in required_providers", block.Body.Blocks[0].Type)
+	}
+
+	requirement := metaArgument{
+		strategies: []models.MergeStrategy{models.StrategyReplace, models.StrategyMerge},
+		validate:   validateProviderRequirement,
+	}
+	patchBlock := &models.PatchBlock{Attributes: make(map[string]*models.PatchAttribute)}
+	for order, attr := range sortedAttributes(block.Body) {
+		arguments := map[string]metaArgument{attr.Name: requirement}
+		patchAttr, err := parsePatchAttribute(attr, order, arguments, src, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("required_providers: %w", err)
+		}
+		patchBlock.Attributes[attr.Name] = patchAttr
+	}
+	return patchBlock, nil
+}
+
+// validateVersionConstraint accepts a string of comma-separated version
+// constraints.
+func validateVersionConstraint(expr hclsyntax.Expression, _ []byte, ctx *hcl.EvalContext) (interface{}, error) {
+	val, diags := expr.Value(ctx)
+	if diags.HasErrors() || val.IsNull() || !val.IsKnown() || val.Type() != cty.String {
+		return nil, errors.New("must be a version constraint string")
+	}
+	if err := checkVersionConstraint(val.AsString()); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+func checkVersionConstraint(constraint string) error {
+	for _, part := range strings.Split(constraint, ",") {
+		if !versionConstraintPattern.MatchString(part) {
+			return fmt.Errorf("%q is not a valid version constraint", constraint)
+		}
+	}
+	return nil
+}
+
+// validateProviderRequirement accepts a provider requirement: an object with
+// source, version and configuration_aliases, or a version constraint string.
+// Requirements with configuration aliases are kept verbatim, since the aliases
+// are provider references.
+func validateProviderRequirement(expr hclsyntax.Expression, src []byte, ctx *hcl.EvalContext) (interface{}, error) {
+	obj, isObject := expr.(*hclsyntax.ObjectConsExpr)
+	if !isObject {
+		val, diags := expr.Value(ctx)
+		if diags.HasErrors() || val.IsNull() || !val.IsKnown() || val.Type() != cty.String {
+			return nil, errors.New("must be an object with source and version, or a version constraint string")
+		}
+		return validateVersionConstraint(expr, src, ctx)
+	}
+
+	verbatim := false
+	for _, item := range obj.Items {
+		name, ok := objectKeyName(item.KeyExpr)
+		if !ok {
+			return nil, errors.New("provider requirement keys must be names")
+		}
+		switch name {
+		case "source":
+			val, diags := item.ValueExpr.Value(ctx)
+			if diags.HasErrors() || val.IsNull() || !val.IsKnown() || val.Type() != cty.String {
+				return nil, errors.New("provider requirement source must be a string")
+			}
+		case "version":
+			if _, err := validateVersionConstraint(item.ValueExpr, src, ctx); err != nil {
+				return nil, fmt.Errorf("provider requirement version %w", err)
+			}
+		case "configuration_aliases":
+			validate := validateReferenceList(validateProviderAlias)
+			if _, err := validate(item.ValueExpr, src, ctx); err != nil {
+				return nil, fmt.Errorf("provider requirement configuration_aliases: %w", err)
+			}
+			verbatim = true
+		default:
+			return nil, fmt.Errorf("unsupported provider requirement argument %q", name)
+		}
+	}
+
+	if verbatim {
+		return expressionTokens(expr, src), nil
+	}
+	val, diags := expr.Value(ctx)
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("failed to evaluate provider requirement: %s", diags.Error())
+	}
+	return val, nil
+}
+
+// validateProviderAlias accepts a reference to an aliased provider
+// configuration, such as aws.us_east_1.
+func validateProviderAlias(traversal hcl.Traversal) error {
+	if len(traversal) != 2 {
+		return errors.New("must refer to a provider alias such as aws.us_east_1")
+	}
+	if _, ok := traversal[1].(hcl.TraverseAttr); !ok {
+		return errors.New("must refer to a provider alias such as aws.us_east_1")
+	}
+	return nil
+}
+
+// objectKeyName returns the literal name of an object key, whether it is
+// written as a bare identifier or a quoted string.
+func objectKeyName(expr hclsyntax.Expression) (string, bool) {
+	if keyword := hcl.ExprAsKeyword(expr); keyword != "" {
+		return keyword, true
+	}
+	val, diags := expr.Value(nil)
+	if diags.HasErrors() || val.IsNull() || !val.IsKnown() || val.Type() != cty.String {
+		return "", false
+	}
+	return val.AsString(), true
+}
@@ -0,0 +1,303 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/typeexpr"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// VariableEnvPrefix is the prefix of environment variables that set overlay
+// variables, e.g. KUNGFU_VAR_size for var.size.
+const VariableEnvPrefix = "KUNGFU_VAR_"
+
+// VariableInputs holds the values supplied for overlay variables from outside
+// the overlay files.
+type VariableInputs struct {
+	// Vars are name=value assignments, as given with --var.
+	Vars []string
+	// VarFiles are paths to HCL files of name = value assignments.
+	VarFiles []string
+	// Environ is the process environment, in os.Environ form.
+	Environ []string
+	// ProjectVarFiles and ProjectVars are the var files and values declared
+	// in the project manifest.
+	ProjectVarFiles []string
+	ProjectVars     map[string]cty.Value
+}
+
+// ParseVariableDeclarations returns the variable blocks declared in an overlay file.
+func ParseVariableDeclarations(path string) ([]models.OverlayVariable, error) {
+	body, _, err := parseOverlayFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var variables []models.OverlayVariable
+	for _, block := range body.Blocks {
+		if block.Type != "variable" {
+			continue
+		}
+		variable, varErr := parseVariableBlock(block)
+		if varErr != nil {
+			return nil, fmt.Errorf("failed to parse variable block: %w", varErr)
+		}
+		variables = append(variables, variable)
+	}
+	return variables, nil
+}
+
+func parseVariableBlock(block *hclsyntax.Block) (models.OverlayVariable, error) {
+	if len(block.Labels) != 1 {
+		return models.OverlayVariable{}, fmt.Errorf(
+			"variable block requires exactly 1 label (name), got %d", len(block.Labels))
+	}
+
+	variable := models.OverlayVariable{
+		Name:    block.Labels[0],
+		Type:    cty.DynamicPseudoType,
+		Default: cty.NilVal,
+		Range:   block.Range(),
+	}
+	if !hclsyntax.ValidIdentifier(variable.Name) {
+		return models.OverlayVariable{}, fmt.Errorf("invalid variable name %q", variable.Name)
+	}
+
+	if attr, exists := block.Body.Attributes["type"]; exists {
+		ty, diags := typeexpr.TypeConstraint(attr.Expr)
+		if diags.HasErrors() {
+			return models.OverlayVariable{}, fmt.Errorf("invalid type for variable %s: %s", variable.Name, diags.Error())
+		}
+		variable.Type = ty
+	}
+
+	if attr, exists := block.Body.Attributes["description"]; exists {
+		val, diags := attr.Expr.Value(nil)
+		if diags.HasErrors() || val.IsNull() || val.Type() != cty.String {
+			return models.OverlayVariable{}, fmt.Errorf("description of variable %s must be a string", variable.Name)
+		}
+		variable.Description = val.AsString()
+	}
+
+	if attr, exists := block.Body.Attributes["default"]; exists {
+		val, diags := attr.Expr.Value(nil)
+		if diags.HasErrors() {
+			return models.OverlayVariable{}, fmt.Errorf(
+				"failed to evaluate default for variable %s: %s", variable.Name, diags.Error())
+		}
+		converted, err := convert.Convert(val, variable.Type)
+		if err != nil {
+			return models.OverlayVariable{}, fmt.Errorf("invalid default for variable %s: %w", variable.Name, err)
+		}
+		variable.Default = converted
+	}
+
+	for name := range block.Body.Attributes {
+		switch name {
+		case "type", "description", "default":
+		default:
+			return models.OverlayVariable{}, fmt.Errorf("unsupported argument %q in variable %s", name, variable.Name)
+		}
+	}
+
+	return variable, nil
+}
+
+// ResolveVariables computes the value of every declared variable. Values are
+// taken, from lowest to highest precedence, from defaults, KUNGFU_VAR_*
+// environment variables, project var files, project vars, var files in order,
+// and --var assignments in order.
+func ResolveVariables(declarations []models.OverlayVariable, inputs VariableInputs) (map[string]cty.Value, error) {
+	declared := make(map[string]models.OverlayVariable, len(declarations))
+	values := make(map[string]cty.Value, len(declarations))
+	for _, variable := range declarations {
+		if previous, exists := declared[variable.Name]; exists {
+			return nil, fmt.Errorf("variable %s is declared more than once (%s and %s)",
+				variable.Name, previous.Range.Filename, variable.Range.Filename)
+		}
+		declared[variable.Name] = variable
+		if variable.Default != cty.NilVal {
+			values[variable.Name] = variable.Default
+		}
+	}
+
+	if err := applyEnvironmentValues(declared, values, inputs.Environ); err != nil {
+		return nil, err
+	}
+	for _, varFile := range inputs.ProjectVarFiles {
+		if err := applyVarFile(declared, values, varFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyProjectValues(declared, values, inputs.ProjectVars); err != nil {
+		return nil, err
+	}
+	for _, varFile := range inputs.VarFiles {
+		if err := applyVarFile(declared, values, varFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, assignment := range inputs.Vars {
+		if err := applyVarAssignment(declared, values, assignment); err != nil {
+			return nil, err
+		}
+	}
+
+	var missing []string
+	for name := range declared {
+		if _, exists := values[name]; !exists {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("no value for required variable(s): %s", strings.Join(missing, ", "))
+	}
+
+	return values, nil
+}
+
+func applyEnvironmentValues(
+	declared map[string]models.OverlayVariable,
+	values map[string]cty.Value,
+	environ []string,
+) error {
+	for _, entry := range environ {
+		if !strings.HasPrefix(entry, VariableEnvPrefix) {
+			continue
+		}
+		name, raw, found := strings.Cut(strings.TrimPrefix(entry, VariableEnvPrefix), "=")
+		variable, exists := declared[name]
+		if !found || !exists {
+			continue
+		}
+
+		val, err := parseRawValue(variable, raw)
+		if err != nil {
+			return fmt.Errorf("invalid value for variable %s from %s%s: %w", name, VariableEnvPrefix, name, err)
+		}
+		values[name] = val
+	}
+	return nil
+}
+
+func applyVarFile(declared map[string]models.OverlayVariable, values map[string]cty.Value, path string) error {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read var file: %w", err)
+	}
+
+	file, diags := hclparse.NewParser().ParseHCL(src, path)
+	if diags.HasErrors() {
+		return fmt.Errorf("failed to parse var file %s: %s", path, diags.Error())
+	}
+
+	attrs, diags := file.Body.JustAttributes()
+	if diags.HasErrors() {
+		return fmt.Errorf("var file %s may only contain assignments: %s", path, diags.Error())
+	}
+
+	for name, attr := range attrs {
+		variable, exists := declared[name]
+		if !exists {
+			continue
+		}
+
+		val, valDiags := attr.Expr.Value(nil)
+		if valDiags.HasErrors() {
+			return fmt.Errorf("failed to evaluate %s in var file %s: %s", name, path, valDiags.Error())
+		}
+		converted, convErr := convert.Convert(val, variable.Type)
+		if convErr != nil {
+			return fmt.Errorf("invalid value for variable %s in var file %s: %w", name, path, convErr)
+		}
+		values[name] = converted
+	}
+	return nil
+}
+
+func applyProjectValues(
+	declared map[string]models.OverlayVariable,
+	values map[string]cty.Value,
+	projectVars map[string]cty.Value,
+) error {
+	for name, val := range projectVars {
+		variable, exists := declared[name]
+		if !exists {
+			continue
+		}
+		converted, err := convert.Convert(val, variable.Type)
+		if err != nil {
+			return fmt.Errorf("invalid value for variable %s in project manifest: %w", name, err)
+		}
+		values[name] = converted
+	}
+	return nil
+}
+
+func applyVarAssignment(declared map[string]models.OverlayVariable, values map[string]cty.Value, assignment string) error {
+	name, raw, found := strings.Cut(assignment, "=")
+	if !found || name == "" {
+		return fmt.Errorf("invalid --var %q, expected name=value", assignment)
+	}
+
+	variable, exists := declared[name]
+	if !exists {
+		return fmt.Errorf("--var %s refers to an undeclared variable", name)
+	}
+
+	val, err := parseRawValue(variable, raw)
+	if err != nil {
+		return fmt.Errorf("invalid value for variable %s: %w", name, err)
+	}
+	values[name] = val
+	return nil
+}
+
+// parseRawValue converts a value given on the command line or in the
+// environment. Untyped and string variables take the raw string; other types
+// parse the value as an HCL expression.
+func parseRawValue(variable models.OverlayVariable, raw string) (cty.Value, error) {
+	if variable.Type == cty.DynamicPseudoType || variable.Type == cty.String {
+		return cty.StringVal(raw), nil
+	}
+
+	expr, diags := hclsyntax.ParseExpression([]byte(raw), variable.Name, hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		return cty.NilVal, errors.New(diags.Error())
+	}
+	val, diags := expr.Value(nil)
+	if diags.HasErrors() {
+		return cty.NilVal, errors.New(diags.Error())
+	}
+
+	converted, err := convert.Convert(val, variable.Type)
+	if err != nil {
+		return cty.NilVal, fmt.Errorf("expected %s: %w", typeexpr.TypeString(variable.Type), err)
+	}
+	return converted, nil
+}
+
+// NewEvalContext returns the evaluation context for overlay expressions,
+// exposing variable values as var.<name> and the overlay function library.
+func NewEvalContext(variables map[string]cty.Value) *hcl.EvalContext {
+	varObject := cty.EmptyObjectVal
+	if len(variables) > 0 {
+		varObject = cty.ObjectVal(variables)
+	}
+	return &hcl.EvalContext{
+		Variables: map[string]cty.Value{
+			"var": varObject,
+		},
+		Functions: Functions(),
+	}
+}
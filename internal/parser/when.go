@@ -0,0 +1,178 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// ModuleEvalContext returns a child of ctx that describes a module call to
+// patch expressions: kungfu.module.name, kungfu.module.source,
+// kungfu.module.version and kungfu.module.args, the build variant as
+// kungfu.variant, and environment variables as env.<NAME>. The module call
+// lives under kungfu so that module.<name> references stay references to the
+// module calls inside the patched module.
+func ModuleEvalContext(
+	ctx *hcl.EvalContext,
+	module models.ModuleCall,
+	variant string,
+	environ []string,
+) *hcl.EvalContext {
+	args := cty.EmptyObjectVal
+	if len(module.Args) > 0 {
+		args = cty.ObjectVal(module.Args)
+	}
+
+	env := make(map[string]cty.Value, len(environ))
+	for _, entry := range environ {
+		if name, value, found := strings.Cut(entry, "="); found && name != "" {
+			env[name] = cty.StringVal(value)
+		}
+	}
+	envVal := cty.MapValEmpty(cty.String)
+	if len(env) > 0 {
+		envVal = cty.MapVal(env)
+	}
+
+	if ctx == nil {
+		ctx = NewEvalContext(nil)
+	}
+	child := ctx.NewChild()
+	child.Variables = map[string]cty.Value{
+		"kungfu": cty.ObjectVal(map[string]cty.Value{
+			"module": cty.ObjectVal(map[string]cty.Value{
+				"name":    cty.StringVal(module.Name),
+				"source":  cty.StringVal(module.Source),
+				"version": cty.StringVal(module.Version),
+				"args":    args,
+			}),
+			"variant": cty.StringVal(variant),
+		}),
+		"env": envVal,
+	}
+	return child
+}
+
+// referencesModuleCall reports whether expr refers to the module call being
+// patched, through kungfu or env, and so must be evaluated separately for
+// each module call.
+func referencesModuleCall(expr hcl.Expression) bool {
+	for _, traversal := range expr.Variables() {
+		switch traversal.RootName() {
+		case "env", "kungfu":
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveModuleValues returns a copy of patch with the attribute values that
+// refer to the module call evaluated in ctx, a context from ModuleEvalContext.
+func ResolveModuleValues(patch models.Patch, ctx *hcl.EvalContext) (models.Patch, error) {
+	attributes, err := resolveAttributes(patch.Attributes, "", ctx)
+	if err != nil {
+		return models.Patch{}, err
+	}
+	patch.Attributes = attributes
+
+	if patch.Added, err = resolveAddedBlocks(patch.Added, "", ctx); err != nil {
+		return models.Patch{}, err
+	}
+
+	blocks := make(map[string]*models.PatchBlock, len(patch.Blocks))
+	for blockType, block := range patch.Blocks {
+		blockAttributes, err := resolveAttributes(block.Attributes, blockType+".", ctx)
+		if err != nil {
+			return models.Patch{}, err
+		}
+		added, err := resolveAddedBlocks(block.Added, blockType+".", ctx)
+		if err != nil {
+			return models.Patch{}, err
+		}
+		blocks[blockType] = &models.PatchBlock{Attributes: blockAttributes, Added: added}
+	}
+	patch.Blocks = blocks
+	return patch, nil
+}
+
+// resolveAddedBlocks returns a copy of blocks with the values that refer to
+// the module call evaluated in ctx.
+func resolveAddedBlocks(blocks []*models.AddedBlock, prefix string, ctx *hcl.EvalContext) ([]*models.AddedBlock, error) {
+	if blocks == nil {
+		return nil, nil
+	}
+	resolved := make([]*models.AddedBlock, 0, len(blocks))
+	for _, block := range blocks {
+		blockPrefix := prefix + block.Type + "."
+		attributes, err := resolveAttributes(block.Attributes, blockPrefix, ctx)
+		if err != nil {
+			return nil, err
+		}
+		nested, err := resolveAddedBlocks(block.Blocks, blockPrefix, ctx)
+		if err != nil {
+			return nil, err
+		}
+		resolvedBlock := *block
+		resolvedBlock.Attributes = attributes
+		resolvedBlock.Blocks = nested
+		resolved = append(resolved, &resolvedBlock)
+	}
+	return resolved, nil
+}
+
+// resolveAttributes returns a copy of attrs with the values that refer to the
+// module call evaluated in ctx. prefix qualifies attribute names in errors.
+func resolveAttributes(
+	attrs map[string]*models.PatchAttribute,
+	prefix string,
+	ctx *hcl.EvalContext,
+) (map[string]*models.PatchAttribute, error) {
+	resolved := make(map[string]*models.PatchAttribute, len(attrs))
+	for name, attr := range attrs {
+		if attr.Expr == nil {
+			resolved[name] = attr
+			continue
+		}
+
+		val, diags := attr.Expr.Value(ctx)
+		if diags.HasErrors() {
+			return nil, fmt.Errorf("failed to evaluate %s%s: %s", prefix, name, diags.Error())
+		}
+		if !val.IsWhollyKnown() {
+			return nil, fmt.Errorf(
+				"%s%s depends on a module argument kungfu cannot evaluate, such as a reference to the root module",
+				prefix, name)
+		}
+
+		resolvedAttr := *attr
+		resolvedAttr.Value = val
+		resolvedAttr.Expr = nil
+		resolved[name] = &resolvedAttr
+	}
+	return resolved, nil
+}
+
+// EvaluateWhen reports whether a patch applies to the module call described
+// by ctx. A patch without a when condition always applies.
+func EvaluateWhen(patch models.Patch, ctx *hcl.EvalContext) (bool, error) {
+	if patch.When == nil {
+		return true, nil
+	}
+
+	val, diags := patch.When.Value(ctx)
+	if diags.HasErrors() {
+		return false, fmt.Errorf("failed to evaluate when: %s", diags.Error())
+	}
+	if !val.IsWhollyKnown() {
+		return false, errors.New(
+			"when depends on a module argument kungfu cannot evaluate, such as a reference to the root module")
+	}
+	if val.IsNull() || val.Type() != cty.Bool {
+		return false, errors.New("when must evaluate to a bool")
+	}
+	return val.True(), nil
+}
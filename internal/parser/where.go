@@ -0,0 +1,105 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// parseWhereBlock parses a where block into one condition per operator
+// argument. A block may combine several operators on the same attribute.
+func parseWhereBlock(block *hclsyntax.Block, ctx *hcl.EvalContext) ([]models.Condition, error) {
+	if len(block.Labels) != 0 {
+		return nil, errors.New("where block does not take labels")
+	}
+
+	attrAttr, exists := block.Body.Attributes["attribute"]
+	if !exists {
+		return nil, errors.New("where block requires an attribute argument")
+	}
+	attrVal, diags := attrAttr.Expr.Value(ctx)
+	if diags.HasErrors() || attrVal.IsNull() || attrVal.Type() != cty.String || attrVal.AsString() == "" {
+		return nil, errors.New("where attribute must be a non-empty string")
+	}
+	attribute := attrVal.AsString()
+
+	var conditions []models.Condition
+	for _, attr := range sortedAttributes(block.Body) {
+		if attr.Name == "attribute" {
+			continue
+		}
+
+		operator, known := whereOperators()[attr.Name]
+		if !known {
+			return nil, fmt.Errorf("unsupported where operator %q", attr.Name)
+		}
+
+		val, valDiags := attr.Expr.Value(ctx)
+		if valDiags.HasErrors() {
+			return nil, fmt.Errorf("failed to evaluate where %s: %s", attr.Name, valDiags.Error())
+		}
+
+		condition := models.Condition{
+			Attribute: attribute,
+			Operator:  operator,
+			Value:     val,
+		}
+		if err := validateCondition(&condition); err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+
+	if len(conditions) == 0 {
+		return nil, fmt.Errorf("where block for %s requires at least one operator", attribute)
+	}
+	return conditions, nil
+}
+
+func whereOperators() map[string]models.ConditionOperator {
+	return map[string]models.ConditionOperator{
+		"present":    models.ConditionPresent,
+		"equals":     models.ConditionEquals,
+		"not_equals": models.ConditionNotEquals,
+		"prefix":     models.ConditionPrefix,
+		"suffix":     models.ConditionSuffix,
+		"matches":    models.ConditionMatches,
+		"contains":   models.ConditionContains,
+		"has_key":    models.ConditionHasKey,
+		"lacks_key":  models.ConditionLacksKey,
+	}
+}
+
+func validateCondition(condition *models.Condition) error {
+	val := condition.Value
+	if val.IsNull() {
+		return fmt.Errorf("where %s must not be null", condition.Operator)
+	}
+
+	switch condition.Operator {
+	case models.ConditionPresent:
+		if val.Type() != cty.Bool {
+			return errors.New("where present must be a bool")
+		}
+	case models.ConditionPrefix, models.ConditionSuffix, models.ConditionHasKey, models.ConditionLacksKey:
+		if val.Type() != cty.String {
+			return fmt.Errorf("where %s must be a string", condition.Operator)
+		}
+	case models.ConditionMatches:
+		if val.Type() != cty.String {
+			return errors.New("where matches must be a string")
+		}
+		pattern, err := regexp.Compile(val.AsString())
+		if err != nil {
+			return fmt.Errorf("invalid where matches pattern: %w", err)
+		}
+		condition.Pattern = pattern
+	case models.ConditionEquals, models.ConditionNotEquals, models.ConditionContains:
+	}
+	return nil
+}
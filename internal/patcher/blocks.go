@@ -0,0 +1,167 @@
+package patcher
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+)
+
+// appendStrategy is the strategy added blocks are reported with.
+const appendStrategy = "append"
+
+// applyModuleBlockPatch applies a check or removed patch to the matching
+// block in the root directory of the module, creating the block when the
+// module does not declare it.
+func applyModuleBlockPatch(
+	files map[string]*models.HCLFile,
+	patch models.Patch,
+	tracker *conflictTracker,
+) (models.AppliedPatch, error) {
+	rootDir, ok := moduleRootDir(files)
+	if !ok {
+		return models.AppliedPatch{}, fmt.Errorf("module has no files to add a block to")
+	}
+
+	if patch.Kind == models.PatchRemoved && declaresAddress(files, rootDir, removedAddress(patch)) {
+		return models.AppliedPatch{}, fmt.Errorf(
+			"cannot remove %s: the module still declares it; Terraform only accepts a removed block for "+
+				"configuration that no longer exists", removedAddress(patch))
+	}
+
+	path, block, key := findModuleBlock(files, rootDir, patch)
+	if block == nil {
+		path, block = createModuleBlock(files, rootDir, patch)
+	}
+
+	if patch.Kind == models.PatchCheck && block.Body().FirstMatchingBlock("data", nil) != nil {
+		for _, added := range patch.Added {
+			if added.Type == "data" {
+				return models.AppliedPatch{}, fmt.Errorf("check %s already has a data block", patch.CheckName)
+			}
+		}
+	}
+
+	changes, err := applyBody(block.Body(), key, patch, tracker)
+	if err != nil {
+		return models.AppliedPatch{}, err
+	}
+	return models.AppliedPatch{
+		Source:       patch.Source,
+		ResourceType: block.Type(),
+		ResourceName: strings.TrimPrefix(key, block.Type()+"."),
+		File:         path,
+		Attributes:   changes,
+	}, nil
+}
+
+// findModuleBlock returns the block in dir a check or removed patch applies
+// to, together with its file and the key it is tracked by in conflicts.
+func findModuleBlock(
+	files map[string]*models.HCLFile,
+	dir string,
+	patch models.Patch,
+) (string, *hclwrite.Block, string) {
+	if patch.Kind == models.PatchCheck {
+		key := "check." + patch.CheckName
+		for _, path := range sortedPaths(files) {
+			if filepath.Dir(path) != dir {
+				continue
+			}
+			if block, exists := files[path].Checks[patch.CheckName]; exists {
+				return path, block, key
+			}
+		}
+		return "", nil, key
+	}
+
+	from := removedAddress(patch)
+	key := "removed." + from
+	for _, path := range sortedPaths(files) {
+		if filepath.Dir(path) != dir {
+			continue
+		}
+		for _, block := range files[path].RemovedBlocks {
+			if text := attributeText(block.Body(), "from"); text != nil && compactSource([]byte(*text)) == from {
+				return path, block, key
+			}
+		}
+	}
+	return "", nil, key
+}
+
+func createModuleBlock(files map[string]*models.HCLFile, dir string, patch models.Patch) (string, *hclwrite.Block) {
+	if patch.Kind == models.PatchCheck {
+		path, block := appendModuleBlock(files, dir, "check", []string{patch.CheckName})
+		if files[path].Checks == nil {
+			files[path].Checks = make(map[string]*hclwrite.Block)
+		}
+		files[path].Checks[patch.CheckName] = block
+		return path, block
+	}
+
+	path, block := appendModuleBlock(files, dir, "removed", nil)
+	files[path].RemovedBlocks = append(files[path].RemovedBlocks, block)
+	return path, block
+}
+
+// declaresAddress reports whether the files in dir declare the resource or
+// module call at address, such as aws_s3_bucket.logs or module.vpc.
+func declaresAddress(files map[string]*models.HCLFile, dir, address string) bool {
+	moduleName, isModule := strings.CutPrefix(address, "module.")
+	for _, path := range sortedPaths(files) {
+		if filepath.Dir(path) != dir {
+			continue
+		}
+		if !isModule {
+			if _, exists := files[path].Resources[address]; exists {
+				return true
+			}
+			continue
+		}
+		for _, block := range files[path].WriteFile.Body().Blocks() {
+			if labels := block.Labels(); block.Type() == "module" && len(labels) == 1 && labels[0] == moduleName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removedAddress returns the from address of a removed patch with
+// whitespace removed.
+func removedAddress(patch models.Patch) string {
+	from, ok := patch.Attributes["from"]
+	if !ok {
+		return ""
+	}
+	return compactSource(valueToTokens(from.Value).Bytes())
+}
+
+// appendBlocks appends added blocks to body and returns the changes they
+// make. prefix qualifies block types in changes, e.g. "lifecycle.".
+func appendBlocks(body *hclwrite.Body, prefix string, blocks []*models.AddedBlock) []models.AttributeChange {
+	changes := make([]models.AttributeChange, 0, len(blocks))
+	for _, added := range blocks {
+		block := appendBlock(body, added)
+		changes = append(changes, models.AttributeChange{
+			Name:     prefix + added.Type,
+			Strategy: appendStrategy,
+			After:    strings.TrimSpace(string(hclwrite.Format(block.BuildTokens(nil).Bytes()))),
+		})
+	}
+	return changes
+}
+
+func appendBlock(body *hclwrite.Body, added *models.AddedBlock) *hclwrite.Block {
+	block := body.AppendNewBlock(added.Type, added.Labels)
+	for _, name := range sortedAttributeNames(added.Attributes) {
+		block.Body().SetAttributeRaw(name, valueToTokens(added.Attributes[name].Value))
+	}
+	for _, nested := range added.Blocks {
+		appendBlock(block.Body(), nested)
+	}
+	return block
+}
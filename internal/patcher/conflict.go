@@ -0,0 +1,86 @@
+package patcher
+
+import (
+	"fmt"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+)
+
+// attributeClaim records which patch last set an attribute of a resource.
+type attributeClaim struct {
+	patch    models.Patch
+	strategy models.MergeStrategy
+	value    string
+}
+
+// conflictTracker detects patches that set the same attribute of the same
+// resource without an explicit priority to order them. It keeps the last
+// claim of each attribute, and the last replace claim, so that two replaces
+// are compared even when a merge or append was applied between them.
+type conflictTracker struct {
+	claims   map[string]attributeClaim
+	replaces map[string]attributeClaim
+	warnings []string
+}
+
+func newConflictTracker() *conflictTracker {
+	return &conflictTracker{
+		claims:   make(map[string]attributeClaim),
+		replaces: make(map[string]attributeClaim),
+	}
+}
+
+// claim registers that patch is about to set attrName on the resource
+// identified by resourceKey. It returns an error when an unordered patch
+// already replaced the attribute with a different value, and records a
+// warning when merge or append strategies collide.
+func (t *conflictTracker) claim(
+	resourceKey string,
+	attrName string,
+	patch models.Patch,
+	patchAttr *models.PatchAttribute,
+) error {
+	key := resourceKey + "." + attrName
+	current := attributeClaim{
+		patch:    patch,
+		strategy: patchAttr.Strategy,
+		value:    string(valueToTokens(patchAttr.Value).Bytes()),
+	}
+
+	previous, exists := t.claims[key]
+	t.claims[key] = current
+	if current.strategy == models.StrategyReplace {
+		previousReplace, replaced := t.replaces[key]
+		t.replaces[key] = current
+		if replaced && sameOrder(previousReplace.patch, patch) && previousReplace.value != current.value {
+			return fmt.Errorf(
+				"conflicting patches for %s: set by %s and %s with different values; "+
+					"declare a priority to order them",
+				key, patchOrigin(previousReplace.patch), patchOrigin(patch))
+		}
+	}
+	if !exists || !sameOrder(previous.patch, patch) ||
+		previous.strategy == models.StrategyReplace && current.strategy == models.StrategyReplace {
+		return nil
+	}
+
+	t.warnings = append(t.warnings, fmt.Sprintf(
+		"%s is patched by %s (%s) and %s (%s); later patch is applied on top",
+		key, patchOrigin(previous.patch), previous.strategy, patchOrigin(patch), current.strategy))
+	return nil
+}
+
+// sameOrder reports whether nothing orders patches a and b, so that neither
+// is meant to override the other: they have the same priority and neither of
+// their overlays includes the other.
+func sameOrder(a, b models.Patch) bool {
+	return a.Priority == b.Priority && !overrides(a, b) && !overrides(b, a)
+}
+
+// patchOrigin describes where a patch was declared for use in messages.
+func patchOrigin(patch models.Patch) string {
+	if patch.Range.Filename == "" {
+		return "patch for " + describeTarget(patch)
+	}
+	return fmt.Sprintf("%s:%d", patch.Range.Filename, patch.Range.Start.Line)
+}
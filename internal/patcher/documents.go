@@ -0,0 +1,183 @@
+package patcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// scratchAttribute is the name of the attribute a value is held in while a
+// strategy is applied to it outside of the module's files.
+const scratchAttribute = "value"
+
+// documentFunctions are the functions that encode a structured document, such
+// as an IAM policy, into a string. Strategies are applied to the document
+// they are called with.
+func documentFunctions() map[string]bool {
+	return map[string]bool{
+		"jsonencode": true,
+		"yamlencode": true,
+	}
+}
+
+// isDocumentStrategy reports whether strategy changes the structure of a
+// value, and so applies to the document inside an encoded string rather than
+// to the string itself.
+func isDocumentStrategy(strategy models.MergeStrategy) bool {
+	switch strategy {
+	case models.StrategyReplace, models.StrategyPrefix, models.StrategySuffix,
+		models.StrategyRegexReplace, models.StrategyTemplate:
+		return false
+	default:
+		return true
+	}
+}
+
+// applyToDocument applies patchAttr to the document encoded in an attribute:
+// the argument of a call to jsonencode or yamlencode, or a string holding a
+// JSON object or array. The document is re-encoded in the same form. It
+// reports false when the attribute does not hold a document.
+func applyToDocument(body *hclwrite.Body, name string, patchAttr *models.PatchAttribute) (bool, error) {
+	existingAttr := body.GetAttribute(name)
+	if existingAttr == nil {
+		return false, nil
+	}
+	src, parsed, ok := parseExpressionSource(existingAttr.Expr())
+	if !ok {
+		return false, nil
+	}
+
+	switch expr := parsed.(type) {
+	case *hclsyntax.FunctionCallExpr:
+		if !documentFunctions()[expr.Name] || len(expr.Args) != 1 || expr.ExpandFinal {
+			return false, nil
+		}
+		patched, err := applyToSource(name, expr.Args[0].Range().SliceBytes(src), patchAttr)
+		if err != nil {
+			return true, err
+		}
+		return true, setAttributeSource(body, name, []byte(expr.Name+"("+string(patched)+")"))
+	case *hclsyntax.TemplateExpr, *hclsyntax.TemplateWrapExpr:
+		return applyToJSONString(body, name, parsed, src, patchAttr)
+	default:
+		return false, nil
+	}
+}
+
+// applyToJSONString applies patchAttr to a string holding a JSON document. A
+// literal string is decoded, patched and encoded again, keeping its heredoc
+// or quoted form. A template with interpolations is decoded by Terraform
+// instead, with jsondecode, and encoded again with jsonencode.
+func applyToJSONString(
+	body *hclwrite.Body,
+	name string,
+	parsed hclsyntax.Expression,
+	src []byte,
+	patchAttr *models.PatchAttribute,
+) (bool, error) {
+	exprSrc := parsed.Range().SliceBytes(src)
+	val, diags := parsed.Value(nil)
+	if diags.HasErrors() {
+		if !startsWithJSONDocument(parsed) {
+			return false, nil
+		}
+		patched, err := applyToSource(name, []byte("jsondecode("+string(exprSrc)+"\n)"), patchAttr)
+		if err != nil {
+			return true, err
+		}
+		return true, setAttributeSource(body, name, []byte("jsonencode("+string(patched)+")"))
+	}
+
+	if !isKnownString(val) || !isJSONDocument(val.AsString()) {
+		return false, nil
+	}
+	docType, err := ctyjson.ImpliedType([]byte(val.AsString()))
+	if err != nil {
+		return false, nil
+	}
+	doc, err := ctyjson.Unmarshal([]byte(val.AsString()), docType)
+	if err != nil {
+		return false, nil
+	}
+
+	patched, err := applyToSource(name, hclwrite.TokensForValue(doc).Bytes(), patchAttr)
+	if err != nil {
+		return true, err
+	}
+	patchedExpr, diags := hclsyntax.ParseExpression(patched, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return true, fmt.Errorf("patched document of %s is not valid HCL: %s", name, diags.Error())
+	}
+	patchedVal, diags := patchedExpr.Value(nil)
+	if diags.HasErrors() || !patchedVal.IsWhollyKnown() {
+		// The patch refers to values only Terraform can evaluate.
+		return true, setAttributeSource(body, name, []byte("jsonencode("+string(patched)+")"))
+	}
+
+	encoded, err := ctyjson.Marshal(patchedVal, patchedVal.Type())
+	if err != nil {
+		return true, fmt.Errorf("failed to encode the patched document of %s: %w", name, err)
+	}
+	if !bytes.HasPrefix(exprSrc, []byte("<<")) {
+		return true, replaceAttribute(body, name, cty.StringVal(string(encoded)))
+	}
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, encoded, "", "  "); err != nil {
+		return true, fmt.Errorf("failed to encode the patched document of %s: %w", name, err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(exprSrc)), "\n")
+	opener, closer := lines[0], strings.TrimSpace(lines[len(lines)-1])
+	heredoc := opener + "\n" + indented.String() + "\n" + closer + "\n"
+	return true, setAttributeSource(body, name, []byte(heredoc))
+}
+
+// applyToSource applies patchAttr to a value with the HCL source src, or to a
+// missing value when src is nil, and returns the source of the result. It
+// returns nil when the patch leaves the value unset.
+func applyToSource(name string, src []byte, patchAttr *models.PatchAttribute) ([]byte, error) {
+	body := hclwrite.NewEmptyFile().Body()
+	if src != nil {
+		tokens, ok := tokensForSource(src)
+		if !ok {
+			return nil, fmt.Errorf("the value of %s cannot be parsed", name)
+		}
+		body.SetAttributeRaw(scratchAttribute, tokens)
+	}
+
+	if err := applyAttribute(body, scratchAttribute, patchAttr); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if attributeText(body, scratchAttribute) == nil {
+		return nil, nil
+	}
+	return []byte(*attributeText(body, scratchAttribute)), nil
+}
+
+func isJSONDocument(s string) bool {
+	trimmed := strings.TrimSpace(s)
+	return (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed))
+}
+
+// startsWithJSONDocument reports whether a template with interpolations
+// starts like a JSON object or array.
+func startsWithJSONDocument(expr hclsyntax.Expression) bool {
+	template, ok := expr.(*hclsyntax.TemplateExpr)
+	if !ok || len(template.Parts) == 0 {
+		return false
+	}
+	literal, ok := template.Parts[0].(*hclsyntax.LiteralValueExpr)
+	if !ok || !isKnownString(literal.Val) {
+		return false
+	}
+	trimmed := strings.TrimSpace(literal.Val.AsString())
+	return strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")
+}
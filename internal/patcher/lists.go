@@ -0,0 +1,480 @@
+package patcher
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// listAttribute applies a list strategy: append, prepend, remove, union or
+// at. List literals are edited in place, keeping the formatting and comments
+// of the elements that stay. Any other expression, such as var.subnet_ids or
+// a call to concat, is wrapped in an expression that computes the patched
+// list when Terraform evaluates it.
+func listAttribute(body *hclwrite.Body, name string, strategy models.MergeStrategy, value interface{}) error {
+	existingAttr := body.GetAttribute(name)
+	if existingAttr == nil {
+		switch strategy {
+		case models.StrategyRemove:
+			return nil
+		case models.StrategyIndex:
+			return fmt.Errorf("cannot replace elements of %s: the attribute is not set", name)
+		default:
+			return replaceAttribute(body, name, value)
+		}
+	}
+
+	src, parsed, ok := parseExpressionSource(existingAttr.Expr())
+	if !ok {
+		return fmt.Errorf("cannot %s %s: the existing value cannot be parsed", strategy, name)
+	}
+
+	unique := referenceLists()[name]
+	if tuple, isTuple := parsed.(*hclsyntax.TupleConsExpr); isTuple {
+		edited, ok, err := editListSource(src, tuple, strategy, value, unique)
+		if err != nil {
+			return fmt.Errorf("cannot %s %s: %w", strategy, name, err)
+		}
+		if ok {
+			return setAttributeSource(body, name, edited)
+		}
+	}
+
+	if unique {
+		if name == "ignore_changes" && hcl.ExprAsKeyword(parsed) == "all" && strategy != models.StrategyRemove {
+			// Every change is already ignored.
+			return nil
+		}
+		return fmt.Errorf("cannot %s %s: the existing value is not a list literal", strategy, name)
+	}
+
+	wrapped, err := listExpressionSource(parsed.Range().SliceBytes(src), strategy, value)
+	if err != nil {
+		return fmt.Errorf("cannot %s %s: %w", strategy, name, err)
+	}
+	return setAttributeSource(body, name, wrapped)
+}
+
+func setAttributeSource(body *hclwrite.Body, name string, src []byte) error {
+	tokens, ok := tokensForSource(src)
+	if !ok {
+		return fmt.Errorf("patched value of %s is not valid HCL: %s", name, src)
+	}
+	body.SetAttributeRaw(name, tokens)
+	return nil
+}
+
+// editListSource returns the source of tuple with strategy applied. It
+// reports false when the patch is not a list literal or known list, so that
+// its elements cannot be spliced into the tuple. With unique set, elements
+// already in the tuple are never added again.
+func editListSource(
+	src []byte,
+	tuple *hclsyntax.TupleConsExpr,
+	strategy models.MergeStrategy,
+	value interface{},
+	unique bool,
+) ([]byte, bool, error) {
+	if strategy == models.StrategyIndex {
+		indexed, ok := indexedElements(value)
+		if !ok {
+			return nil, false, nil
+		}
+		edited, err := indexListSource(src, tuple, indexed)
+		return edited, err == nil, err
+	}
+
+	elements, ok := listElementSources(value)
+	if !ok {
+		return nil, false, nil
+	}
+	if strategy == models.StrategyRemove {
+		return removeListSource(src, tuple, elements), true, nil
+	}
+	if unique || strategy == models.StrategyUnion {
+		elements = newElements(src, tuple, elements)
+	}
+	if strategy == models.StrategyPrepend {
+		return prependListSource(src, tuple, elements), true, nil
+	}
+	return appendListSource(src, tuple, elements), true, nil
+}
+
+// listExpressionSource wraps the source of an existing list expression so
+// that it evaluates to the patched list. Union only skips the patch elements
+// the list already contains: duplicates within the computed list are kept,
+// as its value is not known until Terraform evaluates it.
+func listExpressionSource(existing []byte, strategy models.MergeStrategy, value interface{}) ([]byte, error) {
+	list := string(bytes.TrimSpace(existing))
+
+	if strategy == models.StrategyIndex {
+		indexed, ok := indexedElements(value)
+		if !ok {
+			return nil, fmt.Errorf("the patch must map list indexes to values")
+		}
+		indexes := make([]int, 0, len(indexed))
+		for index := range indexed {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+
+		var conditions strings.Builder
+		for _, index := range indexes {
+			fmt.Fprintf(&conditions, "i == %d ? %s : ", index, indexed[index])
+		}
+		return []byte(fmt.Sprintf("[for i, v in %s : %sv]", list, conditions.String())), nil
+	}
+
+	patch := string(bytes.TrimSpace(valueToTokens(value).Bytes()))
+	switch strategy {
+	case models.StrategyPrepend:
+		return []byte(fmt.Sprintf("concat(%s, %s)", patch, list)), nil
+	case models.StrategyRemove:
+		return []byte(fmt.Sprintf("[for v in %s : v if !contains(%s, v)]", list, patch)), nil
+	case models.StrategyUnion:
+		return []byte(fmt.Sprintf("concat(%s, [for v in %s : v if !contains(%s, v)])", list, patch, list)), nil
+	default:
+		return []byte(fmt.Sprintf("concat(%s, %s)", list, patch)), nil
+	}
+}
+
+// indexedElements reads the value of a kf::at patch, an object whose keys are
+// list indexes, into the HCL source of the element to set at each index.
+func indexedElements(value interface{}) (map[int]string, bool) {
+	items, ok := objectPatchFor(value, nil)
+	if !ok {
+		return nil, false
+	}
+	indexed := make(map[int]string, len(items))
+	for key, item := range items {
+		index, err := strconv.Atoi(key)
+		if err != nil || index < 0 {
+			return nil, false
+		}
+		indexed[index] = string(bytes.TrimSpace(item.text))
+	}
+	return indexed, true
+}
+
+// indexListSource returns the source of tuple with the elements at the given
+// indexes replaced.
+func indexListSource(src []byte, tuple *hclsyntax.TupleConsExpr, indexed map[int]string) ([]byte, error) {
+	edits := make([]models.SourceEdit, 0, len(indexed))
+	for index, text := range indexed {
+		if index >= len(tuple.Exprs) {
+			return nil, fmt.Errorf("index %d is out of range for a list of %d elements", index, len(tuple.Exprs))
+		}
+		elementRange := tuple.Exprs[index].Range()
+		edits = append(edits, models.SourceEdit{Start: elementRange.Start.Byte, End: elementRange.End.Byte, Text: []byte(text)})
+	}
+	return models.ApplySourceEdits(src, tuple.SrcRange.Start.Byte, tuple.SrcRange.End.Byte, edits), nil
+}
+
+// prependListSource returns the source of tuple with the rendered elements
+// inserted before the existing elements.
+func prependListSource(src []byte, tuple *hclsyntax.TupleConsExpr, rendered []string) []byte {
+	start, end := tuple.SrcRange.Start.Byte, tuple.SrcRange.End.Byte
+	if len(rendered) == 0 || len(tuple.Exprs) == 0 {
+		return appendListSource(src, tuple, rendered)
+	}
+
+	firstStart := tuple.Exprs[0].Range().Start.Byte
+	if lineStart, ownLine := ownLineStart(src, start, firstStart); ownLine {
+		edit := models.SourceEdit{Start: lineStart, End: lineStart, Text: []byte(strings.Join(rendered, ",\n") + ",\n")}
+		return models.ApplySourceEdits(src, start, end, []models.SourceEdit{edit})
+	}
+	edit := models.SourceEdit{Start: firstStart, End: firstStart, Text: []byte(strings.Join(rendered, ", ") + ", ")}
+	return models.ApplySourceEdits(src, start, end, []models.SourceEdit{edit})
+}
+
+// removeListSource returns the source of tuple without the elements whose
+// source matches one of rendered, ignoring whitespace. Elements on lines of
+// their own are removed with their line, so the comments of the others are
+// kept; lists that share lines between elements are rewritten.
+func removeListSource(src []byte, tuple *hclsyntax.TupleConsExpr, rendered []string) []byte {
+	start, end := tuple.SrcRange.Start.Byte, tuple.SrcRange.End.Byte
+	remove := make(map[string]bool, len(rendered))
+	for _, element := range rendered {
+		remove[compactSource([]byte(element))] = true
+	}
+
+	var edits []models.SourceEdit
+	var kept []string
+	ownLines := true
+	for _, expr := range tuple.Exprs {
+		elementRange := expr.Range()
+		elementSrc := elementRange.SliceBytes(src)
+		if !remove[compactSource(elementSrc)] {
+			kept = append(kept, string(elementSrc))
+			continue
+		}
+		edit, ownLine := removeLineEdit(src, start, elementRange.Start.Byte, elementRange.End.Byte)
+		ownLines = ownLines && ownLine
+		edits = append(edits, edit)
+	}
+
+	if len(edits) == 0 {
+		return src[start:end]
+	}
+	if ownLines {
+		return models.ApplySourceEdits(src, start, end, edits)
+	}
+	if len(kept) > 0 && bytes.ContainsRune(src[start:end], '\n') {
+		return []byte("[\n" + strings.Join(kept, ",\n") + ",\n]")
+	}
+	return []byte("[" + strings.Join(kept, ", ") + "]")
+}
+
+// removeLineEdit returns the edit deleting the line of the element between
+// elementStart and elementEnd, including its comma and trailing comment, and
+// whether the element is alone on that line.
+func removeLineEdit(src []byte, start, elementStart, elementEnd int) (models.SourceEdit, bool) {
+	lineStart, ownLine := ownLineStart(src, start, elementStart)
+	if !ownLine {
+		return models.SourceEdit{}, false
+	}
+
+	pos := skipBlanks(src, elementEnd)
+	if pos < len(src) && src[pos] == ',' {
+		pos = skipBlanks(src, pos+1)
+	}
+	if pos < len(src) && (src[pos] == '#' || bytes.HasPrefix(src[pos:], []byte("//"))) {
+		for pos < len(src) && src[pos] != '\n' {
+			pos++
+		}
+	}
+	if pos >= len(src) || src[pos] != '\n' {
+		return models.SourceEdit{}, false
+	}
+	return models.SourceEdit{Start: lineStart, End: pos + 1}, true
+}
+
+func skipBlanks(src []byte, pos int) int {
+	for pos < len(src) && (src[pos] == ' ' || src[pos] == '\t') {
+		pos++
+	}
+	return pos
+}
+
+// keyedElement is an element of a merge_by patch.
+type keyedElement struct {
+	// key is the source of the element's merge key, without whitespace.
+	key   string
+	text  string
+	items objectPatch
+}
+
+// mergeByAttribute merges a list of objects into an existing list, matching
+// elements on key. Matched elements are deep-merged and the others appended.
+// A list literal is edited in place; any other expression is wrapped in an
+// expression that computes the merged list when Terraform evaluates it.
+func mergeByAttribute(body *hclwrite.Body, name, key string, value interface{}) error {
+	existingAttr := body.GetAttribute(name)
+	if existingAttr == nil {
+		return replaceAttribute(body, name, value)
+	}
+
+	src, parsed, ok := parseExpressionSource(existingAttr.Expr())
+	if !ok {
+		return fmt.Errorf("cannot merge %s by %s: the existing value cannot be parsed", name, key)
+	}
+	elements, ok := keyedElements(value, key)
+	if !ok {
+		return fmt.Errorf("cannot merge %s by %s: the patch must be a list of objects with literal keys", name, key)
+	}
+
+	if tuple, isTuple := parsed.(*hclsyntax.TupleConsExpr); isTuple {
+		merged, err := mergeByListSource(src, tuple, key, elements)
+		if err != nil {
+			return fmt.Errorf("cannot merge %s by %s: %w", name, key, err)
+		}
+		return setAttributeSource(body, name, merged)
+	}
+
+	list := string(bytes.TrimSpace(parsed.Range().SliceBytes(src)))
+	patch := string(bytes.TrimSpace(valueToTokens(value).Bytes()))
+	field := fieldAccess(key)
+	merges := make([]string, 0, len(elements))
+	for _, element := range elements {
+		keySource := string(bytes.TrimSpace(element.items[key].text))
+		merges = append(merges, fmt.Sprintf("(%s) = %s", keySource, deepMergeSource("e", element.items)))
+	}
+	wrapped := fmt.Sprintf(
+		"concat([for e in %[1]s : try({ %[4]s }[e%[3]s], e)], "+
+			"[for p in %[2]s : p if !contains([for e in %[1]s : e%[3]s], p%[3]s)])",
+		list, patch, field, strings.Join(merges, ", "))
+	return setAttributeSource(body, name, []byte(wrapped))
+}
+
+// deepMergeSource returns an expression that deep-merges items into the
+// object target evaluates to. A nested object is merged into the target's
+// value for its key, and replaces that value when it is not an object.
+func deepMergeSource(target string, items objectPatch) string {
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		item := items[key]
+		value := string(bytes.TrimSpace(item.text))
+		if item.object != nil {
+			value = fmt.Sprintf("try(%s, %s)", deepMergeSource(target+fieldAccess(key), item.object), objectSource(item.object))
+		}
+		parts = append(parts, fmt.Sprintf("%s = %s", objectKeySource(key), value))
+	}
+	return fmt.Sprintf("merge(%s, { %s })", target, strings.Join(parts, ", "))
+}
+
+// objectSource returns items as an object literal on a single line.
+func objectSource(items objectPatch) string {
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value := string(bytes.TrimSpace(items[key].text))
+		if items[key].object != nil {
+			value = objectSource(items[key].object)
+		}
+		parts = append(parts, fmt.Sprintf("%s = %s", objectKeySource(key), value))
+	}
+	return "{ " + strings.Join(parts, ", ") + " }"
+}
+
+// fieldAccess returns the source that reads key from an object, such as
+// .name or ["kubernetes.io/role"].
+func fieldAccess(key string) string {
+	if hclsyntax.ValidIdentifier(key) {
+		return "." + key
+	}
+	return "[" + string(hclwrite.TokensForValue(cty.StringVal(key)).Bytes()) + "]"
+}
+
+// keyedElements reads the elements of a merge_by patch, a known list of
+// objects or a verbatim tuple of object literals.
+func keyedElements(value interface{}, key string) ([]keyedElement, bool) {
+	var elements []keyedElement
+	switch v := value.(type) {
+	case cty.Value:
+		if !isListValue(v) {
+			return nil, false
+		}
+		for _, element := range v.AsValueSlice() {
+			if !isMergeableValue(element) {
+				return nil, false
+			}
+			elements = append(elements, keyedElement{
+				text:  string(bytes.TrimSpace(valueToTokens(element).Bytes())),
+				items: objectPatchForValue(element),
+			})
+		}
+	case hclwrite.Tokens:
+		src := v.Bytes()
+		parsed, diags := hclsyntax.ParseExpression(src, "", hcl.InitialPos)
+		if diags.HasErrors() {
+			return nil, false
+		}
+		tuple, ok := parsed.(*hclsyntax.TupleConsExpr)
+		if !ok {
+			return nil, false
+		}
+		for _, expr := range tuple.Exprs {
+			obj, ok := expr.(*hclsyntax.ObjectConsExpr)
+			if !ok {
+				return nil, false
+			}
+			items, ok := objectPatchForSource(src, obj, nil)
+			if !ok {
+				return nil, false
+			}
+			elements = append(elements, keyedElement{text: string(expr.Range().SliceBytes(src)), items: items})
+		}
+	default:
+		return nil, false
+	}
+
+	for i := range elements {
+		item, exists := elements[i].items[key]
+		if !exists {
+			return nil, false
+		}
+		elements[i].key = compactSource(item.text)
+	}
+	return elements, true
+}
+
+// mergeByListSource returns the source of tuple with elements merged in.
+// Object literals whose key has the same source as a patch element's are
+// merged in place; the remaining patch elements are appended. Two patch
+// elements with the same key are an error.
+func mergeByListSource(
+	src []byte,
+	tuple *hclsyntax.TupleConsExpr,
+	key string,
+	elements []keyedElement,
+) ([]byte, error) {
+	existing := make(map[string]*hclsyntax.ObjectConsExpr)
+	for _, expr := range tuple.Exprs {
+		obj, ok := expr.(*hclsyntax.ObjectConsExpr)
+		if !ok {
+			continue
+		}
+		for _, item := range obj.Items {
+			if name, ok := objectKeyName(item.KeyExpr); ok && name == key {
+				elementKey := compactSource(item.ValueExpr.Range().SliceBytes(src))
+				if _, seen := existing[elementKey]; !seen {
+					existing[elementKey] = obj
+				}
+			}
+		}
+	}
+
+	var edits []models.SourceEdit
+	var appended []string
+	seen := make(map[string]bool, len(elements))
+	for _, element := range elements {
+		if seen[element.key] {
+			return nil, fmt.Errorf("the patch lists the same key twice")
+		}
+		seen[element.key] = true
+
+		obj, matched := existing[element.key]
+		if !matched {
+			appended = append(appended, element.text)
+			continue
+		}
+		merged, err := mergeObjectSource(src, obj, element.items, models.StrategyMerge)
+		if err != nil {
+			return nil, err
+		}
+		edits = append(edits, models.SourceEdit{Start: obj.SrcRange.Start.Byte, End: obj.SrcRange.End.Byte, Text: merged})
+	}
+
+	merged := models.ApplySourceEdits(src, tuple.SrcRange.Start.Byte, tuple.SrcRange.End.Byte, edits)
+	if len(appended) == 0 {
+		return merged, nil
+	}
+	parsed, diags := hclsyntax.ParseExpression(merged, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("the merged list is not valid HCL: %s", diags.Error())
+	}
+	mergedTuple, ok := parsed.(*hclsyntax.TupleConsExpr)
+	if !ok {
+		return nil, fmt.Errorf("the merged list is not valid HCL")
+	}
+	return appendListSource(merged, mergedTuple, appended), nil
+}
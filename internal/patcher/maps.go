@@ -0,0 +1,171 @@
+package patcher
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// mapAttribute applies a map strategy: merge, shallow_merge, defaults or
+// delete_keys. Object literals are edited in place, keeping the order,
+// formatting and comments of the keys that stay. Any other expression, such as
+// local.tags, is wrapped in a call to merge or a for expression that computes
+// the patched map when Terraform evaluates it. nested holds the strategy
+// markers nested in an object patch.
+func mapAttribute(
+	body *hclwrite.Body,
+	name string,
+	strategy models.MergeStrategy,
+	value interface{},
+	nested map[string]*models.NestedMarker,
+) error {
+	items, isObjectPatch := objectPatchFor(value, nested)
+	nestedMarkers := isObjectPatch && hasNestedMarkers(items)
+
+	existingAttr := body.GetAttribute(name)
+	if existingAttr == nil && !nestedMarkers {
+		if strategy == models.StrategyDeleteKeys {
+			return nil
+		}
+		return replaceAttribute(body, name, value)
+	}
+
+	var src []byte
+	var parsed hclsyntax.Expression
+	if existingAttr != nil {
+		var ok bool
+		if src, parsed, ok = parseExpressionSource(existingAttr.Expr()); !ok {
+			return fmt.Errorf("cannot %s %s: the existing value cannot be parsed", strategy, name)
+		}
+	}
+	if parsed == nil || nestedMarkers && isNullLiteral(parsed) {
+		// Nested markers are applied to an empty object.
+		src = []byte("{}")
+		parsed, _ = hclsyntax.ParseExpression(src, "", hcl.InitialPos)
+	}
+
+	if obj, isObject := parsed.(*hclsyntax.ObjectConsExpr); isObject {
+		if strategy == models.StrategyDeleteKeys {
+			keys, ok := deletedKeys(value)
+			if !ok {
+				return fmt.Errorf("cannot delete keys of %s: the patch must be a list of key names", name)
+			}
+			return setAttributeSource(body, name, deleteKeysSource(src, obj, keys))
+		}
+		if isObjectPatch {
+			merged, err := mergeObjectSource(src, obj, items, strategy)
+			if err != nil {
+				return fmt.Errorf("cannot %s %s: %w", strategy, name, err)
+			}
+			return setAttributeSource(body, name, merged)
+		}
+	}
+	if nestedMarkers {
+		return fmt.Errorf("cannot %s %s: nested strategies need the existing value to be an object literal",
+			strategy, name)
+	}
+
+	// A literal that is not a map, such as null or a version constraint that a
+	// provider requirement object replaces, has no keys to merge with.
+	if existing, diags := parsed.Value(nil); !diags.HasErrors() && existing.IsWhollyKnown() &&
+		!isMergeableValue(existing) {
+		switch {
+		case strategy == models.StrategyMerge, strategy == models.StrategyShallowMerge:
+			return replaceAttribute(body, name, value)
+		case strategy == models.StrategyDefaults && existing.IsNull():
+			return replaceAttribute(body, name, value)
+		default:
+			return nil
+		}
+	}
+
+	wrapped := mapExpressionSource(parsed.Range().SliceBytes(src), strategy, value)
+	return setAttributeSource(body, name, wrapped)
+}
+
+// mapExpressionSource wraps the source of an existing map expression so that
+// it evaluates to the patched map. Terraform's merge function is shallow, so
+// merge behaves as shallow_merge on computed maps.
+func mapExpressionSource(existing []byte, strategy models.MergeStrategy, value interface{}) []byte {
+	mapSrc := string(bytes.TrimSpace(existing))
+	patch := string(bytes.TrimSpace(valueToTokens(value).Bytes()))
+
+	switch strategy {
+	case models.StrategyDefaults:
+		return []byte(fmt.Sprintf("merge(%s, %s)", patch, mapSrc))
+	case models.StrategyDeleteKeys:
+		return []byte(fmt.Sprintf("{ for k, v in %s : k => v if !contains(%s, k) }", mapSrc, patch))
+	default:
+		return []byte(fmt.Sprintf("merge(%s, %s)", mapSrc, patch))
+	}
+}
+
+// deletedKeys returns the key names of a delete_keys patch.
+func deletedKeys(value interface{}) ([]string, bool) {
+	val, ok := value.(cty.Value)
+	if !ok || val.IsNull() || !val.IsWhollyKnown() {
+		return nil, false
+	}
+	if ty := val.Type(); !ty.IsTupleType() && !ty.IsListType() && !ty.IsSetType() {
+		return nil, false
+	}
+
+	keys := make([]string, 0, val.LengthInt())
+	for _, key := range val.AsValueSlice() {
+		if key.IsNull() || key.Type() != cty.String {
+			return nil, false
+		}
+		keys = append(keys, key.AsString())
+	}
+	return keys, true
+}
+
+// deleteKeysSource returns the source of obj without the given keys. Items on
+// lines of their own are removed with their line, so the comments of the
+// others are kept; objects that share lines between items are rewritten.
+func deleteKeysSource(src []byte, obj *hclsyntax.ObjectConsExpr, keys []string) []byte {
+	start, end := obj.SrcRange.Start.Byte, obj.SrcRange.End.Byte
+	remove := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		remove[key] = true
+	}
+
+	var edits []models.SourceEdit
+	var kept []string
+	ownLines := true
+	for _, item := range obj.Items {
+		itemStart, itemEnd := item.KeyExpr.Range().Start.Byte, item.ValueExpr.Range().End.Byte
+		key, ok := objectKeyName(item.KeyExpr)
+		if !ok || !remove[key] {
+			kept = append(kept, string(src[itemStart:itemEnd]))
+			continue
+		}
+		edit, ownLine := removeLineEdit(src, start, itemStart, itemEnd)
+		ownLines = ownLines && ownLine
+		edits = append(edits, edit)
+	}
+
+	switch {
+	case len(edits) == 0:
+		return src[start:end]
+	case ownLines:
+		return models.ApplySourceEdits(src, start, end, edits)
+	case len(kept) == 0:
+		return []byte("{}")
+	case bytes.ContainsRune(src[start:end], '\n'):
+		return []byte("{\n" + strings.Join(kept, "\n") + "\n}")
+	default:
+		return []byte("{ " + strings.Join(kept, ", ") + " }")
+	}
+}
+
+func isNullLiteral(expr hclsyntax.Expression) bool {
+	literal, ok := expr.(*hclsyntax.LiteralValueExpr)
+	return ok && literal.Val.IsNull()
+}
@@ -0,0 +1,292 @@
+package patcher
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// MovedFileName is the file that moved blocks are generated into, next to
+// the resources whose address was changed.
+const MovedFileName = "kungfu_moved.tf"
+
+// repetition is how a resource declares its instances.
+type repetition int
+
+const (
+	repetitionNone repetition = iota
+	repetitionCount
+	repetitionForEach
+)
+
+func (r repetition) String() string {
+	switch r {
+	case repetitionCount:
+		return "count"
+	case repetitionForEach:
+		return "for_each"
+	default:
+		return "no repetition"
+	}
+}
+
+func repetitionOf(body *hclwrite.Body) repetition {
+	switch {
+	case body.GetAttribute("count") != nil:
+		return repetitionCount
+	case body.GetAttribute("for_each") != nil:
+		return repetitionForEach
+	default:
+		return repetitionNone
+	}
+}
+
+// resourceMove tracks how the patches of a module change the address of a
+// single resource.
+type resourceMove struct {
+	dir      string
+	resource *models.Resource
+	name     string
+	before   repetition
+	rename   string
+	keys     []string
+}
+
+// moveTracker records the resources touched by patches, before they are
+// patched, so that moved blocks can be generated once all patches applied.
+type moveTracker struct {
+	moves map[string]*resourceMove
+	order []string
+}
+
+func newMoveTracker() *moveTracker {
+	return &moveTracker{moves: make(map[string]*resourceMove)}
+}
+
+// record registers that patch is about to be applied to target. It must be
+// called before the patch changes the resource.
+func (t *moveTracker) record(target patchTarget, patch models.Patch) {
+	dir := filepath.Dir(target.path)
+	key := dir + "\x00" + models.ResourceKey(target.resource.Type, target.resource.Name)
+	move, exists := t.moves[key]
+	if !exists {
+		move = &resourceMove{
+			dir:      dir,
+			resource: target.resource,
+			name:     target.resource.Name,
+			before:   repetitionOf(target.resource.Block.Body()),
+		}
+		t.moves[key] = move
+		t.order = append(t.order, key)
+	}
+	if patch.Rename != "" {
+		move.rename = patch.Rename
+	}
+	if patch.InstanceKeys != nil {
+		move.keys = patch.InstanceKeys
+	}
+}
+
+// finish renames resources and returns the moves their new addresses need,
+// together with warnings about address changes that cannot be moved.
+func (t *moveTracker) finish(files map[string]*models.HCLFile) ([]models.ResourceMove, []string, error) {
+	var moves []models.ResourceMove
+	var warnings []string
+	for _, key := range t.order {
+		move := t.moves[key]
+		if move.rename != "" {
+			if err := renameResource(files, move.dir, move.resource, move.rename); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		resourceMoves, warning, err := move.addresses()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to move %s: %w",
+				models.ResourceKey(move.resource.Type, move.name), err)
+		}
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+		moves = append(moves, resourceMoves...)
+	}
+	return moves, warnings, nil
+}
+
+// addresses returns the moves from the resource's upstream address to its
+// patched one. Switching between count and for_each needs the instance keys
+// to pair up instances; without them, only a warning is returned.
+func (m *resourceMove) addresses() ([]models.ResourceMove, string, error) {
+	resourceType := m.resource.Type
+	after := repetitionOf(m.resource.Block.Body())
+	from := models.ResourceKey(resourceType, m.name)
+	to := models.ResourceKey(resourceType, m.resource.Name)
+
+	if m.before == after {
+		if len(m.keys) > 0 {
+			return nil, "", fmt.Errorf("instance_keys is set but the resource keeps using %s", after)
+		}
+		if from == to {
+			return nil, "", nil
+		}
+		return []models.ResourceMove{{File: m.movedFile(), From: from, To: to}}, "", nil
+	}
+
+	usesForEach := m.before == repetitionForEach || after == repetitionForEach
+	if !usesForEach && len(m.keys) > 0 {
+		return nil, "", fmt.Errorf("instance_keys is set but the resource does not use for_each")
+	}
+	if usesForEach && len(m.keys) == 0 {
+		return nil, fmt.Sprintf(
+			"changing %s from %s to %s changes the address of its instances; set instance_keys to generate moved blocks",
+			from, m.before, after), nil
+	}
+
+	count := 1
+	if usesForEach {
+		single := m.before == repetitionNone || after == repetitionNone
+		if single && len(m.keys) != 1 {
+			return nil, "", fmt.Errorf("instance_keys must list a single key, the resource has a single instance")
+		}
+		count = len(m.keys)
+	}
+
+	moves := make([]models.ResourceMove, 0, count)
+	for i := 0; i < count; i++ {
+		moves = append(moves, models.ResourceMove{
+			File: m.movedFile(),
+			From: from + instanceKey(m.before, i, m.keys),
+			To:   to + instanceKey(after, i, m.keys),
+		})
+	}
+
+	warning := ""
+	if m.before == repetitionNone {
+		warning = fmt.Sprintf(
+			"adding %s to %s changes its address; references to it elsewhere in the module are not updated",
+			after, from)
+	}
+	return moves, warning, nil
+}
+
+func (m *resourceMove) movedFile() string {
+	return filepath.Join(m.dir, MovedFileName)
+}
+
+// instanceKey returns the index suffix of the i-th instance of a resource.
+func instanceKey(rep repetition, i int, keys []string) string {
+	switch rep {
+	case repetitionCount:
+		return fmt.Sprintf("[%d]", i)
+	case repetitionForEach:
+		return fmt.Sprintf("[%s]", hclwrite.TokensForValue(cty.StringVal(keys[i])).Bytes())
+	default:
+		return ""
+	}
+}
+
+// renameResource renames a resource and every reference to it in the files
+// of its directory.
+func renameResource(files map[string]*models.HCLFile, dir string, resource *models.Resource, name string) error {
+	oldKey := models.ResourceKey(resource.Type, resource.Name)
+	newKey := models.ResourceKey(resource.Type, name)
+
+	var dirFiles []*models.HCLFile
+	for _, filePath := range sortedPaths(files) {
+		if filepath.Dir(filePath) != dir {
+			continue
+		}
+		if _, exists := files[filePath].Resources[newKey]; exists {
+			return fmt.Errorf("cannot rename %s to %s: a resource with that name already exists", oldKey, newKey)
+		}
+		dirFiles = append(dirFiles, files[filePath])
+	}
+
+	search := []string{resource.Type, resource.Name}
+	replacement := []string{resource.Type, name}
+	for _, file := range dirFiles {
+		renameReferences(file.WriteFile.Body(), search, replacement)
+		if owned, exists := file.Resources[oldKey]; exists && owned == resource {
+			delete(file.Resources, oldKey)
+			file.Resources[newKey] = resource
+		}
+	}
+
+	resource.Block.SetLabels([]string{resource.Type, name})
+	resource.Name = name
+	return nil
+}
+
+// renameReferences rewrites the references with the search prefix in every
+// expression of body. The from address of existing moved blocks is kept, so
+// that moves declared upstream still apply.
+func renameReferences(body *hclwrite.Body, search, replacement []string) {
+	for _, attr := range body.Attributes() {
+		attr.Expr().RenameVariablePrefix(search, replacement)
+	}
+	for _, block := range body.Blocks() {
+		if block.Type() == "moved" {
+			if to := block.Body().GetAttribute("to"); to != nil {
+				to.Expr().RenameVariablePrefix(search, replacement)
+			}
+			continue
+		}
+		renameReferences(block.Body(), search, replacement)
+	}
+}
+
+// addMovedFiles adds the files of moved blocks that moves are declared in
+// to files.
+func addMovedFiles(files map[string]*models.HCLFile, moves []models.ResourceMove) error {
+	byFile := make(map[string][]models.ResourceMove)
+	for _, move := range moves {
+		byFile[move.File] = append(byFile[move.File], move)
+	}
+
+	movedPaths := make([]string, 0, len(byFile))
+	for movedPath := range byFile {
+		movedPaths = append(movedPaths, movedPath)
+	}
+	sort.Strings(movedPaths)
+
+	for _, movedPath := range movedPaths {
+		if _, exists := files[movedPath]; exists {
+			return fmt.Errorf("cannot generate moved blocks: %s already exists", movedPath)
+		}
+
+		file := hclwrite.NewEmptyFile()
+		for i, move := range byFile[movedPath] {
+			if i > 0 {
+				file.Body().AppendNewline()
+			}
+			block := file.Body().AppendNewBlock("moved", nil)
+			if err := setAddress(block.Body(), "from", move.From); err != nil {
+				return err
+			}
+			if err := setAddress(block.Body(), "to", move.To); err != nil {
+				return err
+			}
+		}
+		files[movedPath] = &models.HCLFile{
+			Path:      movedPath,
+			WriteFile: file,
+			Resources: make(map[string]*models.Resource),
+		}
+	}
+	return nil
+}
+
+func setAddress(body *hclwrite.Body, name, address string) error {
+	traversal, diags := hclsyntax.ParseTraversalAbs([]byte(address), "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return fmt.Errorf("invalid resource address %q: %s", address, diags.Error())
+	}
+	body.SetAttributeTraversal(name, traversal)
+	return nil
+}
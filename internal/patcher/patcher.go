@@ -2,6 +2,8 @@ package patcher
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/dragonfleas/kungfu/internal/models"
 	"github.com/hashicorp/hcl/v2"
@@ -11,163 +13,402 @@ import (
 )
 
 func ApplyPatches(files map[string]*models.HCLFile, patches []models.Patch) (map[string]*models.HCLFile, error) {
-	patchedFiles := make(map[string]*models.HCLFile)
-	for path, file := range files {
-		patchedFiles[path] = file
+	result, err := ApplyPatchesWithChanges(files, patches)
+	if err != nil {
+		return nil, err
 	}
+	return result.Files, nil
+}
 
-	for _, patch := range patches {
-		if err := applyPatch(patchedFiles, patch); err != nil {
-			return nil, fmt.Errorf("failed to apply patch for %s.%s: %w",
-				patch.ResourceType, patch.ResourceName, err)
-		}
+// Result is the outcome of applying a set of patches to a module.
+type Result struct {
+	Files   map[string]*models.HCLFile
+	Applied []models.AppliedPatch
+	// Moves are the moved blocks generated for resources whose address was
+	// changed, declared in files added to Files.
+	Moves    []models.ResourceMove
+	Warnings []string
+}
+
+// ApplyPatchesWithChanges applies patches like ApplyPatches and additionally
+// records every attribute that was changed. Patches are applied in ascending
+// priority order, so higher priorities win; patches with equal priority that
+// replace the same attribute with different values are reported as conflicts,
+// unless the overlay of one includes the overlay of the other.
+func ApplyPatchesWithChanges(files map[string]*models.HCLFile, patches []models.Patch) (*Result, error) {
+	result := &Result{
+		Files:   make(map[string]*models.HCLFile),
+		Applied: make([]models.AppliedPatch, 0, len(patches)),
+	}
+	for path, file := range files {
+		result.Files[path] = file
 	}
 
-	return patchedFiles, nil
-}
+	if err := checkPatchValues(patches); err != nil {
+		return nil, err
+	}
 
-func applyPatch(files map[string]*models.HCLFile, patch models.Patch) error {
-	resourceKey := models.ResourceKey(patch.ResourceType, patch.ResourceName)
+	ordered := orderPatches(patches)
+
+	tracker := newConflictTracker()
+	moves := newMoveTracker()
+	for _, patch := range ordered {
+		switch patch.Kind {
+		case models.PatchTerraform:
+			applied, err := applyTerraformPatch(result.Files, patch, tracker)
+			if err != nil {
+				return nil, fmt.Errorf("failed to apply patch for %s: %w", describeTarget(patch), err)
+			}
+			result.Applied = append(result.Applied, applied...)
+			continue
+		case models.PatchCheck, models.PatchRemoved:
+			applied, err := applyModuleBlockPatch(result.Files, patch, tracker)
+			if err != nil {
+				return nil, fmt.Errorf("failed to apply patch for %s: %w", describeTarget(patch), err)
+			}
+			result.Applied = append(result.Applied, applied)
+			continue
+		case models.PatchProvider:
+			applied, warnings, err := applyProviderPatch(result.Files, patch, tracker)
+			if err != nil {
+				return nil, fmt.Errorf("failed to apply patch for %s: %w", describeTarget(patch), err)
+			}
+			result.Applied = append(result.Applied, applied...)
+			result.Warnings = append(result.Warnings, warnings...)
+			continue
+		}
 
-	var targetResource *models.Resource
+		targets := findTargets(result.Files, patch)
+		if len(targets) == 0 {
+			if patch.ModuleWide {
+				continue
+			}
+			if !isSelector(patch) {
+				return nil, fmt.Errorf("resource %s not found in any file", describeTarget(patch))
+			}
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("patch for %s matched no resources", describeTarget(patch)))
+			continue
+		}
 
-	for _, file := range files {
-		if resource, exists := file.Resources[resourceKey]; exists {
-			targetResource = resource
-			break
+		for _, target := range targets {
+			if !matchesConditions(patch, target.resource) {
+				continue
+			}
+
+			moves.record(target, patch)
+			applied, warnings, err := applyPatch(target, patch, tracker)
+			if err != nil {
+				return nil, fmt.Errorf("failed to apply patch for %s: %w",
+					models.ResourceKey(target.resource.Type, target.resource.Name), err)
+			}
+			result.Applied = append(result.Applied, applied)
+			result.Warnings = append(result.Warnings, warnings...)
 		}
 	}
+	result.Warnings = append(result.Warnings, tracker.warnings...)
 
-	if targetResource == nil {
-		return fmt.Errorf("resource %s not found in any file", resourceKey)
+	resourceMoves, warnings, err := moves.finish(result.Files)
+	if err != nil {
+		return nil, err
+	}
+	if err := addMovedFiles(result.Files, resourceMoves); err != nil {
+		return nil, err
 	}
+	result.Moves = resourceMoves
+	result.Warnings = append(result.Warnings, warnings...)
 
-	resourceBody := targetResource.Block.Body()
-	for attrName, patchAttr := range patch.Attributes {
-		if err := applyAttribute(resourceBody, attrName, patchAttr); err != nil {
-			return fmt.Errorf("failed to apply attribute %s: %w", attrName, err)
+	return result, nil
+}
+
+// orderPatches returns patches sorted by ascending priority. Within a
+// priority, patches keep their declaration order, except that a patch is
+// moved after the patches of the overlays its overlay includes, so that it
+// overrides them.
+func orderPatches(patches []models.Patch) []models.Patch {
+	ordered := make([]models.Patch, len(patches))
+	copy(ordered, patches)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Priority < ordered[j].Priority
+	})
+
+	for start := 0; start < len(ordered); {
+		end := start + 1
+		for end < len(ordered) && ordered[end].Priority == ordered[start].Priority {
+			end++
 		}
+		orderByIncludes(ordered[start:end])
+		start = end
 	}
+	return ordered
+}
 
-	return nil
+// orderByIncludes reorders group so that every patch comes after the patches
+// of the overlays its overlay includes, keeping the order of the others.
+func orderByIncludes(group []models.Patch) {
+	pending := make([]models.Patch, len(group))
+	copy(pending, group)
+	for i := range group {
+		next := 0
+		for j, candidate := range pending {
+			if !includesAny(candidate, pending) {
+				next = j
+				break
+			}
+		}
+		group[i] = pending[next]
+		pending = append(pending[:next], pending[next+1:]...)
+	}
 }
 
-func applyAttribute(body *hclwrite.Body, name string, patchAttr *models.PatchAttribute) error {
-	switch patchAttr.Strategy {
-	case models.StrategyReplace:
-		return replaceAttribute(body, name, patchAttr.Value)
-	case models.StrategyMerge:
-		return mergeAttribute(body, name, patchAttr.Value)
-	case models.StrategyAppend:
-		return appendAttribute(body, name, patchAttr.Value)
-	default:
-		return fmt.Errorf("unknown merge strategy: %d", patchAttr.Strategy)
+// includesAny reports whether the overlay of patch includes the overlay of
+// any of others.
+func includesAny(patch models.Patch, others []models.Patch) bool {
+	for _, other := range others {
+		if overrides(patch, other) {
+			return true
+		}
 	}
+	return false
 }
 
-func replaceAttribute(body *hclwrite.Body, name string, value interface{}) error {
-	body.RemoveAttribute(name)
-	tokens := valueToTokens(value)
-	body.SetAttributeRaw(name, tokens)
-	return nil
+// overrides reports whether the overlay declaring a includes the one
+// declaring b, so that a is applied after b and wins over it.
+func overrides(a, b models.Patch) bool {
+	return b.Range.Filename != "" && b.Range.Filename != a.Range.Filename && a.Includes[b.Range.Filename]
 }
 
-func mergeAttribute(body *hclwrite.Body, name string, value interface{}) error {
-	existingAttr := body.GetAttribute(name)
-	if existingAttr == nil {
-		return replaceAttribute(body, name, value)
+func applyPatch(
+	target patchTarget,
+	patch models.Patch,
+	tracker *conflictTracker,
+) (models.AppliedPatch, []string, error) {
+	resource := target.resource
+	resourceKey := models.ResourceKey(resource.Type, resource.Name)
+
+	result := models.AppliedPatch{
+		Source:       patch.Source,
+		ResourceType: resource.Type,
+		ResourceName: resource.Name,
+		File:         target.path,
+		Attributes:   make([]models.AttributeChange, 0, len(patch.Attributes)),
 	}
 
-	existingVal := extractValue(*existingAttr.Expr())
-	mergedVal := DeepMerge(existingVal, value)
-
-	body.RemoveAttribute(name)
-	tokens := valueToTokens(mergedVal)
-	body.SetAttributeRaw(name, tokens)
-	return nil
-}
+	resourceBody := resource.Block.Body()
+	warnings := switchRepetition(resourceKey, resourceBody, patch)
 
-func appendAttribute(body *hclwrite.Body, name string, value interface{}) error {
-	existingAttr := body.GetAttribute(name)
-	if existingAttr == nil {
-		return replaceAttribute(body, name, value)
+	if patch.Rename != "" {
+		renameAttr := &models.PatchAttribute{Value: cty.StringVal(patch.Rename), Strategy: models.StrategyReplace}
+		if err := tracker.claim(resourceKey, "rename", patch, renameAttr); err != nil {
+			return models.AppliedPatch{}, nil, err
+		}
+		before := resource.Name
+		result.Attributes = append(result.Attributes, models.AttributeChange{
+			Name:     "rename",
+			Strategy: models.StrategyReplace.String(),
+			Before:   &before,
+			After:    patch.Rename,
+		})
 	}
 
-	existingVal := extractValue(*existingAttr.Expr())
-	appendedVal := AppendToList(existingVal, value)
+	changes, err := applyBody(resourceBody, resourceKey, patch, tracker)
+	if err != nil {
+		return models.AppliedPatch{}, nil, err
+	}
+	result.Attributes = append(result.Attributes, changes...)
 
-	body.RemoveAttribute(name)
-	tokens := valueToTokens(appendedVal)
-	body.SetAttributeRaw(name, tokens)
-	return nil
+	return result, warnings, nil
 }
 
-// DeepMerge recursively merges two objects.
-func DeepMerge(existing interface{}, patch interface{}) interface{} {
-	existingCty, existingIsCty := existing.(cty.Value)
-	patchCty, patchIsCty := patch.(cty.Value)
-
-	if !existingIsCty || !patchIsCty {
-		return patch
+// applyBody applies the attributes and nested blocks of patch to body,
+// creating nested blocks that do not exist yet.
+func applyBody(
+	body *hclwrite.Body,
+	key string,
+	patch models.Patch,
+	tracker *conflictTracker,
+) ([]models.AttributeChange, error) {
+	changes, err := applyAttributes(body, key, "", patch.Attributes, patch, tracker)
+	if err != nil {
+		return nil, err
 	}
+	changes = append(changes, appendBlocks(body, "", patch.Added)...)
 
-	if !existingCty.Type().IsObjectType() || !patchCty.Type().IsObjectType() {
-		return patch
+	for _, blockType := range sortedBlockTypes(patch) {
+		block := body.FirstMatchingBlock(blockType, nil)
+		if block == nil {
+			block = body.AppendNewBlock(blockType, nil)
+		}
+		patchBlock := patch.Blocks[blockType]
+		blockChanges, err := applyAttributes(block.Body(), key, blockType+".",
+			patchBlock.Attributes, patch, tracker)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, blockChanges...)
+		changes = append(changes, appendBlocks(block.Body(), blockType+".", patchBlock.Added)...)
 	}
+	return changes, nil
+}
 
-	mergedMap := make(map[string]cty.Value)
+// applyAttributes applies attrs to body in overlay declaration order. prefix
+// qualifies attribute names in changes and conflicts, e.g. "lifecycle.".
+func applyAttributes(
+	body *hclwrite.Body,
+	resourceKey string,
+	prefix string,
+	attrs map[string]*models.PatchAttribute,
+	patch models.Patch,
+	tracker *conflictTracker,
+) ([]models.AttributeChange, error) {
+	changes := make([]models.AttributeChange, 0, len(attrs))
+	for _, attrName := range sortedAttributeNames(attrs) {
+		patchAttr := attrs[attrName]
+		if err := tracker.claim(resourceKey, prefix+attrName, patch, patchAttr); err != nil {
+			return nil, err
+		}
 
-	for key, val := range existingCty.AsValueMap() {
-		mergedMap[key] = val
-	}
+		before := attributeText(body, attrName)
+		if err := applyAttribute(body, attrName, patchAttr); err != nil {
+			return nil, fmt.Errorf("failed to apply attribute %s%s: %w", prefix, attrName, err)
+		}
+		after := attributeText(body, attrName)
 
-	for key, val := range patchCty.AsValueMap() {
-		existingVal, exists := mergedMap[key]
-		if !exists {
-			mergedMap[key] = val
-			continue
+		change := models.AttributeChange{
+			Name:     prefix + attrName,
+			Strategy: patchAttr.Strategy.String(),
+			Before:   before,
+		}
+		if after != nil {
+			change.After = *after
 		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
 
-		if !existingVal.Type().IsObjectType() || !val.Type().IsObjectType() {
-			mergedMap[key] = val
+// switchRepetition removes count from a resource when a patch sets for_each
+// on it, and the other way around, warning that uses of count.index or each
+// in the resource are not rewritten.
+func switchRepetition(resourceKey string, body *hclwrite.Body, patch models.Patch) []string {
+	var warnings []string
+	for _, pair := range [][2]string{{"count", "for_each"}, {"for_each", "count"}} {
+		name, other := pair[0], pair[1]
+		if _, patched := patch.Attributes[name]; !patched || body.GetAttribute(other) == nil {
 			continue
 		}
+		body.RemoveAttribute(other)
+		warnings = append(warnings, fmt.Sprintf(
+			"switching %s from %s to %s; uses of count.index and each in it are not rewritten",
+			resourceKey, other, name))
+	}
+	return warnings
+}
 
-		merged, ok := DeepMerge(existingVal, val).(cty.Value)
-		if ok {
-			mergedMap[key] = merged
-		} else {
-			mergedMap[key] = val
-		}
+// sortedBlockTypes returns the nested block types of a patch in lexical order.
+func sortedBlockTypes(patch models.Patch) []string {
+	types := make([]string, 0, len(patch.Blocks))
+	for blockType := range patch.Blocks {
+		types = append(types, blockType)
 	}
+	sort.Strings(types)
+	return types
+}
 
-	return cty.ObjectVal(mergedMap)
+// sortedPaths returns the paths of files in lexical order so that lookups
+// across files are deterministic.
+func sortedPaths(files map[string]*models.HCLFile) []string {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
 }
 
-// AppendToList appends elements from patch list to existing list.
-func AppendToList(existing interface{}, patch interface{}) interface{} {
-	existingCty, existingIsCty := existing.(cty.Value)
-	patchCty, patchIsCty := patch.(cty.Value)
+// sortedAttributeNames returns the names of attrs in overlay declaration
+// order, falling back to the name for attributes with equal order.
+func sortedAttributeNames(attrs map[string]*models.PatchAttribute) []string {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		orderI, orderJ := attrs[names[i]].Order, attrs[names[j]].Order
+		if orderI != orderJ {
+			return orderI < orderJ
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
 
-	if !existingIsCty || !patchIsCty {
-		return patch
+// attributeText returns the HCL source of an attribute's expression, or nil
+// when the body has no such attribute.
+func attributeText(body *hclwrite.Body, name string) *string {
+	attr := body.GetAttribute(name)
+	if attr == nil {
+		return nil
 	}
+	text := strings.TrimSpace(string(attr.Expr().BuildTokens(nil).Bytes()))
+	return &text
+}
 
-	if !existingCty.Type().IsTupleType() && !existingCty.Type().IsListType() {
-		return patch
+func applyAttribute(body *hclwrite.Body, name string, patchAttr *models.PatchAttribute) error {
+	value, err := models.NormalizeValue(patchAttr.Value)
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %w", name, err)
 	}
+	normalized := *patchAttr
+	normalized.Value = value
+	patchAttr = &normalized
 
-	if !patchCty.Type().IsTupleType() && !patchCty.Type().IsListType() {
-		return patch
+	if isDocumentStrategy(patchAttr.Strategy) {
+		if handled, err := applyToDocument(body, name, patchAttr); handled {
+			return err
+		}
+	}
+	return applyStrategy(body, name, patchAttr)
+}
+
+func applyStrategy(body *hclwrite.Body, name string, patchAttr *models.PatchAttribute) error {
+	switch patchAttr.Strategy {
+	case models.StrategyReplace:
+		return replaceAttribute(body, name, patchAttr.Value)
+	case models.StrategyMerge, models.StrategyShallowMerge, models.StrategyDefaults, models.StrategyDeleteKeys:
+		return mapAttribute(body, name, patchAttr.Strategy, patchAttr.Value, patchAttr.Nested)
+	case models.StrategyAppend, models.StrategyPrepend, models.StrategyRemove,
+		models.StrategyUnion, models.StrategyIndex:
+		return listAttribute(body, name, patchAttr.Strategy, patchAttr.Value)
+	case models.StrategyMergeBy:
+		return mergeByAttribute(body, name, patchAttr.MergeKey, patchAttr.Value)
+	case models.StrategyPrefix, models.StrategySuffix:
+		return affixAttribute(body, name, patchAttr.Strategy, patchAttr.Value)
+	case models.StrategyRegexReplace:
+		return regexReplaceAttribute(body, name, patchAttr.Pattern, patchAttr.Value)
+	case models.StrategyTemplate:
+		return templateAttribute(body, name, patchAttr.Value, patchAttr.Functions)
+	default:
+		return fmt.Errorf("unknown merge strategy: %d", patchAttr.Strategy)
 	}
+}
 
-	existingList := existingCty.AsValueSlice()
-	patchList := patchCty.AsValueSlice()
+// replaceAttribute sets the attribute expression in place, keeping the position of
+// an existing attribute and appending new attributes to the end of the body.
+func replaceAttribute(body *hclwrite.Body, name string, value interface{}) error {
+	tokens := valueToTokens(value)
+	body.SetAttributeRaw(name, tokens)
+	return nil
+}
 
-	merged := make([]cty.Value, 0, len(existingList)+len(patchList))
-	merged = append(merged, existingList...)
-	merged = append(merged, patchList...)
-	return cty.TupleVal(merged)
+// referenceLists are the meta-arguments holding lists of references. Adding
+// to them skips references that are already listed.
+func referenceLists() map[string]bool {
+	return map[string]bool{
+		"depends_on":           true,
+		"ignore_changes":       true,
+		"replace_triggered_by": true,
+	}
 }
 
 func extractValue(expr hclwrite.Expression) interface{} {
@@ -186,32 +427,3 @@ func extractValue(expr hclwrite.Expression) interface{} {
 
 	return val
 }
-
-func valueToTokens(value interface{}) hclwrite.Tokens {
-	switch v := value.(type) {
-	case cty.Value:
-		return hclwrite.TokensForValue(v)
-	case hclsyntax.Expression:
-		exprBytes := v.Range().SliceBytes(v.Range().SliceBytes([]byte{}))
-		if len(exprBytes) > 0 {
-			return hclwrite.TokensForIdentifier(string(exprBytes))
-		}
-		return hclwrite.TokensForValue(cty.StringVal(""))
-	case string:
-		return hclwrite.TokensForValue(cty.StringVal(v))
-	case int:
-		return hclwrite.TokensForValue(cty.NumberIntVal(int64(v)))
-	case int32:
-		return hclwrite.TokensForValue(cty.NumberIntVal(int64(v)))
-	case int64:
-		return hclwrite.TokensForValue(cty.NumberIntVal(v))
-	case float32:
-		return hclwrite.TokensForValue(cty.NumberFloatVal(float64(v)))
-	case float64:
-		return hclwrite.TokensForValue(cty.NumberFloatVal(v))
-	case bool:
-		return hclwrite.TokensForValue(cty.BoolVal(v))
-	default:
-		return hclwrite.TokensForValue(cty.StringVal(fmt.Sprintf("%v", v)))
-	}
-}
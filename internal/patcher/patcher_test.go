@@ -1,12 +1,22 @@
 package patcher_test
 
 import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/dragonfleas/kungfu/internal/parser"
 	"github.com/dragonfleas/kungfu/internal/patcher"
 	"github.com/dragonfleas/kungfu/internal/testutil"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/tryfunc"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
 	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
 )
 
 func TestApplyPatches_ReplaceStrategy(t *testing.T) {
@@ -110,61 +120,1651 @@ func TestApplyPatches_ResourceNotFound(t *testing.T) {
 	_, err := patcher.ApplyPatches(files, []models.Patch{patch})
 
 	if err == nil {
-		t.Error("expected error for nonexistent resource")
+		t.Fatal("expected error for nonexistent resource")
+	}
+	if expected := "resource aws_instance.nonexistent not found in any file"; err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestApplyPatches_GoValues(t *testing.T) {
+	content := `resource "aws_instance" "web" {
+  tags = {
+    Name = "web"
+  }
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	patch := models.Patch{
+		ResourceType: "aws_instance",
+		ResourceName: "web",
+		Attributes: map[string]*models.PatchAttribute{
+			"tags":            {Value: map[string]string{"Owner": "team"}, Strategy: models.StrategyMerge},
+			"security_groups": {Value: []string{"sg-1"}, Strategy: models.StrategyReplace, Order: 1},
+		},
+	}
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := `resource "aws_instance" "web" {
+  tags = {
+    Name  = "web"
+    Owner = "team"
+  }
+  security_groups = ["sg-1"]
+}`
+	if output := string(result[tfFile].WriteFile.Bytes()); output != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, output)
+	}
+}
+
+func TestApplyPatches_InvalidValues(t *testing.T) {
+	tests := map[string]interface{}{
+		"unknown":  cty.UnknownVal(cty.String),
+		"function": func() {},
+	}
+
+	for name, value := range tests {
+		t.Run(name, func(t *testing.T) {
+			files, _ := testutil.SetupTerraformFile(t, `resource "aws_instance" "web" {
+  ami = "ami-123"
+}`)
+			patch := models.Patch{
+				ResourceType: "aws_instance",
+				ResourceName: "web",
+				Attributes: map[string]*models.PatchAttribute{
+					"instance_type": {Value: value, Strategy: models.StrategyReplace},
+				},
+			}
+			if _, err := patcher.ApplyPatches(files, []models.Patch{patch}); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func replacePatch(name, instanceType string, priority int) models.Patch {
+	return models.Patch{
+		ResourceType: "aws_instance",
+		ResourceName: "web",
+		Priority:     priority,
+		Range:        hcl.Range{Filename: name + ".kf.hcl", Start: hcl.Pos{Line: 1}},
+		Attributes: map[string]*models.PatchAttribute{
+			"instance_type": {
+				Value:    cty.StringVal(instanceType),
+				Strategy: models.StrategyReplace,
+			},
+		},
+	}
+}
+
+func TestApplyPatches_ResourceArgumentNamedPriority(t *testing.T) {
+	content := `resource "aws_lb_listener_rule" "api" {
+  listener_arn = var.listener_arn
+  priority     = 10
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	patch := parseSinglePatch(t, `patch "aws_lb_listener_rule" "api" {
+  priority = 100
+}`)
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := `resource "aws_lb_listener_rule" "api" {
+  listener_arn = var.listener_arn
+  priority     = 100
+}`
+	if output := string(result[tfFile].WriteFile.Bytes()); output != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, output)
+	}
+}
+
+func TestApplyPatches_ConflictingReplace(t *testing.T) {
+	content := `resource "aws_instance" "web" {
+  instance_type = "t3.micro"
+}`
+
+	files, _ := testutil.SetupTerraformFile(t, content)
+
+	patches := []models.Patch{
+		replacePatch("team-a", "t3.large", 0),
+		replacePatch("team-b", "t3.xlarge", 0),
+	}
+
+	_, err := patcher.ApplyPatches(files, patches)
+
+	if err == nil || !strings.Contains(err.Error(), "conflicting patches") {
+		t.Errorf("expected conflict error, got %v", err)
+	}
+}
+
+func TestApplyPatches_ConflictingReplaceAcrossMerge(t *testing.T) {
+	content := `resource "aws_instance" "web" {
+  instance_type = "t3.micro"
+}`
+
+	files, _ := testutil.SetupTerraformFile(t, content)
+
+	merge := replacePatch("team-b", "", 0)
+	merge.Attributes["instance_type"] = &models.PatchAttribute{
+		Value:    cty.ObjectVal(map[string]cty.Value{"size": cty.StringVal("large")}),
+		Strategy: models.StrategyMerge,
+	}
+	patches := []models.Patch{
+		replacePatch("team-a", "t3.large", 0),
+		merge,
+		replacePatch("team-c", "t3.xlarge", 0),
+	}
+
+	_, err := patcher.ApplyPatches(files, patches)
+
+	if err == nil || !strings.Contains(err.Error(), "team-a.kf.hcl") || !strings.Contains(err.Error(), "team-c.kf.hcl") {
+		t.Errorf("expected conflict error between team-a and team-c, got %v", err)
+	}
+}
+
+func TestApplyPatches_IdenticalReplaceIsNotConflict(t *testing.T) {
+	content := `resource "aws_instance" "web" {
+  instance_type = "t3.micro"
+}`
+
+	files, _ := testutil.SetupTerraformFile(t, content)
+
+	patches := []models.Patch{
+		replacePatch("team-a", "t3.large", 0),
+		replacePatch("team-b", "t3.large", 0),
+	}
+
+	if _, err := patcher.ApplyPatches(files, patches); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestApplyPatches_PriorityResolvesConflict(t *testing.T) {
+	content := `resource "aws_instance" "web" {
+  instance_type = "t3.micro"
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	patches := []models.Patch{
+		replacePatch("team-a", "t3.xlarge", 10),
+		replacePatch("team-b", "t3.large", 0),
+	}
+
+	result, err := patcher.ApplyPatches(files, patches)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	output := string(result[tfFile].WriteFile.Bytes())
+	if !strings.Contains(output, `"t3.xlarge"`) {
+		t.Errorf("expected higher priority value to win, got:\n%s", output)
+	}
+}
+
+func TestApplyPatches_IncludingOverlayOverrides(t *testing.T) {
+	content := `resource "aws_instance" "web" {
+  instance_type = "t3.micro"
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	prod := replacePatch("prod", "m5.large", 0)
+	prod.Includes = map[string]bool{"base.kf.hcl": true}
+	patches := []models.Patch{
+		prod,
+		replacePatch("base", "t3.large", 0),
+	}
+
+	result, err := patcher.ApplyPatches(files, patches)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	output := string(result[tfFile].WriteFile.Bytes())
+	if !strings.Contains(output, `"m5.large"`) {
+		t.Errorf("expected including overlay to override its base, got:\n%s", output)
+	}
+}
+
+func TestApplyPatches_SiblingOverlaysConflict(t *testing.T) {
+	content := `resource "aws_instance" "web" {
+  instance_type = "t3.micro"
+}`
+
+	files, _ := testutil.SetupTerraformFile(t, content)
+
+	prod := replacePatch("prod", "m5.large", 0)
+	prod.Includes = map[string]bool{"base.kf.hcl": true}
+	patches := []models.Patch{
+		replacePatch("base", "t3.medium", 0),
+		prod,
+		replacePatch("staging", "t3.large", 0),
+	}
+
+	_, err := patcher.ApplyPatches(files, patches)
+
+	if err == nil || !strings.Contains(err.Error(), "prod.kf.hcl") || !strings.Contains(err.Error(), "staging.kf.hcl") {
+		t.Errorf("expected conflict error between prod and staging, got %v", err)
+	}
+}
+
+func TestApplyPatchesWithChanges_MergeCollisionWarns(t *testing.T) {
+	content := `resource "aws_instance" "web" {
+  tags = {
+    Name = "web"
+  }
+}`
+
+	files, _ := testutil.SetupTerraformFile(t, content)
+
+	tagPatch := func(key string) models.Patch {
+		return models.Patch{
+			ResourceType: "aws_instance",
+			ResourceName: "web",
+			Attributes: map[string]*models.PatchAttribute{
+				"tags": {
+					Value:    cty.ObjectVal(map[string]cty.Value{key: cty.StringVal("x")}),
+					Strategy: models.StrategyMerge,
+				},
+			},
+		}
+	}
+
+	result, err := patcher.ApplyPatchesWithChanges(files, []models.Patch{tagPatch("Owner"), tagPatch("Team")})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if len(result.Warnings) != 1 {
+		t.Errorf("expected 1 collision warning, got %v", result.Warnings)
+	}
+}
+
+func TestApplyPatches_ReplacePreservesPosition(t *testing.T) {
+	content := `resource "aws_instance" "web" {
+  ami           = "ami-123"
+  instance_type = "t3.micro"
+  monitoring    = false
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	patch := replacePatch("team-a", "t3.large", 0)
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	output := string(result[tfFile].WriteFile.Bytes())
+	if strings.Index(output, "instance_type") > strings.Index(output, "monitoring") {
+		t.Errorf("expected instance_type to keep its position, got:\n%s", output)
+	}
+}
+
+func TestApplyPatches_NewAttributesInDeclarationOrder(t *testing.T) {
+	content := `resource "aws_instance" "web" {
+  ami = "ami-123"
+}`
+
+	names := []string{"zone", "monitoring", "ebs_optimized", "architecture"}
+	attributes := make(map[string]*models.PatchAttribute, len(names))
+	for i, name := range names {
+		attributes[name] = &models.PatchAttribute{
+			Value:    cty.True,
+			Strategy: models.StrategyReplace,
+			Order:    i,
+		}
+	}
+
+	patch := models.Patch{
+		ResourceType: "aws_instance",
+		ResourceName: "web",
+		Attributes:   attributes,
+	}
+
+	var outputs []string
+	for range 5 {
+		files, tfFile := testutil.SetupTerraformFile(t, content)
+		result, err := patcher.ApplyPatches(files, []models.Patch{patch})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		outputs = append(outputs, string(result[tfFile].WriteFile.Bytes()))
+	}
+
+	last := -1
+	for _, name := range names {
+		index := strings.Index(outputs[0], name)
+		if index < last {
+			t.Fatalf("expected attributes in declaration order, got:\n%s", outputs[0])
+		}
+		last = index
+	}
+
+	for _, output := range outputs[1:] {
+		if output != outputs[0] {
+			t.Fatalf("expected identical output across runs, got:\n%s\nand:\n%s", outputs[0], output)
+		}
+	}
+}
+
+func TestApplyPatches_MergePreservesCommentsAndKeyOrder(t *testing.T) {
+	content := `resource "aws_instance" "web" {
+  tags = {
+    # Name is set by the module
+    Name = var.name
+    Env  = "dev" # default
+  }
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	patch := models.Patch{
+		ResourceType: "aws_instance",
+		ResourceName: "web",
+		Attributes: map[string]*models.PatchAttribute{
+			"tags": {
+				Value: cty.ObjectVal(map[string]cty.Value{
+					"Env":   cty.StringVal("prod"),
+					"Owner": cty.StringVal("team"),
+				}),
+				Strategy: models.StrategyMerge,
+			},
+		},
+	}
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	output := string(result[tfFile].WriteFile.Bytes())
+	for _, expected := range []string{"# Name is set by the module", "var.name", `"prod" # default`, "Owner"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, output)
+		}
+	}
+	if strings.Index(output, "Name") > strings.Index(output, "Env") {
+		t.Errorf("expected original key order to be preserved, got:\n%s", output)
+	}
+}
+
+func TestApplyPatches_AppendPreservesComments(t *testing.T) {
+	content := `resource "aws_instance" "web" {
+  security_groups = [
+    "sg-default", # managed by the module
+  ]
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	patch := models.Patch{
+		ResourceType: "aws_instance",
+		ResourceName: "web",
+		Attributes: map[string]*models.PatchAttribute{
+			"security_groups": {
+				Value:    cty.TupleVal([]cty.Value{cty.StringVal("sg-new")}),
+				Strategy: models.StrategyAppend,
+			},
+		},
+	}
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	output := string(result[tfFile].WriteFile.Bytes())
+	if !strings.Contains(output, "# managed by the module") || !strings.Contains(output, `"sg-new",`) {
+		t.Errorf("expected comment to be kept and element appended, got:\n%s", output)
+	}
+}
+
+func TestApplyPatches_WildcardMatchesAllResources(t *testing.T) {
+	content := `resource "aws_s3_bucket" "logs" {
+  bucket = "logs"
+}
+
+resource "aws_s3_bucket" "data" {
+  bucket = "data"
+}
+
+resource "aws_instance" "web" {
+  ami = "ami-123"
+}`
+
+	files, _ := testutil.SetupTerraformFile(t, content)
+
+	patch := models.Patch{
+		ResourceType: "aws_s3_bucket",
+		ResourceName: "*",
+		Attributes: map[string]*models.PatchAttribute{
+			"force_destroy": {
+				Value:    cty.False,
+				Strategy: models.StrategyReplace,
+			},
+		},
+	}
+
+	result, err := patcher.ApplyPatchesWithChanges(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if len(result.Applied) != 2 {
+		t.Errorf("expected 2 patched resources, got %d", len(result.Applied))
+	}
+}
+
+func TestApplyPatches_ProviderSelector(t *testing.T) {
+	content := `resource "aws_s3_bucket" "logs" {
+  bucket = "logs"
+}
+
+resource "google_storage_bucket" "logs" {
+  name = "logs"
+}`
+
+	files, _ := testutil.SetupTerraformFile(t, content)
+
+	patch := models.Patch{
+		Provider: "aws",
+		Attributes: map[string]*models.PatchAttribute{
+			"tags": {
+				Value:    cty.ObjectVal(map[string]cty.Value{"Owner": cty.StringVal("team")}),
+				Strategy: models.StrategyMerge,
+			},
+		},
+	}
+
+	result, err := patcher.ApplyPatchesWithChanges(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if len(result.Applied) != 1 || result.Applied[0].ResourceType != "aws_s3_bucket" {
+		t.Errorf("expected only the aws resource to be patched, got %+v", result.Applied)
+	}
+}
+
+func TestApplyPatches_SelectorWithoutMatchesWarns(t *testing.T) {
+	content := `resource "aws_instance" "web" {
+  ami = "ami-123"
+}`
+
+	files, _ := testutil.SetupTerraformFile(t, content)
+
+	patch := models.Patch{
+		ResourceType: "aws_s3_bucket",
+		ResourceName: "*",
+		Attributes:   map[string]*models.PatchAttribute{},
+	}
+
+	result, err := patcher.ApplyPatchesWithChanges(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if len(result.Warnings) != 1 {
+		t.Errorf("expected 1 warning, got %v", result.Warnings)
+	}
+}
+
+func TestApplyPatches_WhereConditions(t *testing.T) {
+	content := `resource "aws_instance" "tagged" {
+  instance_type = "m5.large"
+  tags = {
+    Name  = var.name
+    Owner = "team"
+  }
+}
+
+resource "aws_instance" "untagged" {
+  instance_type = "m5.xlarge"
+  tags = {
+    Name = var.name
+  }
+}
+
+resource "aws_instance" "small" {
+  instance_type = "t3.micro"
+}`
+
+	files, _ := testutil.SetupTerraformFile(t, content)
+
+	patch := models.Patch{
+		ResourceType: "aws_instance",
+		ResourceName: "*",
+		Where: []models.Condition{
+			{Attribute: "instance_type", Operator: models.ConditionPrefix, Value: cty.StringVal("m5")},
+			{Attribute: "tags", Operator: models.ConditionLacksKey, Value: cty.StringVal("Owner")},
+		},
+		Attributes: map[string]*models.PatchAttribute{
+			"tags": {
+				Value:    cty.ObjectVal(map[string]cty.Value{"Owner": cty.StringVal("platform")}),
+				Strategy: models.StrategyMerge,
+			},
+		},
+	}
+
+	result, err := patcher.ApplyPatchesWithChanges(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if len(result.Applied) != 1 || result.Applied[0].ResourceName != "untagged" {
+		t.Errorf("expected only the untagged m5 instance to be patched, got %+v", result.Applied)
+	}
+}
+
+func TestApplyPatches_WhereAbsentBlock(t *testing.T) {
+	content := `resource "aws_s3_bucket" "versioned" {
+  versioning {
+    enabled = true
+  }
+}
+
+resource "aws_s3_bucket" "plain" {
+  bucket = "plain"
+}`
+
+	files, _ := testutil.SetupTerraformFile(t, content)
+
+	patch := models.Patch{
+		ResourceType: "aws_s3_bucket",
+		ResourceName: "*",
+		Where: []models.Condition{
+			{Attribute: "versioning", Operator: models.ConditionPresent, Value: cty.False},
+		},
+		Attributes: map[string]*models.PatchAttribute{
+			"force_destroy": {Value: cty.False, Strategy: models.StrategyReplace},
+		},
+	}
+
+	result, err := patcher.ApplyPatchesWithChanges(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if len(result.Applied) != 1 || result.Applied[0].ResourceName != "plain" {
+		t.Errorf("expected only the unversioned bucket to be patched, got %+v", result.Applied)
+	}
+}
+
+func parseSinglePatch(t *testing.T, content string) models.Patch {
+	t.Helper()
+	config, _ := testutil.WriteAndParseKungfuFile(t, content)
+	if len(config.Patches) != 1 {
+		t.Fatalf("expected 1 patch, got %d", len(config.Patches))
+	}
+	return config.Patches[0]
+}
+
+func TestApplyPatches_LifecycleAndMetaArguments(t *testing.T) {
+	content := `resource "aws_s3_bucket" "data" {
+  bucket     = "data"
+  depends_on = [aws_iam_role.reader]
+
+  lifecycle {
+    ignore_changes = [
+      tags, # set by the tagging pipeline
+    ]
+  }
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	patch := parseSinglePatch(t, `patch "aws_s3_bucket" "data" {
+  provider   = aws.us_east_1
+  depends_on = kf::append([aws_iam_role.reader, aws_kms_key.data])
+
+  lifecycle {
+    prevent_destroy = true
+    ignore_changes  = kf::append([tags, bucket])
+  }
+}`)
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	output := string(result[tfFile].WriteFile.Bytes())
+	for _, want := range []string{
+		"provider = aws.us_east_1",
+		"depends_on = [aws_iam_role.reader, aws_kms_key.data]",
+		"prevent_destroy = true",
+		"# set by the tagging pipeline",
+		"bucket,",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, output)
+		}
+	}
+	if strings.Count(output, "tags") != 1 {
+		t.Errorf("expected existing ignore_changes entry not to be duplicated, got:\n%s", output)
+	}
+	if strings.Count(output, "lifecycle") != 1 {
+		t.Errorf("expected existing lifecycle block to be patched, got:\n%s", output)
+	}
+}
+
+func TestApplyPatchesWithChanges_AddingCount(t *testing.T) {
+	content := `resource "aws_s3_bucket" "data" {
+  bucket = "data"
+}
+
+resource "aws_s3_bucket" "logs" {
+  for_each = var.buckets
+  bucket   = each.key
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	patch := parseSinglePatch(t, `patch "aws_s3_bucket" "data" {
+  count = var.create ? 1 : 0
+}`)
+
+	result, err := patcher.ApplyPatchesWithChanges(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !strings.Contains(string(result.Files[tfFile].WriteFile.Bytes()), "count  = var.create ? 1 : 0") {
+		t.Errorf("expected count to be added verbatim, got:\n%s", result.Files[tfFile].WriteFile.Bytes())
+	}
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "changes its address") {
+		t.Errorf("expected address change warning, got %v", result.Warnings)
+	}
+
+	want := []models.ResourceMove{{
+		File: filepath.Join(filepath.Dir(tfFile), patcher.MovedFileName),
+		From: "aws_s3_bucket.data",
+		To:   "aws_s3_bucket.data[0]",
+	}}
+	if !reflect.DeepEqual(result.Moves, want) {
+		t.Errorf("expected moves %v, got %v", want, result.Moves)
+	}
+}
+
+func TestApplyPatchesWithChanges_RenameResource(t *testing.T) {
+	content := `resource "aws_s3_bucket" "this" {
+  bucket = "data"
+}
+
+resource "aws_s3_bucket_policy" "this" {
+  bucket = aws_s3_bucket.this.id
+  policy = data.aws_iam_policy_document.this.json
+}
+
+moved {
+  from = aws_s3_bucket.old
+  to   = aws_s3_bucket.this
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	rename := parseSinglePatch(t, `patch "aws_s3_bucket" "this" {
+  kungfu {
+    rename = "data"
+  }
+}`)
+	tags := parseSinglePatch(t, `patch "aws_s3_bucket" "this" {
+  tags = { Team = "platform" }
+}`)
+
+	result, err := patcher.ApplyPatchesWithChanges(files, []models.Patch{rename, tags})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	output := string(result.Files[tfFile].WriteFile.Bytes())
+	for _, want := range []string{
+		`resource "aws_s3_bucket" "data" {`,
+		"bucket = aws_s3_bucket.data.id",
+		"from = aws_s3_bucket.old",
+		"to   = aws_s3_bucket.data",
+		`Team = "platform"`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, output)
+		}
+	}
+	if _, exists := result.Files[tfFile].Resources["aws_s3_bucket.data"]; !exists {
+		t.Error("expected renamed resource to be indexed under its new name")
+	}
+
+	movedFile := result.Files[filepath.Join(filepath.Dir(tfFile), patcher.MovedFileName)]
+	if movedFile == nil {
+		t.Fatal("expected moved blocks file to be generated")
+	}
+	moved := string(movedFile.WriteFile.Bytes())
+	if !strings.Contains(moved, "from = aws_s3_bucket.this") || !strings.Contains(moved, "to   = aws_s3_bucket.data") {
+		t.Errorf("unexpected moved blocks:\n%s", moved)
 	}
 }
 
-func TestDeepMerge_PreservesOriginalKeys(t *testing.T) {
-	existing := cty.ObjectVal(map[string]cty.Value{
-		"Name": cty.StringVal("web"),
-		"Env":  cty.StringVal("prod"),
-	})
+func TestApplyPatchesWithChanges_SwitchCountToForEach(t *testing.T) {
+	content := `resource "aws_subnet" "private" {
+  count      = 2
+  cidr_block = var.cidrs[count.index]
+}`
 
-	patchVal := cty.ObjectVal(map[string]cty.Value{
-		"Owner": cty.StringVal("team"),
-	})
+	files, tfFile := testutil.SetupTerraformFile(t, content)
 
-	result := patcher.DeepMerge(existing, patchVal)
-	resultVal := result.(cty.Value)
-	resultMap := resultVal.AsValueMap()
+	patch := parseSinglePatch(t, `patch "aws_subnet" "private" {
+  for_each = var.cidrs_by_zone
+
+  kungfu {
+    instance_keys = ["a", "b"]
+  }
+}`)
+
+	result, err := patcher.ApplyPatchesWithChanges(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if strings.Contains(string(result.Files[tfFile].WriteFile.Bytes()), "count ") {
+		t.Errorf("expected count to be removed, got:\n%s", result.Files[tfFile].WriteFile.Bytes())
+	}
 
-	if len(resultMap) != 3 {
-		t.Errorf("expected 3 keys, got %d", len(resultMap))
+	var addresses []string
+	for _, move := range result.Moves {
+		addresses = append(addresses, move.From+" -> "+move.To)
+	}
+	want := []string{
+		`aws_subnet.private[0] -> aws_subnet.private["a"]`,
+		`aws_subnet.private[1] -> aws_subnet.private["b"]`,
+	}
+	if !reflect.DeepEqual(addresses, want) {
+		t.Errorf("expected moves %v, got %v", want, addresses)
 	}
 }
 
-func TestDeepMerge_OverridesConflictingKeys(t *testing.T) {
-	existing := cty.ObjectVal(map[string]cty.Value{
-		"Name": cty.StringVal("old"),
-	})
+func TestApplyPatchesWithChanges_MoveErrors(t *testing.T) {
+	content := `resource "aws_s3_bucket" "data" {
+  bucket = "data"
+}
 
-	patchVal := cty.ObjectVal(map[string]cty.Value{
-		"Name": cty.StringVal("new"),
-	})
+resource "aws_s3_bucket" "logs" {
+  bucket = "logs"
+}`
 
-	result := patcher.DeepMerge(existing, patchVal)
-	resultVal := result.(cty.Value)
-	resultMap := resultVal.AsValueMap()
+	tests := map[string]string{
+		"rename to existing resource": `patch "aws_s3_bucket" "data" {
+  kungfu {
+    rename = "logs"
+  }
+}`,
+		"instance keys without for_each": `patch "aws_s3_bucket" "data" {
+  count = 1
+
+  kungfu {
+    instance_keys = ["a"]
+  }
+}`,
+		"several instance keys for a single instance": `patch "aws_s3_bucket" "data" {
+  for_each = var.buckets
+
+  kungfu {
+    instance_keys = ["a", "b"]
+  }
+}`,
+	}
 
-	if resultMap["Name"].AsString() != "new" {
-		t.Errorf("expected 'new', got %s", resultMap["Name"].AsString())
+	for name, overlay := range tests {
+		t.Run(name, func(t *testing.T) {
+			files, _ := testutil.SetupTerraformFile(t, content)
+			if _, err := patcher.ApplyPatches(files, []models.Patch{parseSinglePatch(t, overlay)}); err == nil {
+				t.Error("expected error")
+			}
+		})
 	}
 }
 
-func TestAppendToList_PreservesOriginal(t *testing.T) {
-	existing := cty.TupleVal([]cty.Value{
-		cty.StringVal("one"),
-	})
+func TestApplyPatches_TerraformBlock(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "modules", "nested"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	mainFile := testutil.WriteTestFile(t, dir, "main.tf", `resource "aws_s3_bucket" "data" {
+  bucket = "data"
+}`)
+	versionsFile := testutil.WriteTestFile(t, dir, "versions.tf", `terraform {
+  required_version = ">= 1.0"
+
+  required_providers {
+    aws = {
+      source  = "hashicorp/aws" # pinned upstream
+      version = "~> 4.0"
+    }
+  }
+}`)
+	nestedFile := testutil.WriteTestFile(t, filepath.Join(dir, "modules", "nested"), "versions.tf", `terraform {
+  required_providers {
+    aws = {
+      source  = "hashicorp/aws"
+      version = "< 5.0"
+    }
+  }
+}`)
+
+	files := make(map[string]*models.HCLFile)
+	for _, path := range []string{mainFile, versionsFile, nestedFile} {
+		parsed, err := parser.ParseHCLFile(path)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", path, err)
+		}
+		files[path] = parsed
+	}
+
+	patch := parseSinglePatch(t, `patch "terraform" {
+  required_version = ">= 1.5"
+
+  required_providers {
+    aws    = kf::merge({ version = ">= 5.0" })
+    random = { source = "hashicorp/random", version = ">= 3.0" }
+  }
+}`)
+
+	result, err := patcher.ApplyPatchesWithChanges(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	versions := string(result.Files[versionsFile].WriteFile.Bytes())
+	for _, want := range []string{
+		`required_version = ">= 1.5"`,
+		`source  = "hashicorp/aws" # pinned upstream`,
+		`version = ">= 5.0"`,
+		`source  = "hashicorp/random"`,
+	} {
+		if !strings.Contains(versions, want) {
+			t.Errorf("expected versions.tf to contain %q, got:\n%s", want, versions)
+		}
+	}
+
+	nested := string(result.Files[nestedFile].WriteFile.Bytes())
+	if !strings.Contains(nested, `version = ">= 5.0"`) || strings.Contains(nested, "random") {
+		t.Errorf("expected nested module to only relax its aws pin, got:\n%s", nested)
+	}
+	if strings.Contains(string(result.Files[mainFile].WriteFile.Bytes()), "terraform") {
+		t.Error("expected no terraform block to be added to main.tf")
+	}
+	if len(result.Applied) != 2 || result.Applied[0].ResourceType != "terraform" {
+		t.Errorf("expected terraform patch to be applied to 2 files, got %+v", result.Applied)
+	}
+}
+
+func TestApplyPatches_TerraformBlockCreated(t *testing.T) {
+	files, tfFile := testutil.SetupTerraformFile(t, `resource "aws_s3_bucket" "data" {
+  bucket = "data"
+}`)
+
+	patch := parseSinglePatch(t, `patch "terraform" {
+  required_providers {
+    aws = { source = "hashicorp/aws", version = ">= 5.0" }
+  }
+}`)
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	output := string(result[tfFile].WriteFile.Bytes())
+	if !strings.Contains(output, "terraform {\n  required_providers {\n    aws = {") {
+		t.Errorf("expected terraform block to be created, got:\n%s", output)
+	}
+}
+
+func TestApplyPatches_ProviderBlocks(t *testing.T) {
+	content := `provider "aws" {
+  region = "us-west-2"
+
+  default_tags {
+    tags = {
+      Module = "legacy" # set upstream
+    }
+  }
+}
+
+provider "aws" {
+  alias  = "replica"
+  region = "eu-west-1"
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	tags := parseSinglePatch(t, `patch "provider" "aws" {
+  default_tags {
+    tags = kf::merge({ Team = "platform" })
+  }
+}`)
+	replica := parseSinglePatch(t, `patch "provider" "aws.replica" {
+  region = "eu-central-1"
+
+  assume_role {
+    role_arn = "arn:aws:iam::123456789012:role/replication"
+  }
+}`)
+
+	result, err := patcher.ApplyPatchesWithChanges(files, []models.Patch{tags, replica})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	output := string(result.Files[tfFile].WriteFile.Bytes())
+	for _, want := range []string{
+		`region = "us-west-2"`,
+		`Module = "legacy" # set upstream`,
+		`region = "eu-central-1"`,
+		"assume_role {",
+		`role_arn = "arn:aws:iam::123456789012:role/replication"`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, output)
+		}
+	}
+	if strings.Count(output, "Team") != 2 {
+		t.Errorf("expected default tags to be added to both configurations, got:\n%s", output)
+	}
+	if len(result.Applied) != 3 || result.Applied[2].ResourceName != "aws.replica" {
+		t.Errorf("unexpected applied patches: %+v", result.Applied)
+	}
+}
+
+func TestApplyPatches_RemoveProviderBlock(t *testing.T) {
+	versions := `terraform {
+  required_providers {
+    aws = {
+      source  = "hashicorp/aws"
+      version = ">= 5.0"
+    }
+  }
+}
+
+provider "aws" {
+  alias  = "replica"
+  region = "eu-west-1"
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, versions)
+
+	remove := parseSinglePatch(t, `patch "provider" "aws.replica" {
+  remove = true
+}`)
+	aliases := parseSinglePatch(t, `patch "terraform" {
+  required_providers {
+    aws = kf::merge({ configuration_aliases = [aws.replica] })
+  }
+}`)
+
+	result, err := patcher.ApplyPatchesWithChanges(files, []models.Patch{remove, aliases})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	output := string(result.Files[tfFile].WriteFile.Bytes())
+	if strings.Contains(output, "provider \"aws\"") {
+		t.Errorf("expected provider block to be removed, got:\n%s", output)
+	}
+	for _, want := range []string{`source                = "hashicorp/aws"`, "configuration_aliases = [aws.replica]"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, output)
+		}
+	}
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "configuration_aliases") {
+		t.Errorf("expected warning about the removed alias, got %v", result.Warnings)
+	}
+}
+
+func TestApplyPatches_ConditionsAndChecks(t *testing.T) {
+	content := `resource "aws_s3_bucket" "this" {
+  bucket = var.bucket
+}
+
+check "bucket_name" {
+  assert {
+    condition     = length(var.bucket) > 3
+    error_message = "Bucket names must be longer than 3 characters."
+  }
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	postcondition := parseSinglePatch(t, `patch "aws_s3_bucket" "this" {
+  lifecycle {
+    postcondition {
+      condition     = self.acl == "private"
+      error_message = "Buckets must be private."
+    }
+  }
+}`)
+	existingCheck := parseSinglePatch(t, `patch "check" "bucket_name" {
+  assert {
+    condition     = !startswith(var.bucket, "tmp-")
+    error_message = "Temporary buckets are not allowed."
+  }
+}`)
+	newCheck := parseSinglePatch(t, `patch "check" "bucket_encrypted" {
+  data "aws_s3_bucket" "this" {
+    bucket = aws_s3_bucket.this.id
+  }
+
+  assert {
+    condition     = data.aws_s3_bucket.this.bucket_regional_domain_name != ""
+    error_message = "Bucket must exist."
+  }
+}`)
+
+	result, err := patcher.ApplyPatchesWithChanges(files, []models.Patch{postcondition, existingCheck, newCheck})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	output := string(result.Files[tfFile].WriteFile.Bytes())
+	for _, want := range []string{
+		"  lifecycle {\n    postcondition {\n      condition     = self.acl == \"private\"",
+		`error_message = "Temporary buckets are not allowed."`,
+		"check \"bucket_encrypted\" {\n  data \"aws_s3_bucket\" \"this\" {\n    bucket = aws_s3_bucket.this.id",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, output)
+		}
+	}
+	if strings.Count(output, "check \"bucket_name\"") != 1 || strings.Count(output, "assert {") != 3 {
+		t.Errorf("expected assert to be added to the existing check, got:\n%s", output)
+	}
+
+	change := result.Applied[0].Attributes[0]
+	if change.Name != "lifecycle.postcondition" || change.Strategy != "append" {
+		t.Errorf("unexpected change: %+v", change)
+	}
+	data := result.Applied[2].Attributes[0]
+	if !strings.HasPrefix(data.After, "data \"aws_s3_bucket\" \"this\" {\n  bucket = aws_s3_bucket.this.id") {
+		t.Errorf("expected the added data block to be reported formatted, got %q", data.After)
+	}
+}
+
+func TestApplyPatches_RemovedBlocks(t *testing.T) {
+	content := `removed {
+  from = aws_s3_bucket.legacy
+
+  lifecycle {
+    destroy = true
+  }
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	keep := parseSinglePatch(t, `patch "removed" {
+  from = aws_s3_bucket.legacy
+
+  lifecycle {
+    destroy = false
+  }
+}`)
+	added := parseSinglePatch(t, `patch "removed" {
+  from = module.logging
+
+  lifecycle {
+    destroy = false
+  }
+}`)
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{keep, added})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	output := string(result[tfFile].WriteFile.Bytes())
+	if strings.Contains(output, "destroy = true") || strings.Count(output, "destroy = false") != 2 {
+		t.Errorf("expected both removed blocks to keep their resources, got:\n%s", output)
+	}
+	if strings.Count(output, "removed {") != 2 || !strings.Contains(output, "from = module.logging") {
+		t.Errorf("expected a removed block to be added for module.logging, got:\n%s", output)
+	}
+}
+
+func TestApplyPatches_RemovedDeclaredConfiguration(t *testing.T) {
+	content := `resource "aws_s3_bucket" "legacy" {
+  bucket = "legacy"
+}
+
+module "logging" {
+  source = "./modules/logging"
+}`
+
+	tests := map[string]string{
+		"resource":    "aws_s3_bucket.legacy",
+		"module call": "module.logging",
+	}
+
+	for name, from := range tests {
+		t.Run(name, func(t *testing.T) {
+			files, _ := testutil.SetupTerraformFile(t, content)
+			patch := parseSinglePatch(t, "patch \"removed\" {\n  from = "+from+"\n}")
+
+			_, err := patcher.ApplyPatches(files, []models.Patch{patch})
+			if err == nil || !strings.Contains(err.Error(), "still declares") {
+				t.Errorf("expected error for removing declared configuration, got %v", err)
+			}
+		})
+	}
+}
+
+func TestApplyPatches_ListStrategiesOnLiterals(t *testing.T) {
+	content := `resource "aws_security_group_rule" "web" {
+  security_groups = [
+    "sg-default", # managed by the module
+    "sg-legacy",
+  ]
+  actions     = ["s3:GetObject", "s3:ListBucket"]
+  subnet_ids  = ["subnet-a", "subnet-b", "subnet-c"]
+  cidr_blocks = ["10.0.0.0/8", "0.0.0.0/0", "192.168.0.0/16"]
+  depends_on  = [aws_iam_role.app]
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	patch := parseSinglePatch(t, `patch "aws_security_group_rule" "web" {
+  security_groups = kf::prepend(["sg-first"])
+  actions         = kf::union(["s3:ListBucket", "s3:PutObject", "s3:PutObject"])
+  subnet_ids      = kf::at({ 0 = "subnet-x", 2 = aws_subnet.z.id })
+  cidr_blocks     = kf::remove(["0.0.0.0/0"])
+  depends_on      = kf::remove([aws_iam_role.app])
+}`)
+	legacy := parseSinglePatch(t, `patch "aws_security_group_rule" "web" {
+  security_groups = kf::remove(["sg-legacy"])
+}`)
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{patch, legacy})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := `resource "aws_security_group_rule" "web" {
+  security_groups = [
+    "sg-first",
+    "sg-default", # managed by the module
+  ]
+  actions     = ["s3:GetObject", "s3:ListBucket", "s3:PutObject"]
+  subnet_ids  = ["subnet-x", "subnet-b", aws_subnet.z.id]
+  cidr_blocks = ["10.0.0.0/8", "192.168.0.0/16"]
+  depends_on  = []
+}`
+	if output := string(result[tfFile].WriteFile.Bytes()); output != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, output)
+	}
+}
+
+func TestApplyPatches_ListStrategiesOnExpressions(t *testing.T) {
+	content := `resource "aws_instance" "web" {
+  vpc_security_group_ids = var.security_group_ids
+  subnet_ids             = concat(var.private_subnets, var.public_subnets)
+  actions                = local.actions
+  cidr_blocks            = var.cidr_blocks
+  zones                  = var.zones
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	patch := parseSinglePatch(t, `patch "aws_instance" "web" {
+  vpc_security_group_ids = kf::union([aws_security_group.audit.id])
+  subnet_ids             = kf::prepend(["subnet-a"])
+  actions                = kf::append(["s3:PutObject"])
+  cidr_blocks            = kf::remove(["0.0.0.0/0"])
+  zones                  = kf::at({ 1 = "eu-west-1b" })
+}`)
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := `resource "aws_instance" "web" {
+  vpc_security_group_ids = concat(var.security_group_ids, [for v in [aws_security_group.audit.id] : v if !contains(var.security_group_ids, v)])
+  subnet_ids             = concat(["subnet-a"], concat(var.private_subnets, var.public_subnets))
+  actions                = concat(local.actions, ["s3:PutObject"])
+  cidr_blocks            = [for v in var.cidr_blocks : v if !contains(["0.0.0.0/0"], v)]
+  zones                  = [for i, v in var.zones : i == 1 ? "eu-west-1b" : v]
+}`
+	if output := string(result[tfFile].WriteFile.Bytes()); output != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, output)
+	}
+}
+
+func TestApplyPatches_UnionOnComputedListKeepsDuplicates(t *testing.T) {
+	files, tfFile := testutil.SetupTerraformFile(t, `resource "aws_instance" "web" {
+  vpc_security_group_ids = var.security_group_ids
+}`)
+
+	patch := parseSinglePatch(t, `patch "aws_instance" "web" {
+  vpc_security_group_ids = kf::union(["sg-a", "sg-b"])
+}`)
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := `resource "aws_instance" "web" {
+  vpc_security_group_ids = concat(var.security_group_ids, [for v in ["sg-a", "sg-b"] : v if !contains(var.security_group_ids, v)])
+}`
+	if output := string(result[tfFile].WriteFile.Bytes()); output != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, output)
+	}
+
+	src := result[tfFile].WriteFile.Body().Blocks()[0].Body().GetAttribute("vpc_security_group_ids").Expr().BuildTokens(nil).Bytes()
+	expr, diags := hclsyntax.ParseExpression(src, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		t.Fatalf("generated expression is not valid HCL: %s", diags.Error())
+	}
+	ctx := &hcl.EvalContext{
+		Variables: map[string]cty.Value{"var": cty.ObjectVal(map[string]cty.Value{
+			"security_group_ids": cty.TupleVal([]cty.Value{cty.StringVal("sg-a"), cty.StringVal("sg-a")}),
+		})},
+		Functions: map[string]function.Function{
+			"concat":   stdlib.ConcatFunc,
+			"contains": stdlib.ContainsFunc,
+		},
+	}
+	got, diags := expr.Value(ctx)
+	if diags.HasErrors() {
+		t.Fatalf("failed to evaluate %s: %s", src, diags.Error())
+	}
+
+	// The patch skips sg-a, which the list contains, but the list keeps its
+	// own duplicate.
+	want := cty.TupleVal([]cty.Value{cty.StringVal("sg-a"), cty.StringVal("sg-a"), cty.StringVal("sg-b")})
+	if !got.RawEquals(want) {
+		t.Errorf("expected %#v, got %#v", want, got)
+	}
+}
+
+func TestApplyPatches_ListStrategyErrors(t *testing.T) {
+	tests := map[string]string{
+		"index out of range": `patch "aws_instance" "web" {
+  subnet_ids = kf::at({ 3 = "subnet-d" })
+}`,
+		"index of missing attribute": `patch "aws_instance" "web" {
+  zones = kf::at({ 0 = "eu-west-1a" })
+}`,
+		"reference list expression": `patch "aws_instance" "web" {
+  depends_on = kf::union([aws_iam_role.app])
+}`,
+	}
+
+	for name, patchContent := range tests {
+		t.Run(name, func(t *testing.T) {
+			files, _ := testutil.SetupTerraformFile(t, `resource "aws_instance" "web" {
+  subnet_ids = ["subnet-a"]
+  depends_on = local.dependencies
+}`)
+			patch := parseSinglePatch(t, patchContent)
+			if _, err := patcher.ApplyPatches(files, []models.Patch{patch}); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestApplyPatches_MapStrategiesOnLiterals(t *testing.T) {
+	content := `resource "aws_instance" "web" {
+  tags = {
+    Name  = "web"
+    Owner = "app-team" # set by the module
+    Debug = "true"
+  }
+  settings = {
+    logging = { level = "info", format = "json" }
+  }
+  labels = { env = "dev", tier = "web", legacy = "yes" }
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	patch := parseSinglePatch(t, `patch "aws_instance" "web" {
+  tags     = kf::defaults({ Owner = "platform", CostCenter = "1234" })
+  settings = kf::shallow_merge({ logging = { level = "debug" } })
+  labels   = kf::delete_keys(["legacy", "missing"])
+}`)
+	cleanup := parseSinglePatch(t, `patch "aws_instance" "web" {
+  tags = kf::delete_keys(["Debug"])
+}`)
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{patch, cleanup})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := `resource "aws_instance" "web" {
+  tags = {
+    Name       = "web"
+    Owner      = "app-team" # set by the module
+    CostCenter = "1234"
+  }
+  settings = {
+    logging = {
+      level = "debug"
+    }
+  }
+  labels = { env = "dev", tier = "web" }
+}`
+	if output := string(result[tfFile].WriteFile.Bytes()); output != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, output)
+	}
+}
+
+func TestApplyPatches_MapStrategiesOnExpressions(t *testing.T) {
+	content := `resource "aws_instance" "web" {
+  tags     = local.tags
+  labels   = var.labels
+  settings = merge(var.settings, { managed = true })
+  metadata = null
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	patch := parseSinglePatch(t, `patch "aws_instance" "web" {
+  tags     = kf::defaults({ Owner = "platform" })
+  labels   = kf::delete_keys(["legacy"])
+  settings = kf::merge({ debug = true })
+  metadata = kf::defaults({ team = "platform" })
+}`)
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := `resource "aws_instance" "web" {
+  tags = merge({
+    Owner = "platform"
+  }, local.tags)
+  labels = { for k, v in var.labels : k => v if !contains(["legacy"], k) }
+  settings = merge(merge(var.settings, { managed = true }), {
+    debug = true
+  })
+  metadata = {
+    team = "platform"
+  }
+}`
+	if output := string(result[tfFile].WriteFile.Bytes()); output != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, output)
+	}
+}
+
+func TestApplyPatches_MergeBy(t *testing.T) {
+	content := `resource "aws_s3_bucket_lifecycle_configuration" "this" {
+  rules = [
+    {
+      id     = "expire-logs" # keep in sync with the log bucket
+      status = "Enabled"
+      expiration = {
+        days = 30
+      }
+    },
+    {
+      id     = "abort-uploads"
+      status = "Enabled"
+    },
+  ]
+  ingress_rules = var.ingress_rules
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	patch := parseSinglePatch(t, `patch "aws_s3_bucket_lifecycle_configuration" "this" {
+  rules = kf::merge_by("id", [
+    { id = "expire-logs", expiration = { days = 90 } },
+    { id = "archive", status = "Enabled" },
+  ])
+  ingress_rules = kf::merge_by("name", [{ name = "https", cidr = "10.0.0.0/8", tags = { Owner = "security" } }])
+}`)
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := `resource "aws_s3_bucket_lifecycle_configuration" "this" {
+  rules = [
+    {
+      id     = "expire-logs" # keep in sync with the log bucket
+      status = "Enabled"
+      expiration = {
+        days = 90
+      }
+    },
+    {
+      id     = "abort-uploads"
+      status = "Enabled"
+    },
+    {
+      id     = "archive"
+      status = "Enabled"
+    },
+  ]
+  ingress_rules = concat([for e in var.ingress_rules : try({ ("https") = merge(e, { cidr = "10.0.0.0/8", name = "https", tags = try(merge(e.tags, { Owner = "security" }), { Owner = "security" }) }) }[e.name], e)], [for p in [{
+    cidr = "10.0.0.0/8"
+    name = "https"
+    tags = {
+      Owner = "security"
+    }
+  }] : p if !contains([for e in var.ingress_rules : e.name], p.name)])
+}`
+	if output := string(result[tfFile].WriteFile.Bytes()); output != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, output)
+	}
+}
+
+func TestApplyPatches_MergeByComputedListDeepMerges(t *testing.T) {
+	files, tfFile := testutil.SetupTerraformFile(t, `resource "aws_security_group" "this" {
+  ingress = var.ingress
+}`)
+
+	patch := parseSinglePatch(t, `patch "aws_security_group" "this" {
+  ingress = kf::merge_by("name", [
+    { name = "https", cidr = "10.0.0.0/8", tags = { Owner = "security" } },
+    { name = "ssh", cidr = "10.1.0.0/16" },
+  ])
+}`)
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	src := result[tfFile].WriteFile.Body().Blocks()[0].Body().GetAttribute("ingress").Expr().BuildTokens(nil).Bytes()
+	expr, diags := hclsyntax.ParseExpression(src, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		t.Fatalf("generated expression is not valid HCL: %s", diags.Error())
+	}
+	ctx := &hcl.EvalContext{
+		Variables: map[string]cty.Value{"var": cty.ObjectVal(map[string]cty.Value{
+			"ingress": cty.TupleVal([]cty.Value{
+				cty.ObjectVal(map[string]cty.Value{
+					"name": cty.StringVal("https"),
+					"cidr": cty.StringVal("0.0.0.0/0"),
+					"tags": cty.ObjectVal(map[string]cty.Value{"Team": cty.StringVal("web")}),
+				}),
+				cty.ObjectVal(map[string]cty.Value{"name": cty.StringVal("http"), "cidr": cty.StringVal("0.0.0.0/0")}),
+			}),
+		})},
+		Functions: map[string]function.Function{
+			"concat":   stdlib.ConcatFunc,
+			"contains": stdlib.ContainsFunc,
+			"merge":    stdlib.MergeFunc,
+			"try":      tryfunc.TryFunc,
+		},
+	}
+	got, diags := expr.Value(ctx)
+	if diags.HasErrors() {
+		t.Fatalf("failed to evaluate %s: %s", src, diags.Error())
+	}
 
-	patchVal := cty.TupleVal([]cty.Value{
-		cty.StringVal("two"),
+	want := cty.TupleVal([]cty.Value{
+		cty.ObjectVal(map[string]cty.Value{
+			"name": cty.StringVal("https"),
+			"cidr": cty.StringVal("10.0.0.0/8"),
+			"tags": cty.ObjectVal(map[string]cty.Value{
+				"Owner": cty.StringVal("security"),
+				"Team":  cty.StringVal("web"),
+			}),
+		}),
+		cty.ObjectVal(map[string]cty.Value{"name": cty.StringVal("http"), "cidr": cty.StringVal("0.0.0.0/0")}),
+		cty.ObjectVal(map[string]cty.Value{"name": cty.StringVal("ssh"), "cidr": cty.StringVal("10.1.0.0/16")}),
 	})
+	if !got.RawEquals(want) {
+		t.Errorf("expected %#v, got %#v", want, got)
+	}
+}
+
+func TestApplyPatches_StringStrategies(t *testing.T) {
+	content := `resource "aws_s3_bucket" "logs" {
+  bucket      = "logs"
+  name        = "${var.name}-logs"
+  description = var.description
+  policy_name = "app_policy_v1"
+  role_name   = local.role_name
+  kms_alias   = "alias/app"
+  region      = lower(var.region)
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	patch := parseSinglePatch(t, `patch "aws_s3_bucket" "logs" {
+  bucket      = kf::prefix("prod-")
+  name        = kf::suffix("-hardened")
+  description = kf::prefix("[managed] ")
+  policy_name = kf::regex_replace("_v[0-9]+$", "_v2")
+  role_name   = kf::regex_replace("^app-", "svc-")
+  kms_alias   = format("%s-prod", original)
+  region      = coalesce(original, "eu-west-1")
+  acl         = coalesce(original, "private")
+}`)
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
 
-	result := patcher.AppendToList(existing, patchVal)
-	resultVal := result.(cty.Value)
-	resultList := resultVal.AsValueSlice()
+	expected := `resource "aws_s3_bucket" "logs" {
+  bucket      = "prod-logs"
+  name        = "${var.name}-logs-hardened"
+  description = "[managed] ${var.description}"
+  policy_name = "app_policy_v2"
+  role_name   = replace(local.role_name, "/^app-/", "svc-")
+  kms_alias   = "alias/app-prod"
+  region      = coalesce(lower(var.region), "eu-west-1")
+  acl         = "private"
+}`
+	if output := string(result[tfFile].WriteFile.Bytes()); output != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, output)
+	}
+}
+
+func TestApplyPatches_StringStrategyOnMissingAttribute(t *testing.T) {
+	files, _ := testutil.SetupTerraformFile(t, `resource "aws_s3_bucket" "logs" {
+  bucket = "logs"
+}`)
+
+	patch := parseSinglePatch(t, `patch "aws_s3_bucket" "logs" {
+  name = kf::suffix("-hardened")
+}`)
+	if _, err := patcher.ApplyPatches(files, []models.Patch{patch}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestApplyPatches_Documents(t *testing.T) {
+	content := `resource "aws_iam_role_policy" "app" {
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect   = "Allow"
+        Action   = ["s3:GetObject"]
+        Resource = "*"
+      },
+    ]
+  })
+  assume_role_policy = <<EOF
+{"Version": "2012-10-17", "Statement": []}
+EOF
+  tags_json = "{\"team\": \"core\"}"
+  config    = yamlencode({ replicas = 1 })
+  template  = <<EOF
+{"bucket": "${var.bucket}"}
+EOF
+}`
+
+	files, tfFile := testutil.SetupTerraformFile(t, content)
+
+	patch := parseSinglePatch(t, `patch "aws_iam_role_policy" "app" {
+  policy = kf::merge({
+    Statement = kf::append([{ Effect = "Deny", Action = ["s3:DeleteObject"], Resource = "*" }])
+  })
+  assume_role_policy = kf::merge({ Statement = [{ Effect = "Allow" }] })
+  tags_json          = kf::merge({ env = "prod" })
+  config             = kf::merge({ replicas = 3 })
+  template           = kf::merge({ versioning = true })
+}`)
+
+	result, err := patcher.ApplyPatches(files, []models.Patch{patch})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
 
-	if len(resultList) != 2 {
-		t.Errorf("expected 2 items, got %d", len(resultList))
+	expected := `resource "aws_iam_role_policy" "app" {
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect   = "Allow"
+        Action   = ["s3:GetObject"]
+        Resource = "*"
+      },
+      {
+        Action   = ["s3:DeleteObject"]
+        Effect   = "Deny"
+        Resource = "*"
+      },
+    ]
+  })
+  assume_role_policy = <<EOF
+{
+  "Statement": [
+    {
+      "Effect": "Allow"
+    }
+  ],
+  "Version": "2012-10-17"
+}
+EOF
+  tags_json          = "{\"env\":\"prod\",\"team\":\"core\"}"
+  config             = yamlencode({ replicas = 3 })
+  template = jsonencode(merge(jsondecode(<<EOF
+{"bucket": "${var.bucket}"}
+EOF
+    ), {
+    versioning = true
+  }))
+}`
+	if output := string(result[tfFile].WriteFile.Bytes()); output != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, output)
 	}
 }
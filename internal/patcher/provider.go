@@ -0,0 +1,87 @@
+package patcher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+)
+
+// providerKind is the resource type provider patches are reported with.
+const providerKind = "provider"
+
+// applyProviderPatch applies a patch to the provider blocks of a module that
+// match its address, or removes them.
+func applyProviderPatch(
+	files map[string]*models.HCLFile,
+	patch models.Patch,
+	tracker *conflictTracker,
+) ([]models.AppliedPatch, []string, error) {
+	var applied []models.AppliedPatch
+	var warnings []string
+	for _, path := range sortedPaths(files) {
+		file := files[path]
+		for _, address := range sortedProviderAddresses(file) {
+			provider := file.Providers[address]
+			if !matchesProvider(patch.ProviderConfig, provider) {
+				continue
+			}
+
+			result := models.AppliedPatch{
+				Source:       patch.Source,
+				ResourceType: providerKind,
+				ResourceName: address,
+				File:         path,
+			}
+			if patch.Remove {
+				file.WriteFile.Body().RemoveBlock(provider.Block)
+				delete(file.Providers, address)
+				result.Removed = true
+				if provider.Alias != "" {
+					warnings = append(warnings, fmt.Sprintf(
+						"removed provider %s; declare it in configuration_aliases and pass it from the module call",
+						address))
+				}
+				applied = append(applied, result)
+				continue
+			}
+
+			changes, err := applyBody(provider.Block.Body(), providerKind+"."+address, patch, tracker)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to patch provider %s: %w", address, err)
+			}
+			result.Attributes = changes
+			applied = append(applied, result)
+		}
+	}
+
+	if len(applied) == 0 && !patch.ModuleWide {
+		if models.IsPattern(patch.ProviderConfig) {
+			warnings = append(warnings, fmt.Sprintf("patch for %s matched no provider blocks", describeTarget(patch)))
+			return nil, warnings, nil
+		}
+		return nil, nil, fmt.Errorf("provider %s not found in any file", patch.ProviderConfig)
+	}
+	return applied, warnings, nil
+}
+
+// matchesProvider reports whether a provider block matches the address of a
+// provider patch. An address without an alias matches every configuration
+// of the provider.
+func matchesProvider(pattern string, provider *models.ProviderConfig) bool {
+	name, alias, hasAlias := strings.Cut(pattern, ".")
+	if !matchGlob(name, provider.Name) {
+		return false
+	}
+	return !hasAlias || (provider.Alias != "" && matchGlob(alias, provider.Alias))
+}
+
+func sortedProviderAddresses(file *models.HCLFile) []string {
+	addresses := make([]string, 0, len(file.Providers))
+	for address := range file.Providers {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
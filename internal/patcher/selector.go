@@ -0,0 +1,115 @@
+package patcher
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+)
+
+// patchTarget is a resource matched by a patch, together with the file it is
+// declared in.
+type patchTarget struct {
+	path     string
+	resource *models.Resource
+}
+
+// isSelector reports whether a patch may match any number of resources, as
+// opposed to naming exactly one resource by type and name.
+func isSelector(patch models.Patch) bool {
+	return patch.Provider != "" ||
+		patch.NameRegex != nil ||
+		patch.ResourceType == "" ||
+		patch.ResourceName == "" ||
+		models.IsPattern(patch.ResourceType) ||
+		models.IsPattern(patch.ResourceName)
+}
+
+// findTargets returns the resources matched by patch in file path and
+// resource key order.
+func findTargets(files map[string]*models.HCLFile, patch models.Patch) []patchTarget {
+	var targets []patchTarget
+	for _, filePath := range sortedPaths(files) {
+		file := files[filePath]
+		keys := make([]string, 0, len(file.Resources))
+		for key := range file.Resources {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			resource := file.Resources[key]
+			if matchesResource(patch, resource) {
+				targets = append(targets, patchTarget{path: filePath, resource: resource})
+			}
+		}
+	}
+	return targets
+}
+
+func matchesResource(patch models.Patch, resource *models.Resource) bool {
+	if !matchGlob(patch.ResourceType, resource.Type) || !matchGlob(patch.ResourceName, resource.Name) {
+		return false
+	}
+	if patch.Provider != "" && resourceProvider(resource.Type) != patch.Provider {
+		return false
+	}
+	if patch.NameRegex != nil && !patch.NameRegex.MatchString(resource.Name) {
+		return false
+	}
+	return true
+}
+
+func matchGlob(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+// resourceProvider returns the provider local name implied by a resource type,
+// which is the part before the first underscore.
+func resourceProvider(resourceType string) string {
+	if idx := strings.Index(resourceType, "_"); idx > 0 {
+		return resourceType[:idx]
+	}
+	return resourceType
+}
+
+// describeTarget returns a human-readable description of what a patch selects.
+func describeTarget(patch models.Patch) string {
+	switch patch.Kind {
+	case models.PatchTerraform:
+		return "terraform block"
+	case models.PatchProvider:
+		return "provider " + patch.ProviderConfig
+	case models.PatchCheck:
+		return "check " + patch.CheckName
+	case models.PatchRemoved:
+		return "removed block for " + removedAddress(patch)
+	}
+	if !isSelector(patch) {
+		return models.ResourceKey(patch.ResourceType, patch.ResourceName)
+	}
+
+	var parts []string
+	if patch.ResourceType != "" {
+		parts = append(parts, "type="+patch.ResourceType)
+	}
+	if patch.ResourceName != "" {
+		parts = append(parts, "name="+patch.ResourceName)
+	}
+	if patch.NameRegex != nil {
+		parts = append(parts, "name_regex="+patch.NameRegex.String())
+	}
+	if patch.Provider != "" {
+		parts = append(parts, "provider="+patch.Provider)
+	}
+	if len(parts) == 0 {
+		return "all resources"
+	}
+	return fmt.Sprintf("resources matching %s", strings.Join(parts, ", "))
+}
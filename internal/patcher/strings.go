@@ -0,0 +1,179 @@
+package patcher
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+)
+
+// affixAttribute applies the prefix or suffix strategy. A known string is
+// replaced by the result, a quoted template has the affix spliced in, and any
+// other expression is interpolated into a new template.
+func affixAttribute(body *hclwrite.Body, name string, strategy models.MergeStrategy, value interface{}) error {
+	existingAttr := body.GetAttribute(name)
+	if existingAttr == nil {
+		return fmt.Errorf("cannot add a %s to %s: the attribute is not set", strategy, name)
+	}
+
+	src, parsed, ok := parseExpressionSource(existingAttr.Expr())
+	if !ok {
+		return fmt.Errorf("cannot add a %s to %s: the existing value cannot be parsed", strategy, name)
+	}
+
+	affix, known := value.(cty.Value)
+	if existing, diags := parsed.Value(nil); known && !diags.HasErrors() && isKnownString(existing) {
+		if strategy == models.StrategyPrefix {
+			return replaceAttribute(body, name, cty.StringVal(affix.AsString()+existing.AsString()))
+		}
+		return replaceAttribute(body, name, cty.StringVal(existing.AsString()+affix.AsString()))
+	}
+
+	affixText := "${" + string(bytes.TrimSpace(valueToTokens(value).Bytes())) + "}"
+	if known {
+		affixText = templateText(affix.AsString())
+	}
+
+	existingSrc := parsed.Range().SliceBytes(src)
+	existingText := "${" + string(existingSrc) + "}"
+	if isQuotedTemplate(parsed, existingSrc) {
+		existingText = string(existingSrc[1 : len(existingSrc)-1])
+	}
+
+	if strategy == models.StrategyPrefix {
+		return setAttributeSource(body, name, []byte(`"`+affixText+existingText+`"`))
+	}
+	return setAttributeSource(body, name, []byte(`"`+existingText+affixText+`"`))
+}
+
+// regexReplaceAttribute replaces the matches of pattern in a string attribute.
+// A known string is replaced by the result; any other expression is wrapped
+// in a call to Terraform's replace function, which uses the same regular
+// expression syntax when the pattern is enclosed in slashes.
+func regexReplaceAttribute(body *hclwrite.Body, name, pattern string, value interface{}) error {
+	existingAttr := body.GetAttribute(name)
+	if existingAttr == nil {
+		return fmt.Errorf("cannot replace in %s: the attribute is not set", name)
+	}
+	replacement, ok := value.(cty.Value)
+	if !ok || !isKnownString(replacement) {
+		return fmt.Errorf("cannot replace in %s: the replacement must be a string", name)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("cannot replace in %s: %w", name, err)
+	}
+
+	src, parsed, ok := parseExpressionSource(existingAttr.Expr())
+	if !ok {
+		return fmt.Errorf("cannot replace in %s: the existing value cannot be parsed", name)
+	}
+	if existing, diags := parsed.Value(nil); !diags.HasErrors() && isKnownString(existing) {
+		return replaceAttribute(body, name, cty.StringVal(re.ReplaceAllString(existing.AsString(), replacement.AsString())))
+	}
+
+	wrapped := fmt.Sprintf("replace(%s, %s, %s)",
+		bytes.TrimSpace(parsed.Range().SliceBytes(src)),
+		hclwrite.TokensForValue(cty.StringVal("/"+pattern+"/")).Bytes(),
+		hclwrite.TokensForValue(replacement).Bytes())
+	return setAttributeSource(body, name, []byte(wrapped))
+}
+
+// templateAttribute applies a value that refers to original, the value of the
+// attribute before the patch. When the module's value is a literal, the
+// template is evaluated and its result written; otherwise the module's
+// expression is substituted for original and Terraform evaluates the result.
+// A missing attribute is null.
+func templateAttribute(
+	body *hclwrite.Body,
+	name string,
+	value interface{},
+	functions map[string]function.Function,
+) error {
+	tokens, ok := value.(hclwrite.Tokens)
+	if !ok {
+		return replaceAttribute(body, name, value)
+	}
+	templateSrc := tokens.Bytes()
+	template, diags := hclsyntax.ParseExpression(templateSrc, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return fmt.Errorf("invalid template for %s: %s", name, diags.Error())
+	}
+
+	original := cty.NullVal(cty.DynamicPseudoType)
+	originalSrc := []byte("null")
+	if existingAttr := body.GetAttribute(name); existingAttr != nil {
+		src, parsed, ok := parseExpressionSource(existingAttr.Expr())
+		if !ok {
+			return fmt.Errorf("cannot apply template to %s: the existing value cannot be parsed", name)
+		}
+		originalSrc = parsed.Range().SliceBytes(src)
+		if !isSimpleExpression(parsed) {
+			originalSrc = []byte("(" + string(originalSrc) + ")")
+		}
+		original, diags = parsed.Value(nil)
+		if diags.HasErrors() {
+			original = cty.DynamicVal
+		}
+	}
+
+	if original.IsWhollyKnown() {
+		ctx := &hcl.EvalContext{
+			Variables: map[string]cty.Value{models.OriginalVariable: original},
+			Functions: functions,
+		}
+		if val, diags := template.Value(ctx); !diags.HasErrors() && val.IsWhollyKnown() {
+			return replaceAttribute(body, name, val)
+		}
+	}
+
+	var edits []models.SourceEdit
+	for _, traversal := range template.Variables() {
+		if traversal.RootName() != models.OriginalVariable {
+			continue
+		}
+		rootRange := traversal[0].SourceRange()
+		edits = append(edits, models.SourceEdit{Start: rootRange.Start.Byte, End: rootRange.End.Byte, Text: originalSrc})
+	}
+	return setAttributeSource(body, name, models.ApplySourceEdits(templateSrc, 0, len(templateSrc), edits))
+}
+
+func isKnownString(val cty.Value) bool {
+	return !val.IsNull() && val.IsKnown() && val.Type() == cty.String
+}
+
+// isQuotedTemplate reports whether expr is a quoted string template, whose
+// content a prefix or suffix can be spliced into.
+func isQuotedTemplate(expr hclsyntax.Expression, src []byte) bool {
+	switch expr.(type) {
+	case *hclsyntax.TemplateExpr, *hclsyntax.TemplateWrapExpr:
+		return len(src) >= 2 && src[0] == '"' && src[len(src)-1] == '"'
+	default:
+		return false
+	}
+}
+
+// isSimpleExpression reports whether expr can be substituted into another
+// expression without parentheses.
+func isSimpleExpression(expr hclsyntax.Expression) bool {
+	switch expr.(type) {
+	case *hclsyntax.ScopeTraversalExpr, *hclsyntax.LiteralValueExpr, *hclsyntax.TemplateExpr,
+		*hclsyntax.TemplateWrapExpr, *hclsyntax.FunctionCallExpr, *hclsyntax.TupleConsExpr,
+		*hclsyntax.ObjectConsExpr:
+		return true
+	default:
+		return false
+	}
+}
+
+// templateText returns s escaped for use inside a quoted template.
+func templateText(s string) string {
+	quoted := hclwrite.TokensForValue(cty.StringVal(s)).Bytes()
+	return string(quoted[1 : len(quoted)-1])
+}
@@ -0,0 +1,212 @@
+package patcher
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+)
+
+// terraformKey identifies the terraform block of a module in conflicts.
+const terraformKey = "terraform"
+
+// terraformBody is the body of a terraform block, or of a block nested in
+// one, together with the file it is declared in.
+type terraformBody struct {
+	path string
+	body *hclwrite.Body
+}
+
+// applyTerraformPatch applies a patch to the terraform blocks of a module.
+// An argument or provider requirement is patched wherever the module declares
+// it, including in nested modules shipped with it, so that every pin is
+// relaxed. Arguments the module does not declare are added to the terraform
+// block of its root directory, which is created when missing.
+func applyTerraformPatch(
+	files map[string]*models.HCLFile,
+	patch models.Patch,
+	tracker *conflictTracker,
+) ([]models.AppliedPatch, error) {
+	var paths []string
+	byPath := make(map[string]*models.AppliedPatch)
+	record := func(path string, change models.AttributeChange) {
+		applied, exists := byPath[path]
+		if !exists {
+			applied = &models.AppliedPatch{
+				Source:       patch.Source,
+				ResourceType: terraformKey,
+				File:         path,
+			}
+			byPath[path] = applied
+			paths = append(paths, path)
+		}
+		applied.Attributes = append(applied.Attributes, change)
+	}
+
+	if err := applyTerraformArguments(files, "", patch.Attributes, patch, tracker, record); err != nil {
+		return nil, err
+	}
+	for _, blockType := range sortedBlockTypes(patch) {
+		err := applyTerraformArguments(files, blockType, patch.Blocks[blockType].Attributes, patch, tracker, record)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	applied := make([]models.AppliedPatch, 0, len(paths))
+	for _, path := range paths {
+		applied = append(applied, *byPath[path])
+	}
+	return applied, nil
+}
+
+// applyTerraformArguments applies attrs to the terraform blocks of a module,
+// or to the blockType blocks nested in them when blockType is not empty.
+func applyTerraformArguments(
+	files map[string]*models.HCLFile,
+	blockType string,
+	attrs map[string]*models.PatchAttribute,
+	patch models.Patch,
+	tracker *conflictTracker,
+	record func(path string, change models.AttributeChange),
+) error {
+	prefix := ""
+	if blockType != "" {
+		prefix = blockType + "."
+	}
+
+	for _, name := range sortedAttributeNames(attrs) {
+		patchAttr := attrs[name]
+		if err := tracker.claim(terraformKey, prefix+name, patch, patchAttr); err != nil {
+			return err
+		}
+
+		var targets []terraformBody
+		for _, candidate := range terraformBodies(files, blockType) {
+			if candidate.body.GetAttribute(name) != nil {
+				targets = append(targets, candidate)
+			}
+		}
+		if len(targets) == 0 {
+			target, err := rootTerraformBody(files, blockType)
+			if err != nil {
+				return err
+			}
+			targets = append(targets, target)
+		}
+
+		for _, target := range targets {
+			before := attributeText(target.body, name)
+			if err := applyAttribute(target.body, name, patchAttr); err != nil {
+				return fmt.Errorf("failed to apply attribute %s%s: %w", prefix, name, err)
+			}
+			change := models.AttributeChange{
+				Name:     prefix + name,
+				Strategy: patchAttr.Strategy.String(),
+				Before:   before,
+			}
+			if after := attributeText(target.body, name); after != nil {
+				change.After = *after
+			}
+			record(target.path, change)
+		}
+	}
+	return nil
+}
+
+// terraformBodies returns the bodies of the terraform blocks of files, or of
+// the blockType blocks nested in them, in file path order.
+func terraformBodies(files map[string]*models.HCLFile, blockType string) []terraformBody {
+	var bodies []terraformBody
+	for _, path := range sortedPaths(files) {
+		for _, block := range files[path].TerraformBlocks {
+			if blockType == "" {
+				bodies = append(bodies, terraformBody{path: path, body: block.Body()})
+				continue
+			}
+			for _, nested := range block.Body().Blocks() {
+				if nested.Type() == blockType {
+					bodies = append(bodies, terraformBody{path: path, body: nested.Body()})
+				}
+			}
+		}
+	}
+	return bodies
+}
+
+// rootTerraformBody returns the first terraform block in the root directory
+// of the module, or the first blockType block nested in one, creating the
+// blocks when they do not exist.
+func rootTerraformBody(files map[string]*models.HCLFile, blockType string) (terraformBody, error) {
+	rootDir, ok := moduleRootDir(files)
+	if !ok {
+		return terraformBody{}, fmt.Errorf("module has no files to add a terraform block to")
+	}
+
+	if blockType != "" {
+		for _, candidate := range terraformBodies(files, blockType) {
+			if filepath.Dir(candidate.path) == rootDir {
+				return candidate, nil
+			}
+		}
+	}
+
+	var root *terraformBody
+	for _, candidate := range terraformBodies(files, "") {
+		if filepath.Dir(candidate.path) == rootDir {
+			root = &candidate
+			break
+		}
+	}
+	if root == nil {
+		path, block := appendModuleBlock(files, rootDir, terraformKey, nil)
+		files[path].TerraformBlocks = append(files[path].TerraformBlocks, block)
+		root = &terraformBody{path: path, body: block.Body()}
+	}
+
+	if blockType == "" {
+		return *root, nil
+	}
+	nested := root.body.AppendNewBlock(blockType, nil)
+	return terraformBody{path: root.path, body: nested.Body()}, nil
+}
+
+// appendModuleBlock adds an empty top-level block to the first file of dir
+// and returns the path of that file.
+func appendModuleBlock(
+	files map[string]*models.HCLFile,
+	dir string,
+	blockType string,
+	labels []string,
+) (string, *hclwrite.Block) {
+	for _, path := range sortedPaths(files) {
+		if filepath.Dir(path) != dir {
+			continue
+		}
+		body := files[path].WriteFile.Body()
+		if len(body.Attributes()) > 0 || len(body.Blocks()) > 0 {
+			body.AppendNewline()
+		}
+		return path, body.AppendNewBlock(blockType, labels)
+	}
+	return "", nil
+}
+
+// moduleRootDir returns the shallowest directory of files, the root of the
+// module they belong to.
+func moduleRootDir(files map[string]*models.HCLFile) (string, bool) {
+	rootDir := ""
+	for _, path := range sortedPaths(files) {
+		dir := filepath.Dir(path)
+		if rootDir == "" || depth(dir) < depth(rootDir) {
+			rootDir = dir
+		}
+	}
+	return rootDir, rootDir != ""
+}
+
+func depth(dir string) int {
+	return strings.Count(filepath.ToSlash(dir), "/")
+}
@@ -0,0 +1,432 @@
+package patcher
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// objectPatch is an object merged into an existing object literal, keyed by
+// item name.
+type objectPatch map[string]patchItem
+
+// patchItem is an item of an objectPatch: the HCL source of its value, and
+// its own items when the value is an object or the strategy to apply to the
+// key when the value is a nested marker such as kf::append([...]).
+type patchItem struct {
+	text   []byte
+	object objectPatch
+	marker *models.PatchAttribute
+}
+
+// objectPatchFor reads an object patch value into its items, attaching the
+// strategy markers nested in it to the keys they are nested under.
+func objectPatchFor(patch interface{}, nested map[string]*models.NestedMarker) (objectPatch, bool) {
+	switch v := patch.(type) {
+	case cty.Value:
+		if !isMergeableValue(v) {
+			return nil, false
+		}
+		return objectPatchForValue(v), true
+	case hclwrite.Tokens:
+		src := v.Bytes()
+		parsed, diags := hclsyntax.ParseExpression(src, "", hcl.Pos{Line: 1, Column: 1, Byte: 0})
+		if diags.HasErrors() {
+			return nil, false
+		}
+		obj, ok := parsed.(*hclsyntax.ObjectConsExpr)
+		if !ok {
+			return nil, false
+		}
+		return objectPatchForSource(src, obj, nested)
+	default:
+		return nil, false
+	}
+}
+
+func objectPatchForValue(val cty.Value) objectPatch {
+	items := make(objectPatch)
+	for key, itemVal := range val.AsValueMap() {
+		item := patchItem{text: bytes.TrimSpace(valueToTokens(itemVal).Bytes())}
+		if isMergeableValue(itemVal) {
+			item.object = objectPatchForValue(itemVal)
+		}
+		items[key] = item
+	}
+	return items
+}
+
+// objectPatchForSource reads the items of a verbatim object literal. It
+// reports false when a key is not a literal name.
+func objectPatchForSource(
+	src []byte,
+	obj *hclsyntax.ObjectConsExpr,
+	nested map[string]*models.NestedMarker,
+) (objectPatch, bool) {
+	items := make(objectPatch)
+	for _, objItem := range obj.Items {
+		key, ok := objectKeyName(objItem.KeyExpr)
+		if !ok {
+			return nil, false
+		}
+		item := patchItem{text: objItem.ValueExpr.Range().SliceBytes(src)}
+		marker := nested[key]
+		if object, isObject := objItem.ValueExpr.(*hclsyntax.ObjectConsExpr); isObject {
+			var markers map[string]*models.NestedMarker
+			if marker != nil {
+				markers = marker.Object
+			}
+			if item.object, ok = objectPatchForSource(src, object, markers); !ok {
+				return nil, false
+			}
+		}
+		if marker != nil {
+			item.marker = marker.Attribute
+		}
+		items[key] = item
+	}
+	return items, true
+}
+
+// appendListInPlace appends the elements of patch to an existing tuple literal
+// by editing its source, keeping existing elements and comments intact. With
+// unique set, elements already in the list are not appended again. It reports
+// false when the existing expression is not a tuple literal or the patch is
+// not a known list or tuple.
+func appendListInPlace(expr *hclwrite.Expression, patch interface{}, unique bool) (hclwrite.Tokens, bool) {
+	elements, ok := listElementSources(patch)
+	if !ok {
+		return nil, false
+	}
+
+	src, parsed, ok := parseExpressionSource(expr)
+	if !ok {
+		return nil, false
+	}
+
+	tuple, ok := parsed.(*hclsyntax.TupleConsExpr)
+	if !ok {
+		return nil, false
+	}
+
+	if unique {
+		elements = newElements(src, tuple, elements)
+	}
+	return tokensForSource(appendListSource(src, tuple, elements))
+}
+
+// listElementSources renders the elements of a list patch value as HCL
+// source. Verbatim values must be tuple literals.
+func listElementSources(patch interface{}) ([]string, bool) {
+	switch v := patch.(type) {
+	case cty.Value:
+		if !isListValue(v) {
+			return nil, false
+		}
+		elements := make([]string, 0, v.LengthInt())
+		for _, element := range v.AsValueSlice() {
+			elements = append(elements, string(bytes.TrimSpace(valueToTokens(element).Bytes())))
+		}
+		return elements, true
+	case hclwrite.Tokens:
+		src := v.Bytes()
+		parsed, diags := hclsyntax.ParseExpression(src, "", hcl.Pos{Line: 1, Column: 1, Byte: 0})
+		if diags.HasErrors() {
+			return nil, false
+		}
+		tuple, ok := parsed.(*hclsyntax.TupleConsExpr)
+		if !ok {
+			return nil, false
+		}
+		elements := make([]string, 0, len(tuple.Exprs))
+		for _, element := range tuple.Exprs {
+			elements = append(elements, string(element.Range().SliceBytes(src)))
+		}
+		return elements, true
+	default:
+		return nil, false
+	}
+}
+
+// newElements returns the elements that tuple does not already contain,
+// comparing their source with whitespace removed.
+func newElements(src []byte, tuple *hclsyntax.TupleConsExpr, elements []string) []string {
+	existing := make(map[string]bool, len(tuple.Exprs))
+	for _, expr := range tuple.Exprs {
+		existing[compactSource(expr.Range().SliceBytes(src))] = true
+	}
+
+	var result []string
+	for _, element := range elements {
+		key := compactSource([]byte(element))
+		if existing[key] {
+			continue
+		}
+		existing[key] = true
+		result = append(result, element)
+	}
+	return result
+}
+
+func compactSource(src []byte) string {
+	return strings.Join(strings.Fields(string(src)), "")
+}
+
+func isMergeableValue(val cty.Value) bool {
+	if val.IsNull() || !val.IsWhollyKnown() {
+		return false
+	}
+	ty := val.Type()
+	return ty.IsObjectType() || ty.IsMapType()
+}
+
+func isListValue(val cty.Value) bool {
+	if val.IsNull() || !val.IsWhollyKnown() {
+		return false
+	}
+	ty := val.Type()
+	return ty.IsTupleType() || ty.IsListType() || ty.IsSetType()
+}
+
+func parseExpressionSource(expr *hclwrite.Expression) ([]byte, hclsyntax.Expression, bool) {
+	// A heredoc is only terminated by the newline after its closing marker,
+	// which belongs to the attribute rather than the expression.
+	src := append(expr.BuildTokens(nil).Bytes(), '\n')
+	parsed, diags := hclsyntax.ParseExpression(src, "", hcl.Pos{Line: 1, Column: 1, Byte: 0})
+	if diags.HasErrors() {
+		return nil, nil, false
+	}
+	return src, parsed, true
+}
+
+// tokensForSource converts HCL expression source back into hclwrite tokens.
+func tokensForSource(src []byte) (hclwrite.Tokens, bool) {
+	wrapped := append([]byte("value = "), bytes.TrimSpace(src)...)
+	wrapped = append(wrapped, '\n')
+
+	file, diags := hclwrite.ParseConfig(wrapped, "", hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		return nil, false
+	}
+	attr := file.Body().GetAttribute("value")
+	if attr == nil {
+		return nil, false
+	}
+	return attr.Expr().BuildTokens(nil), true
+}
+
+// mergeObjectSource returns the source of obj with the keys of patch merged
+// in. Existing keys are edited in place and new keys are inserted before the
+// closing brace in sorted order. The merge strategy recurses into nested
+// object literals, shallow_merge replaces the value of existing keys as a
+// whole, and defaults keeps them, only adding the keys that are missing. A key
+// whose patch value is a nested marker has the marker's strategy applied to
+// it, whatever the strategy of the object.
+func mergeObjectSource(
+	src []byte,
+	obj *hclsyntax.ObjectConsExpr,
+	patch objectPatch,
+	strategy models.MergeStrategy,
+) ([]byte, error) {
+	patchMap := make(objectPatch, len(patch))
+	for key, item := range patch {
+		patchMap[key] = item
+	}
+	var edits []models.SourceEdit
+
+	for _, item := range obj.Items {
+		key, ok := objectKeyName(item.KeyExpr)
+		if !ok {
+			continue
+		}
+		patchItem, exists := patchMap[key]
+		if !exists {
+			continue
+		}
+		delete(patchMap, key)
+
+		valueRange := item.ValueExpr.Range()
+		text := patchItem.text
+		nested, isObject := item.ValueExpr.(*hclsyntax.ObjectConsExpr)
+		switch {
+		case patchItem.marker != nil:
+			applied, err := applyToSource(key, valueRange.SliceBytes(src), patchItem.marker)
+			if err != nil {
+				return nil, err
+			}
+			text = applied
+		case isObject && patchItem.object != nil && strategy != models.StrategyShallowMerge:
+			merged, err := mergeObjectSource(src, nested, patchItem.object, strategy)
+			if err != nil {
+				return nil, err
+			}
+			text = merged
+		case strategy == models.StrategyDefaults:
+			// The module's value wins.
+			continue
+		}
+		edits = append(edits, models.SourceEdit{
+			Start: valueRange.Start.Byte,
+			End:   valueRange.End.Byte,
+			Text:  bytes.TrimSpace(text),
+		})
+	}
+
+	for key, item := range patchMap {
+		if item.marker == nil {
+			continue
+		}
+		applied, err := applyToSource(key, nil, item.marker)
+		if err != nil {
+			return nil, err
+		}
+		if applied == nil {
+			delete(patchMap, key)
+			continue
+		}
+		patchMap[key] = patchItem{text: applied}
+	}
+
+	if len(patchMap) > 0 {
+		edits = append(edits, objectInsertEdit(src, obj, patchMap))
+	}
+
+	return models.ApplySourceEdits(src, obj.SrcRange.Start.Byte, obj.SrcRange.End.Byte, edits), nil
+}
+
+// hasNestedMarkers reports whether an object patch has nested markers at any
+// depth.
+func hasNestedMarkers(patch objectPatch) bool {
+	for _, item := range patch {
+		if item.marker != nil || hasNestedMarkers(item.object) {
+			return true
+		}
+	}
+	return false
+}
+
+func objectInsertEdit(src []byte, obj *hclsyntax.ObjectConsExpr, newItems objectPatch) models.SourceEdit {
+	keys := make([]string, 0, len(newItems))
+	for key := range newItems {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	items := make([]string, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, objectKeySource(key)+" = "+string(newItems[key].text))
+	}
+
+	start, end := obj.SrcRange.Start.Byte, obj.SrcRange.End.Byte
+	closing := end - 1
+
+	if !bytes.ContainsRune(src[start:end], '\n') {
+		if len(obj.Items) == 0 {
+			return models.SourceEdit{Start: closing, End: closing, Text: []byte(" " + strings.Join(items, ", ") + " ")}
+		}
+		lastEnd := obj.Items[len(obj.Items)-1].ValueExpr.Range().End.Byte
+		return models.SourceEdit{Start: lastEnd, End: lastEnd, Text: []byte(", " + strings.Join(items, ", "))}
+	}
+
+	text := strings.Join(items, "\n") + "\n"
+	if lineStart, ownLine := ownLineStart(src, start, closing); ownLine {
+		return models.SourceEdit{Start: lineStart, End: lineStart, Text: []byte(text)}
+	}
+	return models.SourceEdit{Start: closing, End: closing, Text: []byte("\n" + text)}
+}
+
+// appendListSource returns the source of tuple with the rendered elements
+// appended after the existing elements, following the tuple's existing comma
+// style.
+func appendListSource(src []byte, tuple *hclsyntax.TupleConsExpr, rendered []string) []byte {
+	start, end := tuple.SrcRange.Start.Byte, tuple.SrcRange.End.Byte
+	if len(rendered) == 0 {
+		return src[start:end]
+	}
+
+	closing := end - 1
+	if len(tuple.Exprs) == 0 {
+		edit := models.SourceEdit{Start: closing, End: closing, Text: []byte(strings.Join(rendered, ", "))}
+		return models.ApplySourceEdits(src, start, end, []models.SourceEdit{edit})
+	}
+
+	lastEnd := tuple.Exprs[len(tuple.Exprs)-1].Range().End.Byte
+	if !bytes.ContainsRune(src[start:end], '\n') {
+		edit := models.SourceEdit{Start: lastEnd, End: lastEnd, Text: []byte(", " + strings.Join(rendered, ", "))}
+		return models.ApplySourceEdits(src, start, end, []models.SourceEdit{edit})
+	}
+
+	hasComma := hasTrailingComma(src, lastEnd)
+	var edits []models.SourceEdit
+	if !hasComma {
+		edits = append(edits, models.SourceEdit{Start: lastEnd, End: lastEnd, Text: []byte(",")})
+	}
+
+	text := strings.Join(rendered, ",\n") + ",\n"
+	if lineStart, ownLine := ownLineStart(src, start, closing); ownLine {
+		edits = append(edits, models.SourceEdit{Start: lineStart, End: lineStart, Text: []byte(text)})
+	} else {
+		edits = append(edits, models.SourceEdit{Start: closing, End: closing, Text: []byte("\n" + text)})
+	}
+	return models.ApplySourceEdits(src, start, end, edits)
+}
+
+// hasTrailingComma reports whether the element ending at lastEnd is followed
+// by a comma on the same line.
+func hasTrailingComma(src []byte, lastEnd int) bool {
+	pos := lastEnd
+	for pos < len(src) && (src[pos] == ' ' || src[pos] == '\t') {
+		pos++
+	}
+	return pos < len(src) && src[pos] == ','
+}
+
+// ownLineStart returns the start of the line holding the token at pos, such
+// as a closing bracket or a list element, and whether only whitespace
+// precedes it on that line.
+func ownLineStart(src []byte, start, pos int) (int, bool) {
+	for pos := pos - 1; pos > start; pos-- {
+		switch src[pos] {
+		case '\n':
+			return pos + 1, true
+		case ' ', '\t':
+			continue
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// objectKeySource returns key as an object key, quoted unless it is a valid
+// identifier.
+func objectKeySource(key string) string {
+	if hclsyntax.ValidIdentifier(key) {
+		return key
+	}
+	return string(hclwrite.TokensForValue(cty.StringVal(key)).Bytes())
+}
+
+// objectKeyName returns the literal name of an object key, whether it is
+// written as a bare identifier, a quoted string or a number.
+func objectKeyName(expr hclsyntax.Expression) (string, bool) {
+	if keyword := hcl.ExprAsKeyword(expr); keyword != "" {
+		return keyword, true
+	}
+	val, diags := expr.Value(nil)
+	if diags.HasErrors() || val.IsNull() || !val.IsKnown() {
+		return "", false
+	}
+	str, err := convert.Convert(val, cty.String)
+	if err != nil {
+		return "", false
+	}
+	return str.AsString(), true
+}
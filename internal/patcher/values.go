@@ -0,0 +1,78 @@
+package patcher
+
+import (
+	"fmt"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// valueToTokens renders a patch attribute value as HCL. HCL writes maps like
+// objects and lists and sets like tuples; Terraform converts them back to the
+// type the module declares.
+func valueToTokens(value interface{}) hclwrite.Tokens {
+	switch v := value.(type) {
+	case cty.Value:
+		return hclwrite.TokensForValue(v)
+	case hclwrite.Tokens:
+		return v
+	}
+
+	normalized, err := models.NormalizeValue(value)
+	if err != nil {
+		// checkPatchValues rejects these values before any patch is applied.
+		return hclwrite.TokensForValue(cty.NullVal(cty.DynamicPseudoType))
+	}
+	return valueToTokens(normalized)
+}
+
+// checkPatchValues reports the first attribute of patches whose value cannot
+// be written to a module, such as a Go value with no cty equivalent or a
+// value that is not known.
+func checkPatchValues(patches []models.Patch) error {
+	for _, patch := range patches {
+		if err := checkAttributeValues(patch.Attributes, ""); err != nil {
+			return fmt.Errorf("invalid patch for %s: %w", describeTarget(patch), err)
+		}
+		for blockType, block := range patch.Blocks {
+			if err := checkAttributeValues(block.Attributes, blockType+"."); err != nil {
+				return fmt.Errorf("invalid patch for %s: %w", describeTarget(patch), err)
+			}
+			if err := checkAddedBlockValues(block.Added, blockType+"."); err != nil {
+				return fmt.Errorf("invalid patch for %s: %w", describeTarget(patch), err)
+			}
+		}
+		if err := checkAddedBlockValues(patch.Added, ""); err != nil {
+			return fmt.Errorf("invalid patch for %s: %w", describeTarget(patch), err)
+		}
+	}
+	return nil
+}
+
+func checkAddedBlockValues(blocks []*models.AddedBlock, prefix string) error {
+	for _, block := range blocks {
+		if err := checkAttributeValues(block.Attributes, prefix+block.Type+"."); err != nil {
+			return err
+		}
+		if err := checkAddedBlockValues(block.Blocks, prefix+block.Type+"."); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAttributeValues checks the values of attrs. Attributes that refer to
+// the module call are skipped: their value is evaluated, and checked to be
+// known, for each call.
+func checkAttributeValues(attrs map[string]*models.PatchAttribute, prefix string) error {
+	for name, attr := range attrs {
+		if attr.Expr != nil {
+			continue
+		}
+		if _, err := models.NormalizeValue(attr.Value); err != nil {
+			return fmt.Errorf("%s%s: %w", prefix, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package patcher
+
+import (
+	"strings"
+
+	"github.com/dragonfleas/kungfu/internal/models"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// resolvedAttribute is the existing configuration found at a condition path.
+type resolvedAttribute struct {
+	present bool
+	// value is the evaluated value, or cty.NilVal when the configuration is a
+	// nested block or an expression that cannot be evaluated statically.
+	value cty.Value
+	// keys are the literal keys of an object expression, used when the value
+	// itself cannot be evaluated.
+	keys []string
+}
+
+// matchesConditions reports whether every where condition of patch holds
+// for the resource.
+func matchesConditions(patch models.Patch, resource *models.Resource) bool {
+	for _, condition := range patch.Where {
+		resolved := resolveAttribute(resource.Block.Body(), strings.Split(condition.Attribute, "."))
+		if !evaluateCondition(condition, resolved) {
+			return false
+		}
+	}
+	return true
+}
+
+func resolveAttribute(body *hclwrite.Body, path []string) resolvedAttribute {
+	if attr := body.GetAttribute(path[0]); attr != nil {
+		resolved := resolvedAttribute{present: true, value: cty.NilVal}
+		if val, ok := extractValue(*attr.Expr()).(cty.Value); ok {
+			resolved.value = val
+		} else if len(path) == 1 {
+			resolved.keys = literalObjectKeys(attr.Expr())
+		}
+
+		for _, step := range path[1:] {
+			if !isMergeableValue(resolved.value) {
+				return resolvedAttribute{}
+			}
+			next, exists := resolved.value.AsValueMap()[step]
+			if !exists {
+				return resolvedAttribute{}
+			}
+			resolved.value = next
+		}
+		return resolved
+	}
+
+	for _, block := range body.Blocks() {
+		if block.Type() != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return resolvedAttribute{present: true, value: cty.NilVal}
+		}
+		return resolveAttribute(block.Body(), path[1:])
+	}
+
+	return resolvedAttribute{}
+}
+
+func literalObjectKeys(expr *hclwrite.Expression) []string {
+	_, parsed, ok := parseExpressionSource(expr)
+	if !ok {
+		return nil
+	}
+	obj, ok := parsed.(*hclsyntax.ObjectConsExpr)
+	if !ok {
+		return nil
+	}
+
+	keys := make([]string, 0, len(obj.Items))
+	for _, item := range obj.Items {
+		if key, isLiteral := objectKeyName(item.KeyExpr); isLiteral {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func evaluateCondition(condition models.Condition, resolved resolvedAttribute) bool {
+	switch condition.Operator {
+	case models.ConditionPresent:
+		return resolved.present == condition.Value.True()
+	case models.ConditionEquals:
+		return valuesEqual(resolved.value, condition.Value)
+	case models.ConditionNotEquals:
+		return !valuesEqual(resolved.value, condition.Value)
+	case models.ConditionPrefix:
+		str, ok := knownString(resolved.value)
+		return ok && strings.HasPrefix(str, condition.Value.AsString())
+	case models.ConditionSuffix:
+		str, ok := knownString(resolved.value)
+		return ok && strings.HasSuffix(str, condition.Value.AsString())
+	case models.ConditionMatches:
+		str, ok := knownString(resolved.value)
+		return ok && condition.Pattern.MatchString(str)
+	case models.ConditionContains:
+		return listContains(resolved.value, condition.Value)
+	case models.ConditionHasKey:
+		hasKey, known := objectHasKey(resolved, condition.Value.AsString())
+		return known && hasKey
+	case models.ConditionLacksKey:
+		hasKey, known := objectHasKey(resolved, condition.Value.AsString())
+		return known && !hasKey
+	default:
+		return false
+	}
+}
+
+func valuesEqual(existing, want cty.Value) bool {
+	if existing == cty.NilVal || !existing.IsWhollyKnown() {
+		return false
+	}
+	return existing.Equals(want).True()
+}
+
+func knownString(val cty.Value) (string, bool) {
+	if val == cty.NilVal || val.IsNull() || !val.IsKnown() || val.Type() != cty.String {
+		return "", false
+	}
+	return val.AsString(), true
+}
+
+func listContains(existing, want cty.Value) bool {
+	if existing == cty.NilVal || existing.IsNull() || !existing.IsWhollyKnown() || !existing.CanIterateElements() {
+		return false
+	}
+	ty := existing.Type()
+	if !ty.IsListType() && !ty.IsTupleType() && !ty.IsSetType() {
+		return false
+	}
+	for _, element := range existing.AsValueSlice() {
+		if element.Equals(want).True() {
+			return true
+		}
+	}
+	return false
+}
+
+// objectHasKey reports whether the resolved attribute has key, and whether
+// that could be determined at all. A missing attribute has no keys.
+func objectHasKey(resolved resolvedAttribute, key string) (bool, bool) {
+	if !resolved.present {
+		return false, true
+	}
+	if resolved.value != cty.NilVal && !resolved.value.IsNull() {
+		ty := resolved.value.Type()
+		if ty.IsObjectType() {
+			return ty.HasAttribute(key), true
+		}
+		if ty.IsMapType() && resolved.value.IsKnown() {
+			return resolved.value.HasIndex(cty.StringVal(key)).True(), true
+		}
+		return false, false
+	}
+	if resolved.keys != nil {
+		for _, existing := range resolved.keys {
+			if existing == key {
+				return true, true
+			}
+		}
+		return false, true
+	}
+	return false, false
+}